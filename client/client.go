@@ -3,12 +3,22 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
 )
 
 type clientState int
@@ -17,8 +27,52 @@ const (
 	stateLogin clientState = iota
 	statePassword
 	stateChat
+	stateRoomMenu
+	stateDisconnected
 )
 
+// roomListPrefix starts the server's one-line reply to /rooms.
+const roomListPrefix = "Rooms: "
+
+// The server frames its connect banner with these lines.
+const (
+	bannerStart = "[banner]"
+	bannerEnd   = "[/banner]"
+)
+
+// urlPattern finds links in messages so View can make them clickable.
+var urlPattern = regexp.MustCompile(`https?://[^\s]+[^\s.,;:!?)'"]`)
+
+// restartPrefix starts the server's signal that it's about to restart,
+// followed by the seconds until it expects to be back.
+const restartPrefix = "[restart] "
+
+// commandPrefixLine is the server telling us, before the welcome, that its
+// commands start with something other than "/": "[commands] !".
+const commandPrefixLine = "[commands] "
+
+// preferenceLine starts a preference saved on the server with /set, sent
+// after the welcome and whenever it changes: "[pref] notify pm". See
+// applyPreference.
+const preferenceLine = "[pref] "
+
+// onlineListPrefix starts the server's one-line reply to /who.
+const onlineListPrefix = "Online: "
+
+// messageIDPrefix starts a room message the server kept, followed by its ID
+// for /report: "[id 42] alice: hi". The client strips it and keeps the ID.
+const messageIDPrefix = "[id "
+
+// serverLineMsg is one line received from the server.
+type serverLineMsg string
+
+// serverErrMsg reports that reading from the server over conn stopped; err
+// is nil when the server closed the connection cleanly.
+type serverErrMsg struct {
+	conn net.Conn
+	err  error
+}
+
 type model struct {
 	messages  []string
 	input     string
@@ -26,31 +80,198 @@ type model struct {
 	exit      bool
 	state     clientState
 	prevState clientState
+
+	// Room selection menu, filled from the server's /rooms reply
+	rooms         []string // entries as listed, e.g. "#general (3)"
+	roomCursor    int
+	awaitingRooms bool
+
+	// Terminal rows, from Bubble Tea's window size reports; 0 until the
+	// first, or when unknown. Only the room menu needs it: the renderer
+	// already cuts lines to the width and keeps the bottom rows of the chat.
+	height int
+
+	// Presence: who we are and who else is online, kept up to date from
+	// /who replies and join/leave notices.
+	username string
+	online   map[string]bool
+
+	// Tab completion of usernames; repeated Tab cycles through completions.
+	completions   []string
+	completionIdx int
+	completionAt  int // offset in input where the completed name starts
+
+	// Users whose messages are received but not displayed (/ignore)
+	ignored map[string]bool
+
+	pms []pm // recent PMs sent and received, for /pms (see pms.go)
+
+	inBanner bool // between bannerStart and bannerEnd
+
+	// What the server has told us about itself and where we are, for
+	// /server (see serverinfo.go)
+	banner      []string // lines of its last banner
+	room, topic string
+
+	altScreen  bool // draw on the terminal's alternate screen (-alt-screen)
+	hyperlinks bool // render URLs as OSC 8 terminal hyperlinks
+	plain      bool // no colors or other terminal styles (-no-color, NO_COLOR)
+	scrollback int  // most messages kept; older ones are dropped (0 keeps all)
+
+	// Display options (see display.go)
+	timestamps   timestampMode
+	timestampsOn timestampMode // format "/timestamps on" switches to
+	nameWidth    int           // longest sender name shown in full (0 is unlimited)
+	alignNames   bool          // pad chat senders' names to nameWidth so messages line up
+	colorNames   bool          // draw each sender's name in its own color
+	stamps       []time.Time   // when each of messages arrived; kept in step by Update
+	showIDs      bool          // show the server's message IDs, for /report
+	ids          []int64       // server ID of each of messages, 0 for none; kept in step by Update
+
+	readReceipts bool       // tell senders when their PMs have been shown (/read)
+	notify       notifyMode // which messages ring the bell (-notify, /notify)
+	notifyOn     notifyMode // mode "/notify on" switches to
+	bell         bool       // the last update received a line that rings the bell; View writes it
+
+	expandNotices bool // show join/leave runs in full rather than summarized (Ctrl+O)
+
+	follow bool // read-only after login: no input line, keys other than Ctrl+C ignored
+
+	confirmQuit bool // ask before quitting with unsent input (-confirm-quit)
+	quitPrompt  bool // showing "Quit? [y/N]"; kept apart from state so the session carries on underneath
+
+	// Flood protection: chat input sent within sendInterval of the last send
+	// stays in the input line, with a hint, rather than going out
+	sendInterval time.Duration // 0 disables
+	lastSend     time.Time
+	slowDown     bool // showing the hint; cleared by the next key
+
+	// Line editing (see editing.go)
+	editMode   editMode
+	cursor     int    // rune offset into input
+	killBuffer string // last text killed with Ctrl-K/U/W, for Ctrl-Y
+	vimNormal  bool   // vim mode: normal (command) rather than insert
+
+	// Reconnecting after the connection drops (see reconnect.go)
+	addr           string
+	tlsConfig      *tls.Config    // dial with TLS (-tls); nil for plain TCP
+	listen         func(net.Conn) // starts delivering a connection's lines
+	reconnectLogin reconnectLogin
+	dialing        bool
+	restartIn      time.Duration // announced by the server before it closes for a restart
+	autoRetries    int           // automatic reconnect attempts left after a restart
+	usernamePrompt bool          // the server's last line asked for a username
+	commandPrefix  string        // what the server's commands start with, if it said; "" means "/"
+	loginName      string        // filled in at the username prompt (-username)
+	pending, saved credentials   // reuse only: the login being typed, and the last one that worked
+	queued         []string      // chat that failed to send or was typed while disconnected, flushed after the next login
+	queuedAs       string        // username the queued messages were written as
 }
 
+// Init returns the commands that set up the terminal: the alternate screen
+// under -alt-screen, and a query for the window size, so the first frame
+// is laid out for it.
 func (m model) Init() tea.Cmd {
-	return nil
+	cmds := []tea.Cmd{tea.WindowSize()}
+	if m.altScreen {
+		cmds = append(cmds, tea.EnterAltScreen)
+	}
+	return tea.Batch(cmds...)
 }
 
+// Update handles msg, stamps the lines it added with the time (and gives
+// them no ID unless the handler did), then trims the scrollback to its
+// maximum. A bell belongs to the frame after the line that rang it, so it's
+// cleared first.
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	m.bell = false
+	next, cmd := m.update(msg)
+	nm, ok := next.(model)
+	if !ok {
+		return next, cmd
+	}
+	for now := time.Now(); len(nm.stamps) < len(nm.messages); {
+		nm.stamps = append(nm.stamps, now)
+	}
+	for len(nm.ids) < len(nm.messages) {
+		nm.ids = append(nm.ids, 0)
+	}
+	if nm.scrollback > 0 && len(nm.messages) > nm.scrollback {
+		// Slicing keeps memory bounded: append reallocates with only the
+		// retained lines once capacity runs out
+		nm.messages = nm.messages[len(nm.messages)-nm.scrollback:]
+		nm.stamps = nm.stamps[len(nm.stamps)-nm.scrollback:]
+		nm.ids = nm.ids[len(nm.ids)-nm.scrollback:]
+	}
+	return nm, cmd
+}
+
+func (m model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	switch msg := msg.(type) {
 
 	// ─────────────────────────────────────────────────────────────────────────────
 	// KEYBOARD INPUT:
 	// ─────────────────────────────────────────────────────────────────────────────
 	case tea.KeyMsg:
+		if m.quitPrompt {
+			return m.answerQuit(msg)
+		}
+		if m.state == stateRoomMenu {
+			return m.updateRoomMenu(msg)
+		}
+		if m.state == stateDisconnected {
+			return m.updateDisconnected(msg)
+		}
+		// Once logged in, follow mode only displays
+		if m.follow && m.state == stateChat {
+			if msg.Type == tea.KeyCtrlC {
+				return m.quit()
+			}
+			return m, nil
+		}
+		if msg.Type != tea.KeyTab {
+			m.completions = nil
+		}
+		m.slowDown = false
 		switch msg.Type {
+		case tea.KeyCtrlC:
+			return m.quit()
+
+		case tea.KeyCtrlO:
+			m.expandNotices = !m.expandNotices
+
+		case tea.KeyTab:
+			m = m.completeUsername()
+			m.cursor = len([]rune(m.input))
+
 		case tea.KeyEnter:
 			if m.conn != nil && len(m.input) > 0 {
-				if m.input == "/exit" {
-					return m.exitProgram()
+				if m.input == m.serverCommand("exit") {
+					m.input, m.cursor = "", 0
+					return m.quit()
+				}
+				if handled, next, cmd := m.localCommand(m.input); handled {
+					next.input, next.cursor = "", 0
+					return next, cmd
+				}
+				// Too soon after the last send: likely a held or doubled Enter
+				if m.state == stateChat && m.sendInterval > 0 && time.Since(m.lastSend) < m.sendInterval {
+					m.slowDown = true
+					return m, nil
 				}
 				// Send typed input to the server
-				fmt.Fprintln(m.conn, m.input)
+				m = m.noteLogin(m.input)
+				if _, err := fmt.Fprintln(m.conn, m.input); err != nil {
+					return m.sendFailed(err)
+				}
+				m.lastSend = time.Now()
+				if m.input == m.serverCommand("rooms") {
+					m.awaitingRooms = true
+				}
 
-				// If in chat mode, display local message
-				if m.state == stateChat {
-					m.messages = append(m.messages, "You: "+m.input)
+				// If in chat mode, display local message (commands aren't chat)
+				if text, chat := m.asChat(m.input); m.state == stateChat && chat {
+					m.messages = append(m.messages, "You: "+text)
 				}
 
 				// If we’re in hidden password mode, revert to previous state after sending
@@ -58,119 +279,722 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.state = m.prevState
 				}
 			}
-			m.input = "" // Clear input on enter
-
-		case tea.KeyBackspace:
-			if len(m.input) > 0 {
-				m.input = m.input[:len(m.input)-1]
-			}
+			m.input, m.cursor = "", 0 // Clear input on enter
+			m.vimNormal = false
 
 		default:
-			// If we’re in password mode, do not echo typed chars
-			if m.state == statePassword {
-				m.input += msg.String() // stored but not displayed
-			} else {
-				// Normal state => echo typed chars
-				m.input += msg.String()
-			}
+			// Typing and line editing; in password mode the input is
+			// stored but View doesn't echo it
+			m = m.editInput(msg)
 		}
 
 	// ─────────────────────────────────────────────────────────────────────────────
-	// SERVER LINES (STRING):
+	// CONNECTION ENDED:
 	// ─────────────────────────────────────────────────────────────────────────────
-	case string:
-		serverLine := strings.TrimRight(msg, "\r\n")
+	case serverErrMsg:
+		// A reader for a connection we've already given up on
+		if msg.conn != m.conn {
+			return m, nil
+		}
+		// Display why for clarity, then offer to reconnect
+		if msg.err != nil {
+			m.messages = append(m.messages, fmt.Sprintf("Error reading from server: %v", msg.err))
+		} else {
+			m.messages = append(m.messages, "Connection closed by server.")
+		}
+		if m.restartIn > 0 {
+			return m.restarting()
+		}
+		return m.disconnected()
 
-		// If the server closed the connection, exit the program.
-		if serverLine == "Connection closed by server." {
-			// Display it for clarity, then quit
-			m.messages = append(m.messages, serverLine)
-			return m.exitProgram()
+	case pastedMsg:
+		return m.pasted(msg), nil
+
+	case skippedLineMsg:
+		m.messages = append(m.messages, fmt.Sprintf("Skipped a line from the server over %d KB.", maxServerLine/1024))
+		return m, nil
+
+	case reconnectedMsg:
+		return m.reconnected(msg)
+
+	case autoReconnectMsg:
+		if m.state != stateDisconnected {
+			return m, nil
+		}
+		return m.dial()
+
+	case tea.WindowSizeMsg:
+		m.height = max(msg.Height, 0)
+		return m, nil
+
+	// ─────────────────────────────────────────────────────────────────────────────
+	// SERVER LINES:
+	// ─────────────────────────────────────────────────────────────────────────────
+	case serverLineMsg:
+		serverLine := strings.TrimRight(string(msg), "\r\n")
+
+		// Banner lines are shown exactly as sent and never treated as prompts
+		if serverLine == bannerStart {
+			m.inBanner, m.banner = true, nil
+			return m, nil
+		}
+		if m.inBanner {
+			if serverLine == bannerEnd {
+				m.inBanner = false
+			} else {
+				m.messages = append(m.messages, serverLine)
+				m.banner = append(m.banner, serverLine)
+			}
+			return m, nil
 		}
 
+		// The MOTD and announcements are flagged as Markdown (see markdown.go)
+		if md, ok := strings.CutPrefix(serverLine, markdownPrefix); ok {
+			m.messages = append(m.messages, renderMarkdown(md, m.plain))
+			return m, nil
+		}
+
+		if id, edited, deleted, ok := changedMessage(serverLine); ok && m.state == stateChat {
+			return m.applyEdit(id, edited, deleted), nil
+		}
+
+		// Room messages the server kept carry their ID
+		var id int64
+		if rest, ok := strings.CutPrefix(serverLine, messageIDPrefix); ok {
+			if num, line, found := strings.Cut(rest, "] "); found {
+				if n, err := strconv.ParseInt(num, 10, 64); err == nil {
+					id, serverLine = n, line
+				}
+			}
+		}
+
+		// Our /rooms request was answered => open the selection menu
+		if m.awaitingRooms && strings.HasPrefix(serverLine, roomListPrefix) {
+			m.awaitingRooms = false
+			m.rooms = parseRoomList(serverLine)
+			m.roomCursor = 0
+			if len(m.rooms) > 0 {
+				m.state = stateRoomMenu
+				return m, nil
+			}
+		}
+
+		if pref, ok := strings.CutPrefix(serverLine, preferenceLine); ok && m.state == stateChat {
+			name, value, _ := strings.Cut(pref, " ")
+			return m.applyPreference(name, value), nil
+		}
+
+		// The server is about to close the connection to restart
+		if secs, ok := strings.CutPrefix(serverLine, restartPrefix); ok {
+			if n, err := strconv.Atoi(secs); err == nil && n > 0 {
+				m.restartIn = time.Duration(n) * time.Second
+				return m, nil
+			}
+		}
+
+		// Prompts and the welcome only mean something while logging in; in
+		// the chat the same words can be part of anyone's message, and must
+		// not touch the input being typed or clear the screen.
+		loggingIn := m.state == stateLogin || m.state == statePassword
+
+		if prefix, ok := strings.CutPrefix(serverLine, commandPrefixLine); ok && loggingIn && prefix != "" {
+			m.commandPrefix = prefix
+			return m, nil
+		}
+
+		m.usernamePrompt = loggingIn && strings.TrimSpace(serverLine) == "Username:"
+		// Suggest -username, unless a saved login is being replayed
+		if m.usernamePrompt && m.loginName != "" && m.input == "" && m.saved.user == "" {
+			m.input = m.loginName
+			m.cursor = len([]rune(m.input))
+		}
+		m.trackPresence(serverLine)
+		m = m.trackServerInfo(serverLine)
+
 		// 1) If server prompts for a password => switch to hidden input
-		if strings.Contains(serverLine, "(typing not hidden):") {
+		if loggingIn && strings.Contains(serverLine, "(typing not hidden):") {
 			m.prevState = m.state
 			m.state = statePassword
 		}
 
 		// 2) If we see “Welcome back” or “has joined the chat,” user is fully logged in
-		if strings.Contains(serverLine, "Welcome back") ||
-			strings.Contains(serverLine, "has joined the chat") {
+		if loggingIn && (strings.Contains(serverLine, "Welcome back") ||
+			strings.Contains(serverLine, "has joined the chat")) {
 			// Clear all old login lines so we start fresh for the chat
-			m.messages = nil
+			m.messages, m.stamps, m.ids = nil, nil, nil
+			if m.pending.pass != "" {
+				m.saved, m.pending = m.pending, credentials{}
+			}
+			// Learn our own name and who's already here
+			if name, ok := strings.CutPrefix(serverLine, "Welcome back, "); ok {
+				m.username = strings.TrimSuffix(name, "!")
+			}
+			fmt.Fprintln(m.conn, m.serverCommand("who"))
 			m.state = stateChat
 
 			// Add the welcome line (so they can see it)
 			// or comment this out if you don’t want to show it
 			m.messages = append(m.messages, serverLine)
+			if len(m.queued) > 0 {
+				return m.flushQueued()
+			}
 			return m, nil
 		}
 
-		// 3) For everything else, just display in TUI
+		// 3) For everything else, just display in TUI (unless the sender is ignored)
+		if m.ignored[senderOf(serverLine)] {
+			return m, nil
+		}
+		if rest, ok := strings.CutPrefix(serverLine, "[PM from "); ok && m.readReceipts && m.state == stateChat {
+			sender, _, _ := strings.Cut(rest, "]")
+			fmt.Fprintln(m.conn, m.serverCommand("read "+sender))
+		}
 		if trimmed := strings.TrimSpace(serverLine); trimmed != "" {
+			m = m.recordPM(trimmed)
 			m.messages = append(m.messages, trimmed)
+			m.ids = append(m.ids, id)
+			m.bell = m.state == stateChat && m.wantsBell(trimmed)
 		}
 	}
 	return m, nil
 }
 
+// serverCommand spells the command "/name args" with the server's command
+// prefix, which the client's own commands (see localCommand) start with too.
+func (m model) serverCommand(command string) string {
+	if m.commandPrefix == "" {
+		return "/" + command
+	}
+	return m.commandPrefix + command
+}
+
+// asChat reports whether the server takes input as chat rather than a
+// command, and if so the text everyone sees: input starting with the
+// command prefix twice is chat with one of them taken off.
+func (m model) asChat(input string) (text string, chat bool) {
+	prefix := m.serverCommand("")
+	rest, ok := strings.CutPrefix(input, prefix)
+	switch {
+	case !ok:
+		return input, true
+	case strings.HasPrefix(rest, prefix):
+		return rest, true
+	}
+	return "", false
+}
+
+// localCommand runs commands the client handles itself without involving
+// the server. Like the server's, they start with its command prefix, so
+// where that isn't "/", "/server is down" is chat. It reports whether input
+// was such a command.
+func (m model) localCommand(input string) (bool, model, tea.Cmd) {
+	fields := strings.Fields(input)
+	if len(fields) == 0 {
+		return false, m, nil
+	}
+	name, ok := strings.CutPrefix(fields[0], m.serverCommand(""))
+	if !ok {
+		return false, m, nil
+	}
+	switch name {
+	case "connect":
+		if len(fields) != 2 {
+			m.messages = append(m.messages, "Usage: /connect <host:port>")
+			return true, m, nil
+		}
+		next, cmd := m.connect(fields[1])
+		return true, next.(model), cmd
+
+	case "ignore", "unignore":
+		if len(fields) != 2 {
+			m.messages = append(m.messages, "Usage: /"+name+" <username>")
+			return true, m, nil
+		}
+		if m.ignored == nil {
+			m.ignored = make(map[string]bool)
+		}
+		if name == "ignore" {
+			m.ignored[fields[1]] = true
+			m.messages = append(m.messages, "Ignoring messages from "+fields[1]+".")
+		} else {
+			delete(m.ignored, fields[1])
+			m.messages = append(m.messages, "No longer ignoring "+fields[1]+".")
+		}
+		return true, m, nil
+
+	case "keys":
+		m.messages = append(m.messages, keyList(m.editMode)...)
+		return true, m, nil
+
+	case "timestamps":
+		return true, m.timestampsCommand(fields[1:]), nil
+
+	case "pms":
+		return true, m.pmsCommand(fields[1:]), nil
+
+	case "server":
+		return true, m.serverInfo(), nil
+
+	case "paste":
+		return true, m, readClipboard
+
+	case "notify":
+		return true, m.notifyCommand(fields[1:]), nil
+
+	case "ids":
+		if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+			m.messages = append(m.messages, "Usage: /ids on|off")
+			return true, m, nil
+		}
+		m.showIDs = fields[1] == "on"
+		return true, m, nil
+
+	case "export-users":
+		path := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(input), fields[0]))
+		if path == "" {
+			m.messages = append(m.messages, "Usage: /export-users <file>")
+			return true, m, nil
+		}
+		n, err := m.exportUsers(path)
+		if err != nil {
+			m.messages = append(m.messages, fmt.Sprintf("Export failed: %v", err))
+		} else {
+			m.messages = append(m.messages, fmt.Sprintf("Exported %d online users to %s.", n, path))
+		}
+		return true, m, nil
+	}
+	return false, m, nil
+}
+
+// exportUsers writes the online users we know of, sorted, one per line, to
+// a new file at path. It won't overwrite an existing file.
+func (m model) exportUsers(path string) (int, error) {
+	names := make([]string, 0, len(m.online))
+	for name := range m.online {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	var list strings.Builder
+	for _, name := range names {
+		list.WriteString(name + "\n")
+	}
+	_, err = f.WriteString(list.String())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(names), nil
+}
+
+// senderOf returns who sent a chat line ("name: text"), private message
+// ("[PM from name] text") or shared file ("[file from name] url"), or "" for
+// anything else.
+func senderOf(line string) string {
+	for _, prefix := range []string{"[PM from ", "[file from "} {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			name, _, _ := strings.Cut(rest, "]")
+			return name
+		}
+	}
+	name, _, found := strings.Cut(line, ": ")
+	if !found || strings.Contains(name, " ") {
+		return ""
+	}
+	return name
+}
+
+// trackPresence updates the online-user set from a server line.
+func (m model) trackPresence(line string) {
+	if list, ok := strings.CutPrefix(line, onlineListPrefix); ok {
+		clear(m.online)
+		for _, entry := range strings.Split(list, ", ") {
+			// Entries may carry a status, e.g. "alice (idle)"
+			if name, _, _ := strings.Cut(entry, " "); name != "" {
+				m.online[name] = true
+			}
+		}
+		return
+	}
+
+	name, _, _ := strings.Cut(line, " ")
+	switch {
+	case strings.HasSuffix(line, " has joined the chat"):
+		m.online[name] = true
+	case strings.HasSuffix(line, " has left the chat"):
+		delete(m.online, name)
+	}
+}
+
+// completeUsername completes the username being typed after "/msg " or "@"
+// against the online users. Pressing Tab again cycles to the next match.
+func (m model) completeUsername() model {
+	if len(m.completions) > 0 {
+		m.completionIdx = (m.completionIdx + 1) % len(m.completions)
+		m.input = m.input[:m.completionAt] + m.completions[m.completionIdx]
+		return m
+	}
+
+	start := strings.LastIndex(m.input, " ") + 1
+	partial := m.input[start:]
+	switch {
+	case strings.HasPrefix(partial, "@"):
+		start++
+		partial = partial[1:]
+	case strings.HasPrefix(m.input, m.serverCommand("msg ")) && start == len(m.serverCommand("msg ")):
+	default:
+		return m
+	}
+
+	var matches []string
+	for name := range m.online {
+		if strings.HasPrefix(name, partial) && name != m.username {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return m
+	}
+	sort.Strings(matches)
+
+	m.completions = matches
+	m.completionIdx = 0
+	m.completionAt = start
+	m.input = m.input[:start] + matches[0]
+	return m
+}
+
+// updateRoomMenu handles keys while the room selection menu is open.
+func (m model) updateRoomMenu(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyUp:
+		if m.roomCursor > 0 {
+			m.roomCursor--
+		}
+	case tea.KeyDown:
+		if m.roomCursor < len(m.rooms)-1 {
+			m.roomCursor++
+		}
+	case tea.KeyEnter:
+		name := strings.Fields(m.rooms[m.roomCursor])[0]
+		fmt.Fprintln(m.conn, m.serverCommand("join "+name))
+		m.state = stateChat
+	case tea.KeyEsc:
+		m.state = stateChat
+	}
+	return m, nil
+}
+
+// parseRoomList splits a "Rooms: #a (1), #b (2)" line into its entries.
+func parseRoomList(line string) []string {
+	list := strings.TrimPrefix(line, roomListPrefix)
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	return strings.Split(list, ", ")
+}
+
+// View draws the model, ending with the terminal bell if the last update
+// rang it. The bell goes through the renderer like the rest of the frame,
+// so it can't land in the middle of an escape sequence; the renderer skips
+// a frame identical to the last, so it rings once.
 func (m model) View() string {
+	if m.bell {
+		return m.view() + "\a"
+	}
+	return m.view()
+}
+
+func (m model) view() string {
+	if m.state == stateRoomMenu {
+		return m.roomMenuView()
+	}
+
+	lines, from := m.messages, []int(nil)
+	if !m.expandNotices {
+		lines, from = collapseNotices(lines)
+	}
+
 	var sb strings.Builder
-	for _, line := range m.messages {
+	for i, line := range lines {
+		at := i
+		if from != nil {
+			at = from[i]
+		}
+		line = m.displayLine(line, at)
+		if m.hyperlinks {
+			line = linkify(line)
+		}
 		sb.WriteString(line + "\n")
 	}
-	sb.WriteString("\nType /exit to quit.\n> ")
-
-	// If in password mode, hide typed input
-	if m.state == statePassword {
-		sb.WriteString(strings.Repeat("*", len(m.input)))
+	if m.quitPrompt {
+		sb.WriteString("\nQuit? Unsent messages will be lost. [y/N] ")
+		return sb.String()
+	}
+	if m.state == stateDisconnected {
+		if m.autoRetries > 0 {
+			sb.WriteString("\nDisconnected; reconnecting automatically. Press Enter to try now, or Ctrl+C to quit.\n")
+		} else {
+			sb.WriteString("\nDisconnected. Press Enter to reconnect, or Ctrl+C to quit.\n")
+		}
+		if m.queuedAs != "" {
+			sb.WriteString("Messages typed here are queued until you're back as " + m.queuedAs + ".\n> ")
+			sb.WriteString(m.renderInput())
+		}
+		return sb.String()
+	}
+	if m.follow && m.state == stateChat {
+		sb.WriteString("\n" + m.encryptionStatus() + " Following (read-only). Press Ctrl+C to quit.\n")
+		return sb.String()
+	}
+	if m.slowDown {
+		sb.WriteString("\n" + m.encryptionStatus() + " Slow down: press Enter again in a moment to send.\n> ")
 	} else {
-		sb.WriteString(m.input)
+		sb.WriteString("\n" + m.encryptionStatus() + " Type " + m.serverCommand("exit") + " to quit.\n> ")
+	}
+	sb.WriteString(m.renderInput())
+	return sb.String()
+}
+
+// linkify wraps each URL in line in an OSC 8 hyperlink escape, which
+// supporting terminals make clickable and others ignore, leaving plain text.
+func linkify(line string) string {
+	return urlPattern.ReplaceAllStringFunc(line, func(url string) string {
+		return "\x1b]8;;" + url + "\x1b\\" + url + "\x1b]8;;\x1b\\"
+	})
+}
+
+// roomMenuView draws the room menu. In a terminal too short for every room,
+// it shows only the rooms around the cursor, at least one however short,
+// since the renderer would otherwise cut off the top, cursor and all.
+func (m model) roomMenuView() string {
+	var sb strings.Builder
+	sb.WriteString("Select a room (↑/↓ to move, Enter to join, Esc to cancel):\n\n")
+	first, last := 0, len(m.rooms)
+	// The heading, the blank line and the empty line after the last room
+	if rows := max(m.height-3, 1); m.height > 0 && last > rows {
+		first = min(max(m.roomCursor-rows/2, 0), last-rows)
+		last = first + rows
+	}
+	for i := first; i < last; i++ {
+		room := m.rooms[i]
+		if i == m.roomCursor {
+			sb.WriteString("> " + room + "\n")
+		} else {
+			sb.WriteString("  " + room + "\n")
+		}
 	}
 	return sb.String()
 }
 
+// sendFailed marks the input that couldn't be written as unsent, queuing it
+// if it's a chat message, and since the connection is broken, disconnects so
+// the user can reconnect.
+func (m model) sendFailed(err error) (tea.Model, tea.Cmd) {
+	unsent, note := m.input, "not sent"
+	text, chat := m.asChat(m.input)
+	switch {
+	case m.state == statePassword:
+		unsent = strings.Repeat("*", len([]rune(m.input)))
+	case m.state == stateChat && chat && m.username != "":
+		// Chat is worth keeping: it's sent once we're logged in again as
+		// the same user
+		unsent, note = "You: "+text, "queued"
+		m.queued = append(m.queued, m.input)
+		m.queuedAs = m.username
+	}
+	m.messages = append(m.messages, "✗ "+unsent+" ("+note+")")
+	m.messages = append(m.messages, fmt.Sprintf("Connection lost: %v", err))
+	return m.disconnected()
+}
+
+// quit exits, first asking to confirm with -confirm-quit if that would lose
+// something not yet sent.
+func (m model) quit() (tea.Model, tea.Cmd) {
+	if m.confirmQuit && m.hasUnsent() {
+		m.quitPrompt = true
+		return m, nil
+	}
+	return m.exitProgram()
+}
+
+// hasUnsent reports whether there's a message that quitting would lose:
+// text on the input line (but not a password), or chat queued while
+// disconnected.
+func (m model) hasUnsent() bool {
+	typed := m.state != statePassword && strings.TrimSpace(m.input) != ""
+	return typed || len(m.queued) > 0
+}
+
+// answerQuit handles a key at the quit prompt: y (or Ctrl+C again) quits,
+// anything else goes back to where the user was, input intact.
+func (m model) answerQuit(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.quitPrompt = false
+	if msg.Type == tea.KeyCtrlC || (msg.Type == tea.KeyRunes && strings.EqualFold(string(msg.Runes), "y")) {
+		return m.exitProgram()
+	}
+	return m, nil
+}
+
 func (m model) exitProgram() (tea.Model, tea.Cmd) {
 	m.exit = true
 	return m, tea.Quit
 }
 
+// termStyles reports whether to draw without colors or other styles, with
+// -no-color or NO_COLOR (https://no-color.org) set to anything but empty,
+// and whether to make URLs hyperlinks, which plain output and a dumb
+// terminal don't get. When plain, lipgloss is told too, so nothing it
+// renders is ever styled.
+func termStyles(noColor bool) (plain, hyperlinks bool) {
+	plain = noColor || os.Getenv("NO_COLOR") != ""
+	if plain {
+		lipgloss.SetColorProfile(termenv.Ascii)
+	}
+	return plain, os.Getenv("TERM") != "dumb" && !plain
+}
+
 func main() {
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Print("Enter the server address (e.g., localhost:9000): ")
-	address, _ := reader.ReadString('\n')
-	address = strings.TrimSpace(address)
+	addrFlag := flag.String("addr", "", "server address, e.g. localhost:9000 (prompted for if empty)")
+	tlsFlag := flag.Bool("tls", false, "connect with TLS, to a server listening with a certificate")
+	tlsCA := flag.String("tls-ca", "", "PEM file of the CA (or self-signed certificate) to trust for -tls, instead of the system's")
+	editModeFlag := flag.String("editmode", "emacs", "input keybindings: emacs or vim")
+	scrollback := flag.Int("scrollback", 1000, "most messages kept on screen; older ones are dropped (0 keeps all)")
+	readReceipts := flag.Bool("read-receipts", false, "let senders know when their private messages have been shown")
+	reconnectFlag := flag.String("reconnect-login", "prompt", "after reconnecting: prompt to log in again, or reuse this session's login")
+	notifyFlag := flag.String("notify", "none", "ring the terminal bell for: pm, mention (PMs and mentions), all messages, or none")
+	confirmQuit := flag.Bool("confirm-quit", true, "ask before quitting with a message typed but not sent, or queued")
+	sendInterval := flag.Duration("send-interval", 250*time.Millisecond, "shortest time between two chat sends; Enter sooner keeps the message in the input line (0 disables)")
+	follow := flag.Bool("follow", false, "read-only display: after logging in, show messages without an input line")
+	altScreen := flag.Bool("alt-screen", true, "draw full-screen, and restore the terminal's previous contents on exit")
+	usernameFlag := flag.String("username", "", "username to fill in at the login prompt")
+	timestampsFlag := flag.String("timestamps", "off", "show when each message arrived: off, 24h or 12h")
+	nameWidth := flag.Int("name-width", 0, "longest sender name shown; longer ones are cut short with … (0 shows names in full)")
+	alignNames := flag.Bool("align-names", false, "pad chat senders' names to -name-width so messages line up")
+	colorNames := flag.Bool("color-names", true, "draw each sender's name in a color of its own")
+	noColor := flag.Bool("no-color", false, "draw without colors or other terminal styles, as when NO_COLOR is set")
+	showIDs := flag.Bool("message-ids", false, "show the ID of each room message the server keeps, for /report")
+	profile := flag.String("profile", "", "apply the named profile from the -profiles file")
+	profiles := flag.String("profiles", defaultProfilesPath(), "file of named profiles, each a [name] section of flag = value lines")
+	flag.Parse()
+
+	if *profile != "" {
+		settings, err := loadProfile(*profiles, *profile)
+		if err == nil {
+			err = applyProfile(settings)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	mode, err := parseEditMode(*editModeFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	relogin, err := parseReconnectLogin(*reconnectFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	notify, err := parseNotifyMode(*notifyFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	stamps, err := parseTimestampMode(*timestampsFlag)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	address := *addrFlag
+	if address == "" {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Enter the server address (e.g., localhost:9000): ")
+		// At EOF a last line without a newline still counts
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			fmt.Fprintln(os.Stderr, "\nError reading server address:", err)
+			os.Exit(1)
+		}
+		address = strings.TrimSpace(line)
+	}
+	if address == "" {
+		fmt.Fprintln(os.Stderr, "\nError: no server address provided.")
+		fmt.Fprintln(os.Stderr, "Enter one at the prompt, or run: client -addr host:port")
+		os.Exit(2)
+	}
 
-	conn, err := net.Dial("tcp", address)
+	var tlsConfig *tls.Config
+	if *tlsFlag {
+		if tlsConfig, err = loadTLSConfig(*tlsCA); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -tls-ca:", err)
+			os.Exit(2)
+		}
+	}
+
+	plain, hyperlinks := termStyles(*noColor)
+
+	conn, err := dialServer(address, tlsConfig)
 	if err != nil {
 		fmt.Println("Error connecting to server:", err)
 		return
 	}
-	defer conn.Close()
 
 	// Initial model is in login state
-	m := model{conn: conn, state: stateLogin}
+	var p *tea.Program
+	m := model{
+		conn:           conn,
+		state:          stateLogin,
+		online:         make(map[string]bool),
+		hyperlinks:     hyperlinks,
+		plain:          plain,
+		editMode:       mode,
+		readReceipts:   *readReceipts,
+		notify:         notify,
+		notifyOn:       notify,
+		follow:         *follow,
+		confirmQuit:    *confirmQuit,
+		sendInterval:   *sendInterval,
+		scrollback:     *scrollback,
+		timestamps:     stamps,
+		timestampsOn:   stamps,
+		nameWidth:      *nameWidth,
+		alignNames:     *alignNames,
+		colorNames:     *colorNames && !plain,
+		showIDs:        *showIDs,
+		addr:           address,
+		tlsConfig:      tlsConfig,
+		reconnectLogin: relogin,
+		loginName:      *usernameFlag,
+		altScreen:      *altScreen,
+		listen:         func(c net.Conn) { go readServer(c, p.Send) },
+	}
 
-	p := tea.NewProgram(m)
+	// Init enters the alternate screen; Bubble Tea leaves it however Run
+	// returns: /exit, Ctrl+C, or a panic it recovers from
+	p = tea.NewProgram(m)
 
 	// Read server lines
-	go func() {
-		scanner := bufio.NewScanner(conn)
-		for scanner.Scan() {
-			p.Send(scanner.Text())
-		}
-		if err := scanner.Err(); err != nil {
-			p.Send(fmt.Sprintf("Error reading from server: %v", err))
-		} else {
-			p.Send("Connection closed by server.")
-		}
-	}()
+	m.listen(conn)
 
-	if _, runErr := p.Run(); runErr != nil {
+	final, runErr := p.Run()
+	if runErr != nil {
 		fmt.Println("Error running program:", runErr)
 		os.Exit(1)
 	}
+	if fm, ok := final.(model); ok && fm.conn != nil {
+		fm.conn.Close()
+	}
 
 	fmt.Println("Exiting chat client. Goodbye!")
 }
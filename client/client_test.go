@@ -0,0 +1,602 @@
+// client_test.go
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// The model tests drive a model through Update as Bubble Tea would, with
+// keys and server lines, and check what View draws. The model's connection
+// is one end of a pipe; the test's fakeServer is the other, and collects
+// what the client sends.
+
+const testTimeout = 5 * time.Second
+
+// fakeServer is the server end of a test model's connection.
+type fakeServer struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+}
+
+// newTestModel returns a model connected to a fakeServer, in the login
+// state as main starts it.
+func newTestModel(t *testing.T) (model, *fakeServer) {
+	t.Helper()
+	client, s := pipe(t)
+	m := model{
+		conn:   client,
+		state:  stateLogin,
+		online: make(map[string]bool),
+		listen: func(net.Conn) {},
+	}
+	return m, s
+}
+
+// pipe returns the client end of a new connection and the fakeServer at
+// the other end.
+func pipe(t *testing.T) (net.Conn, *fakeServer) {
+	client, server := net.Pipe()
+	s := &fakeServer{t: t, conn: server, lines: make(chan string, 1000)}
+	go func() {
+		defer close(s.lines)
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			s.lines <- scanner.Text()
+		}
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, s
+}
+
+// expect reads what the client sent up to the first line containing want,
+// and returns that line.
+func (s *fakeServer) expect(want string) string {
+	s.t.Helper()
+	var seen []string
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-s.lines:
+			if !ok {
+				s.t.Fatalf("connection closed waiting for %q; got %q", want, seen)
+			}
+			seen = append(seen, line)
+			if strings.Contains(line, want) {
+				return line
+			}
+		case <-timeout:
+			s.t.Fatalf("timed out waiting for %q; got %q", want, seen)
+		}
+	}
+}
+
+// update passes msg to m.Update and returns the model it gave back,
+// dropping any command.
+func update(t *testing.T, m model, msg tea.Msg) model {
+	t.Helper()
+	next, _ := m.Update(msg)
+	nm, ok := next.(model)
+	if !ok {
+		t.Fatalf("Update returned %T, want model", next)
+	}
+	return nm
+}
+
+// receive hands m each line as if the server had sent it.
+func receive(t *testing.T, m model, lines ...string) model {
+	t.Helper()
+	for _, line := range lines {
+		m = update(t, m, serverLineMsg(line+"\n"))
+	}
+	return m
+}
+
+// press hands m each key in turn.
+func press(t *testing.T, m model, keys ...tea.KeyType) model {
+	t.Helper()
+	for _, key := range keys {
+		m = update(t, m, tea.KeyMsg{Type: key})
+	}
+	return m
+}
+
+// typeText types text on the input line without pressing Enter.
+func typeText(t *testing.T, m model, text string) model {
+	t.Helper()
+	for _, r := range text {
+		m = update(t, m, tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+	}
+	return m
+}
+
+// enter types text and presses Enter.
+func enter(t *testing.T, m model, text string) model {
+	t.Helper()
+	return press(t, typeText(t, m, text), tea.KeyEnter)
+}
+
+// loggedIn returns a test model logged in as username, as after the
+// server's welcome.
+func loggedIn(t *testing.T, username string) (model, *fakeServer) {
+	t.Helper()
+	m, s := newTestModel(t)
+	m = receive(t, m, "Welcome back, "+username+"!")
+	s.expect("/who")
+	if m.state != stateChat {
+		t.Fatalf("state after the welcome = %v, want stateChat", m.state)
+	}
+	return m, s
+}
+
+func TestRoomListOpensMenu(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	m = enter(t, m, "/rooms")
+	s.expect("/rooms")
+
+	m = receive(t, m, "Rooms: #general (2), #dev (1)")
+	if m.state != stateRoomMenu {
+		t.Fatalf("state = %v, want stateRoomMenu", m.state)
+	}
+	view := m.View()
+	for _, want := range []string{"Select a room", "> #general (2)", "  #dev (1)"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("View() = %q, want it to contain %q", view, want)
+		}
+	}
+
+	m = press(t, m, tea.KeyDown, tea.KeyEnter)
+	s.expect("/join #dev")
+	if m.state != stateChat {
+		t.Errorf("state after choosing = %v, want stateChat", m.state)
+	}
+}
+
+func TestTabCompletesUsernames(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m = receive(t, m, "Online: alice, albert (idle), alfred, bob")
+
+	m = press(t, typeText(t, m, "/msg al"), tea.KeyTab)
+	if m.input != "/msg albert" {
+		t.Errorf("after Tab: input = %q, want %q", m.input, "/msg albert")
+	}
+	m = press(t, m, tea.KeyTab)
+	if m.input != "/msg alfred" {
+		t.Errorf("after Tab again: input = %q, want %q", m.input, "/msg alfred")
+	}
+
+	m = press(t, typeText(t, m, " hi @b"), tea.KeyTab)
+	if m.input != "/msg alfred hi @bob" {
+		t.Errorf("mention: input = %q, want %q", m.input, "/msg alfred hi @bob")
+	}
+}
+
+func TestIgnoreHidesMessages(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m = enter(t, m, "/ignore bob")
+	if last := m.messages[len(m.messages)-1]; last != "Ignoring messages from bob." {
+		t.Errorf("after /ignore: last message = %q", last)
+	}
+
+	m = receive(t, m, "bob: can you see this?", "[PM from bob] or this?", "carol: hi")
+	for _, line := range m.messages {
+		if strings.Contains(line, "this?") {
+			t.Errorf("shown from an ignored user: %q", line)
+		}
+	}
+	if last := m.messages[len(m.messages)-1]; last != "carol: hi" {
+		t.Errorf("last message = %q, want carol's", last)
+	}
+
+	m = enter(t, m, "/unignore bob")
+	m = receive(t, m, "bob: now?")
+	if last := m.messages[len(m.messages)-1]; last != "bob: now?" {
+		t.Errorf("after /unignore: last message = %q, want bob's", last)
+	}
+}
+
+func TestBannerIsNotAPrompt(t *testing.T) {
+	m, _ := newTestModel(t)
+	m = receive(t, m, "[banner]", " Password (typing not hidden): ", "  /\\_/\\", "[/banner]")
+	if m.state != stateLogin {
+		t.Errorf("state = %v after the banner, want stateLogin", m.state)
+	}
+	want := []string{" Password (typing not hidden): ", "  /\\_/\\"}
+	if strings.Join(m.messages, "\n") != strings.Join(want, "\n") {
+		t.Errorf("messages = %q, want %q", m.messages, want)
+	}
+
+	m = receive(t, m, "Password (typing not hidden): ")
+	if m.state != statePassword {
+		t.Errorf("state = %v at the real prompt, want statePassword", m.state)
+	}
+}
+
+func TestURLsBecomeHyperlinks(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.hyperlinks = true
+	m = receive(t, m, "bob: see https://example.com/docs?page=2.")
+
+	link := "\x1b]8;;https://example.com/docs?page=2\x1b\\https://example.com/docs?page=2\x1b]8;;\x1b\\."
+	if view := m.View(); !strings.Contains(view, link) {
+		t.Errorf("View() = %q, want the URL as an OSC 8 hyperlink %q", view, link)
+	}
+
+	m.hyperlinks = false
+	if view := m.View(); strings.Contains(view, "\x1b]8;;") {
+		t.Errorf("View() = %q without hyperlinks, want plain text", view)
+	}
+}
+
+func TestSendFailureIsShown(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	s.conn.Close()
+
+	m = enter(t, m, "anyone there?")
+	got := m.messages[len(m.messages)-2:]
+	if got[0] != "✗ You: anyone there? (queued)" || !strings.HasPrefix(got[1], "Connection lost: ") {
+		t.Errorf("messages end %q, want the message marked unsent and why", got)
+	}
+	if m.state != stateDisconnected || !slices.Equal(m.queued, []string{"anyone there?"}) {
+		t.Errorf("state %v, queued %q; want disconnected with the message queued", m.state, m.queued)
+	}
+	if view := m.View(); !strings.Contains(view, "Disconnected. Press Enter to reconnect") {
+		t.Errorf("View() = %q, want the reconnect prompt", view)
+	}
+}
+
+func TestTypedMessagesDispatch(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m = receive(t, m, "bob: hi")
+
+	// A plain string is nobody's message, not a server line
+	m = update(t, m, "carol: ignored")
+	if last := m.messages[len(m.messages)-1]; last != "bob: hi" {
+		t.Errorf("last message = %q, want the server line only", last)
+	}
+
+	// An error from a connection already given up on is stale
+	other, _ := net.Pipe()
+	defer other.Close()
+	m = update(t, m, serverErrMsg{conn: other})
+	if m.state != stateChat {
+		t.Errorf("state after a stale error = %v, want stateChat", m.state)
+	}
+
+	m = update(t, m, serverErrMsg{conn: m.conn})
+	if m.state != stateDisconnected || m.messages[len(m.messages)-1] != "Connection closed by server." {
+		t.Errorf("after the connection closed: state %v, messages %q", m.state, m.messages)
+	}
+}
+
+func TestReconnectLogin(t *testing.T) {
+	for _, mode := range []reconnectLogin{reconnectReuse, reconnectPrompt} {
+		m, s := newTestModel(t)
+		m.reconnectLogin = mode
+		m = receive(t, m, "Enter 'login' or 'register': ")
+		m = enter(t, m, "login")
+		m = receive(t, m, "Username: ")
+		m = enter(t, m, "alice")
+		m = receive(t, m, "Password (typing not hidden): ")
+		m = enter(t, m, "secret")
+		m = receive(t, m, "Welcome back, alice!")
+		s.expect("/who")
+
+		m = update(t, m, serverErrMsg{conn: m.conn})
+		conn, s := pipe(t)
+		m = update(t, m, reconnectedMsg{conn: conn})
+		if m.state != stateLogin {
+			t.Errorf("%v: state after reconnecting = %v, want stateLogin", mode, m.state)
+		}
+
+		if mode == reconnectReuse {
+			s.expect("login")
+			s.expect("alice")
+			s.expect("secret")
+			continue
+		}
+		if m.saved != (credentials{}) {
+			t.Errorf("prompt mode kept the login %+v", m.saved)
+		}
+		select {
+		case line := <-s.lines:
+			t.Errorf("prompt mode sent %q by itself", line)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m = receive(t, m, "Online: bob, alice, carol (away)")
+	path := filepath.Join(t.TempDir(), "users.txt")
+
+	m = enter(t, m, "/export-users "+path)
+	if last := m.messages[len(m.messages)-1]; last != "Exported 3 online users to "+path+"." {
+		t.Errorf("after /export-users: %q", last)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "alice\nbob\ncarol\n"; got != want {
+		t.Errorf("file = %q, want %q", got, want)
+	}
+
+	// An existing file isn't overwritten
+	m = enter(t, m, "/export-users "+path)
+	if last := m.messages[len(m.messages)-1]; !strings.HasPrefix(last, "Export failed: ") {
+		t.Errorf("exporting over a file: %q, want it refused", last)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	m.readReceipts = true
+	m = receive(t, m, "[PM from bob] hi", "[PM to bob (delivered)] hello", "[PM to carol (queued)] later")
+	s.expect("/read bob")
+	if got := m.messages[len(m.messages)-2:]; got[0] != "[PM to bob (delivered)] hello" || got[1] != "[PM to carol (queued)] later" {
+		t.Errorf("messages end %q, want the receipts shown", got)
+	}
+}
+
+func TestScrollback(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.scrollback = 3
+	m.showIDs = true
+	for i := 1; i <= 5; i++ {
+		m = receive(t, m, fmt.Sprintf("[id %d] bob: line %d", i, i))
+	}
+	if want := []string{"bob: line 3", "bob: line 4", "bob: line 5"}; !slices.Equal(m.messages, want) {
+		t.Errorf("messages = %q, want %q", m.messages, want)
+	}
+	// The IDs and stamps are trimmed in step
+	if len(m.stamps) != 3 || !slices.Equal(m.ids, []int64{3, 4, 5}) {
+		t.Errorf("%d stamps and ids %v, want 3 of each, for lines 3 to 5", len(m.stamps), m.ids)
+	}
+	if view := m.View(); !strings.Contains(view, "#3 bob: line 3") || strings.Contains(view, "line 2") {
+		t.Errorf("View() = %q, want lines 3 to 5 only", view)
+	}
+}
+
+func TestJoinNoticesCollapse(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.plain = true
+	m = receive(t, m, "bob: hi", "carol has joined the chat", "dave has joined the chat",
+		"erin has joined #dev", "carol: hello")
+
+	view := m.View()
+	if !strings.Contains(view, "· 3 users joined — Ctrl+O to expand") {
+		t.Errorf("view has no summary of the joins:\n%s", view)
+	}
+	if strings.Contains(view, "has joined") {
+		t.Errorf("collapsed view still shows a join notice:\n%s", view)
+	}
+	if !strings.Contains(view, "bob: hi") || !strings.Contains(view, "carol: hello") {
+		t.Errorf("collapsed view lost the chat around the joins:\n%s", view)
+	}
+
+	view = press(t, m, tea.KeyCtrlO).View()
+	if strings.Contains(view, "Ctrl+O to expand") || strings.Count(view, "has joined") != 3 {
+		t.Errorf("after Ctrl+O the joins should be listed:\n%s", view)
+	}
+}
+
+func TestIncomingLinesKeepInput(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m = receive(t, m, "bob: morning")
+	m = typeText(t, m, "half a ")
+	// Lines that look like the login prompts, mid-chat
+	m = receive(t, m, "carol has joined the chat", "bob: Welcome back, carol!", "dave: Enter your password (typing not hidden):")
+	m = typeText(t, m, "thought")
+
+	if m.input != "half a thought" || m.cursor != len("half a thought") {
+		t.Errorf("input %q, cursor %d, want the draft intact with the cursor at its end", m.input, m.cursor)
+	}
+	if m.state != stateChat {
+		t.Errorf("state = %v, want stateChat", m.state)
+	}
+	if !slices.Contains(m.messages, "bob: morning") || m.messages[len(m.messages)-1] != "dave: Enter your password (typing not hidden):" {
+		t.Errorf("messages = %q, want the earlier chat kept and the new lines added", m.messages)
+	}
+}
+
+func TestFollowIgnoresKeys(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	m.follow = true
+	m.readReceipts = true
+	m = enter(t, m, "hello")
+	m = press(t, m, tea.KeyCtrlU, tea.KeyTab, tea.KeyCtrlO)
+	if m.input != "" || m.expandNotices {
+		t.Errorf("in follow mode keys changed the model: input %q, notices expanded %v", m.input, m.expandNotices)
+	}
+	if view := m.View(); !strings.Contains(view, "Following (read-only)") || strings.Contains(view, "> ") {
+		t.Errorf("follow mode view:\n%s", view)
+	}
+
+	// The client's own requests still go out, and are all it sent
+	m = receive(t, m, "[PM from bob] are you there?")
+	select {
+	case line := <-s.lines:
+		if line != "/read bob" {
+			t.Errorf("sent %q, want only the read receipt", line)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("no read receipt")
+	}
+}
+
+func TestConfirmQuit(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.confirmQuit = true
+
+	m = press(t, typeText(t, m, "half a thought"), tea.KeyCtrlC)
+	if m.exit || !m.quitPrompt {
+		t.Fatalf("Ctrl+C with unsent input: exit %v, prompt %v; want the prompt", m.exit, m.quitPrompt)
+	}
+	if view := m.View(); !strings.Contains(view, "Quit? Unsent messages will be lost. [y/N]") {
+		t.Errorf("view:\n%s\nwant the quit prompt", view)
+	}
+	m = typeText(t, m, "n")
+	if m.exit || m.quitPrompt || m.input != "half a thought" {
+		t.Errorf("after n: exit %v, prompt %v, input %q; want back to the input as it was", m.exit, m.quitPrompt, m.input)
+	}
+	m = typeText(t, press(t, m, tea.KeyCtrlC), "y")
+	if !m.exit {
+		t.Error("y at the prompt didn't quit")
+	}
+
+	// Nothing to lose, nothing to ask
+	m, _ = loggedIn(t, "alice")
+	m.confirmQuit = true
+	if m = press(t, m, tea.KeyCtrlC); !m.exit || m.quitPrompt {
+		t.Errorf("Ctrl+C with nothing typed: exit %v, prompt %v; want it to quit", m.exit, m.quitPrompt)
+	}
+	m, _ = newTestModel(t)
+	m.confirmQuit, m.state = true, statePassword
+	if m = press(t, typeText(t, m, "hunter2"), tea.KeyCtrlC); !m.exit {
+		t.Error("Ctrl+C at the password prompt asked first, want a password not to count as unsent")
+	}
+}
+
+func TestInitCommands(t *testing.T) {
+	m, _ := newTestModel(t)
+	for _, alt := range []bool{false, true} {
+		m.altScreen = alt
+		msgs := []tea.Msg{m.Init()()}
+		if batch, ok := msgs[0].(tea.BatchMsg); ok {
+			msgs = nil
+			for _, cmd := range batch {
+				msgs = append(msgs, cmd())
+			}
+		}
+		want := []tea.Msg{tea.WindowSize()()}
+		if alt {
+			want = append(want, tea.EnterAltScreen())
+		}
+		if !slices.Equal(msgs, want) {
+			t.Errorf("-alt-screen=%v: Init() gives %#v, want %#v", alt, msgs, want)
+		}
+	}
+
+	// A program started with them enters the alternate screen, takes the
+	// model's lines, and leaves it when it quits
+	m.altScreen = true
+	var out strings.Builder
+	p := tea.NewProgram(m, tea.WithInput(nil), tea.WithOutput(&out))
+	go func() {
+		p.Send(serverLineMsg("Welcome to the secure chat server!"))
+		p.Send(tea.KeyMsg{Type: tea.KeyCtrlC})
+	}()
+	done := make(chan struct{})
+	var final tea.Model
+	var err error
+	go func() {
+		defer close(done)
+		final, err = p.Run()
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		p.Kill()
+		t.Fatal("the program didn't quit")
+	}
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if fm := final.(model); !fm.exit || !slices.Contains(fm.messages, "Welcome to the secure chat server!") {
+		t.Errorf("final model: exit %v, messages %q", fm.exit, fm.messages)
+	}
+	if enter, leave := strings.Index(out.String(), "\x1b[?1049h"), strings.LastIndex(out.String(), "\x1b[?1049l"); enter < 0 || leave < enter {
+		t.Errorf("output %q, want the alternate screen entered and then left", out.String())
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	m, s := newTestModel(t)
+	m = receive(t, m, "[commands] !", "Welcome back, alice!")
+	s.expect("!who")
+
+	// The client's own commands take the prefix too
+	m = enter(t, m, "!server")
+	if !slices.Contains(m.messages, "  Commands start with: !") {
+		t.Errorf("!server didn't run; messages %q", m.messages)
+	}
+	if view := m.View(); !strings.Contains(view, "Type !exit to quit.") {
+		t.Errorf("view:\n%s\nwant !exit in the status line", view)
+	}
+
+	// Everything else goes to the server, and only what lacks the prefix
+	// is chat
+	for _, tc := range []struct {
+		input string
+		chat  bool
+	}{
+		{"/server is down", true},
+		{"/who", true},
+		{"/exit stage left", true},
+		{"!who", false},
+		{"!!who", true},
+	} {
+		before := len(m.messages)
+		m = enter(t, m, tc.input)
+		if got := s.expect(""); got != tc.input {
+			t.Errorf("sent %q for %q", got, tc.input)
+		}
+		if shown := slices.Contains(m.messages[before:], "You: "+strings.TrimPrefix(tc.input, "!")); shown != tc.chat {
+			t.Errorf("%q shown as chat %v, want %v", tc.input, shown, tc.chat)
+		}
+	}
+	if m.exit {
+		t.Error("/exit quit, want it sent as chat")
+	}
+	if m = enter(t, m, "!exit"); !m.exit {
+		t.Error("!exit didn't quit")
+	}
+}
+
+func TestSendDebounce(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	m.sendInterval = time.Minute
+
+	m = enter(t, m, "first")
+	s.expect("first")
+	m = enter(t, m, "second")
+	if !m.slowDown || m.input != "second" {
+		t.Errorf("Enter right after a send: slow down %v, input %q; want it held with the input kept", m.slowDown, m.input)
+	}
+	if view := m.View(); !strings.Contains(view, "Slow down: press Enter again in a moment to send.") || !strings.Contains(view, "> second") {
+		t.Errorf("view:\n%s\nwant the slow-down notice and the input", view)
+	}
+	if slices.Contains(m.messages, "You: second") {
+		t.Error("the held message was shown as sent")
+	}
+
+	// Once the interval has passed, Enter sends it
+	m.lastSend = time.Now().Add(-time.Minute)
+	m = press(t, m, tea.KeyEnter)
+	select {
+	case line := <-s.lines:
+		if line != "second" {
+			t.Errorf("sent %q, want the held message", line)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the held message wasn't sent")
+	}
+	if m.slowDown || m.input != "" || !slices.Contains(m.messages, "You: second") {
+		t.Errorf("after sending: slow down %v, input %q", m.slowDown, m.input)
+	}
+}
@@ -0,0 +1,103 @@
+// clipboard.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// /paste reads the system clipboard with the platform's own tool and puts
+// it in the input line. Input is sent as one line, so a multi-line
+// clipboard is pasted with its lines joined by spaces; other control
+// characters, which the server refuses, are dropped.
+
+// maxPaste is the most characters /paste puts in the input line.
+const maxPaste = 10000
+
+// pastedMsg carries what readClipboard found.
+type pastedMsg struct {
+	text string
+	err  error
+}
+
+// clipboardTools returns the commands that print the clipboard here, in
+// the order to try them.
+func clipboardTools() [][]string {
+	switch runtime.GOOS {
+	case "darwin":
+		return [][]string{{"pbpaste"}}
+	case "windows":
+		return [][]string{{"powershell.exe", "-NoProfile", "-Command", "Get-Clipboard -Raw"}}
+	}
+	tools := [][]string{
+		{"xclip", "-selection", "clipboard", "-out"},
+		{"xsel", "--clipboard", "--output"},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([][]string{{"wl-paste", "--no-newline"}}, tools...)
+	}
+	return tools
+}
+
+// readClipboard reads the clipboard with the first tool that's installed.
+func readClipboard() tea.Msg {
+	for _, tool := range clipboardTools() {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		out, err := exec.Command(tool[0], tool[1:]...).Output()
+		if err != nil {
+			return pastedMsg{err: fmt.Errorf("%s: %w", tool[0], err)}
+		}
+		return pastedMsg{text: string(out)}
+	}
+	names := make([]string, 0, len(clipboardTools()))
+	for _, tool := range clipboardTools() {
+		names = append(names, tool[0])
+	}
+	return pastedMsg{err: errors.New("no clipboard tool found (tried " + strings.Join(names, ", ") + ")")}
+}
+
+// pasteText makes clipboard text fit for the input line: one line, valid
+// UTF-8 and without control characters other than tab.
+func pasteText(text string) string {
+	text = strings.ToValidUTF8(text, "�")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.Join(strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == '\r' }), " ")
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// pasted inserts the clipboard at the cursor.
+func (m model) pasted(msg pastedMsg) model {
+	if msg.err != nil {
+		m.messages = append(m.messages, fmt.Sprintf("Can't read the clipboard: %v", msg.err))
+		return m
+	}
+	text := pasteText(msg.text)
+	if strings.TrimSpace(text) == "" {
+		m.messages = append(m.messages, "The clipboard is empty.")
+		return m
+	}
+	if utf8.RuneCountInString(text) > maxPaste {
+		text = string([]rune(text)[:maxPaste])
+		m.messages = append(m.messages, fmt.Sprintf("Pasted only the first %d characters of the clipboard.", maxPaste))
+	}
+	r := []rune(m.input)
+	cursor := min(m.cursor, len(r))
+	m.input = string(r[:cursor]) + text + string(r[cursor:])
+	m.cursor = cursor + utf8.RuneCountInString(text)
+	return m
+}
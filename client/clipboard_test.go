@@ -0,0 +1,43 @@
+// clipboard_test.go
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestPasteCommand(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("fakes xclip, which /paste uses on Linux")
+	}
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	m, _ := loggedIn(t, "alice")
+	m = typeText(t, m, "/paste")
+	next, cmd := m.Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = next.(model)
+	if cmd == nil {
+		t.Fatal("/paste returned no command to read the clipboard")
+	}
+	m = update(t, m, cmd())
+	if got := m.messages[len(m.messages)-1]; !strings.HasPrefix(got, "Can't read the clipboard: no clipboard tool found (tried xclip, xsel)") {
+		t.Errorf("without a tool, messages end %q, want the tools tried", got)
+	}
+
+	script := "#!/bin/sh\nprintf 'first line\\r\\nsecond\\tline\\a\\n'\n"
+	if err := os.WriteFile(filepath.Join(bin, "xclip"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m = typeText(t, m, "quote: ")
+	m = update(t, m, readClipboard())
+	if want := "quote: first line second\tline"; m.input != want || m.cursor != len([]rune(want)) {
+		t.Errorf("input %q, cursor %d; want %q with the cursor after it", m.input, m.cursor, want)
+	}
+}
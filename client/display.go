@@ -0,0 +1,160 @@
+// display.go
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Display options only change how View draws messages. The stored lines,
+// which /ignore, notice collapsing and the bell look at, stay as received.
+
+// timestampMode selects whether, and how, View shows when each line arrived.
+type timestampMode int
+
+const (
+	timestampsOff timestampMode = iota
+	timestamps24h               // 15:04
+	timestamps12h               // 3:04 PM
+)
+
+// parseTimestampMode parses the -timestamps flag.
+func parseTimestampMode(name string) (timestampMode, error) {
+	switch name {
+	case "off":
+		return timestampsOff, nil
+	case "24h":
+		return timestamps24h, nil
+	case "12h":
+		return timestamps12h, nil
+	}
+	return 0, fmt.Errorf("unknown timestamp format %q (want off, 24h or 12h)", name)
+}
+
+// prefix returns the timestamp shown before a line that arrived at at.
+func (t timestampMode) prefix(at time.Time) string {
+	switch t {
+	case timestamps24h:
+		return at.Format("15:04") + " "
+	case timestamps12h:
+		return at.Format("3:04 PM") + " "
+	}
+	return ""
+}
+
+// timestampsCommand handles "/timestamps on|off|24h|12h", switching
+// timestamps for every line on screen, not just new ones. "on" brings back
+// the last format used, 24h by default.
+func (m model) timestampsCommand(args []string) model {
+	if len(args) != 1 {
+		m.messages = append(m.messages, "Usage: /timestamps on|off|24h|12h")
+		return m
+	}
+	switch args[0] {
+	case "on":
+		m.timestamps = max(m.timestampsOn, timestamps24h)
+	case "off":
+		m.timestamps = timestampsOff
+	default:
+		mode, err := parseTimestampMode(args[0])
+		if err != nil {
+			m.messages = append(m.messages, "Usage: /timestamps on|off|24h|12h")
+			return m
+		}
+		m.timestamps, m.timestampsOn = mode, mode
+	}
+	return m
+}
+
+// shortenSender cuts the sender's name in a chat, PM or file line (see
+// senderOf) to width characters, ending in "…". Other lines, and a width of
+// 0, are left alone.
+func shortenSender(line string, width int) string {
+	name := senderOf(line)
+	if width <= 0 || name == "" || utf8.RuneCountInString(name) <= width {
+		return line
+	}
+	short := string([]rune(name)[:width-1]) + "…"
+	for _, prefix := range []string{"[PM from ", "[file from "} {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			return prefix + short + strings.TrimPrefix(rest, name)
+		}
+	}
+	return short + strings.TrimPrefix(line, name)
+}
+
+// senderPadding returns the spaces that right-align the sender's name on a
+// chat line ("name: text") in a column width characters wide, so message
+// text lines up. Run it after shortenSender, which makes sure the name fits.
+func senderPadding(line string, width int) string {
+	name := senderOf(line)
+	if width <= 0 || name == "" || !strings.HasPrefix(line, name+": ") {
+		return ""
+	}
+	return strings.Repeat(" ", max(width-utf8.RuneCountInString(name), 0))
+}
+
+// namePalette holds the colors senders' names are drawn in, each a darker
+// shade for light terminals and a lighter one for dark terminals so every
+// name stays readable on either.
+var namePalette = []lipgloss.AdaptiveColor{
+	{Light: "160", Dark: "203"}, // red
+	{Light: "28", Dark: "77"},   // green
+	{Light: "130", Dark: "214"}, // orange
+	{Light: "25", Dark: "75"},   // blue
+	{Light: "127", Dark: "177"}, // magenta
+	{Light: "30", Dark: "80"},   // cyan
+	{Light: "94", Dark: "180"},  // tan
+	{Light: "55", Dark: "141"},  // purple
+}
+
+// nameColor returns the color for name. It's a hash of the name, so a user
+// keeps their color in every message and every session.
+func nameColor(name string) lipgloss.AdaptiveColor {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return namePalette[h.Sum32()%uint32(len(namePalette))]
+}
+
+// colorSender draws the sender's name in a chat, PM or file line in its
+// color (see nameColor).
+func colorSender(line string) string {
+	name := senderOf(line)
+	if name == "" {
+		return line
+	}
+	start := 0
+	for _, prefix := range []string{"[PM from ", "[file from "} {
+		if strings.HasPrefix(line, prefix) {
+			start = len(prefix)
+		}
+	}
+	styled := lipgloss.NewStyle().Foreground(nameColor(name)).Render(name)
+	return line[:start] + styled + line[start+len(name):]
+}
+
+// displayLine applies the display options to messages[at], or to the
+// summary line standing in for it.
+func (m model) displayLine(line string, at int) string {
+	line = shortenSender(line, m.nameWidth)
+	pad := ""
+	if m.alignNames {
+		pad = senderPadding(line, m.nameWidth)
+	}
+	if m.colorNames {
+		line = colorSender(line)
+	}
+	line = pad + line
+	if m.showIDs && at < len(m.ids) && m.ids[at] != 0 {
+		line = fmt.Sprintf("#%d %s", m.ids[at], line)
+	}
+	if at < len(m.stamps) {
+		line = m.timestamps.prefix(m.stamps[at]) + line
+	}
+	return line
+}
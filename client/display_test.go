@@ -0,0 +1,187 @@
+// display_test.go
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+func TestTimestampsAndNameWidth(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.nameWidth = 6
+	m = receive(t, m, "bartholomew: hello", "[PM from bartholomew] psst", "carol: hi")
+	at := time.Date(2026, 1, 2, 15, 4, 0, 0, time.Local)
+	for i := range m.stamps {
+		m.stamps[i] = at
+	}
+	if got := m.messages[len(m.messages)-3]; got != "bartholomew: hello" {
+		t.Errorf("stored line %q, want the name in full", got)
+	}
+
+	for _, tc := range []struct {
+		mode timestampMode
+		want []string
+	}{
+		{timestampsOff, []string{"\nbarth…: hello\n", "\n[PM from barth…] psst\n", "\ncarol: hi\n"}},
+		{timestamps24h, []string{"\n15:04 barth…: hello\n", "\n15:04 [PM from barth…] psst\n", "\n15:04 carol: hi\n"}},
+		{timestamps12h, []string{"\n3:04 PM barth…: hello\n", "\n3:04 PM [PM from barth…] psst\n", "\n3:04 PM carol: hi\n"}},
+	} {
+		m.timestamps = tc.mode
+		view := m.View()
+		for _, want := range tc.want {
+			if !strings.Contains(view, want) {
+				t.Errorf("view with timestamps %v:\n%s\nwant %q", tc.mode, view, want)
+			}
+		}
+	}
+}
+
+func TestTimestampsCommand(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	m = receive(t, m, "bob: hello")
+	m.stamps[len(m.stamps)-1] = time.Date(2026, 1, 2, 15, 4, 0, 0, time.Local)
+
+	steps := []struct {
+		command, want string
+	}{
+		{"/timestamps on", "\n15:04 bob: hello\n"},
+		{"/timestamps 12h", "\n3:04 PM bob: hello\n"},
+		{"/timestamps off", "\nbob: hello\n"},
+		{"/timestamps on", "\n3:04 PM bob: hello\n"}, // the last format used
+		{"/timestamps sometimes", "Usage: /timestamps on|off|24h|12h"},
+	}
+	for _, step := range steps {
+		m = enter(t, m, step.command)
+		if view := m.View(); !strings.Contains(view, step.want) {
+			t.Errorf("view after %q:\n%s\nwant %q", step.command, view, step.want)
+		}
+	}
+
+	// None of it went to the server
+	m = enter(t, m, "done")
+	if got := <-s.lines; got != "done" {
+		t.Errorf("server got %q, want only the chat message", got)
+	}
+}
+
+func TestAlignNames(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.nameWidth, m.alignNames = 8, true
+	m = receive(t, m, "bob: hi", "bartholomew: hello", "[PM from bob] psst", "* bob waves")
+
+	view := m.View()
+	for _, want := range []string{
+		"\n     bob: hi\n",
+		"\nbarthol…: hello\n",
+		"\n[PM from bob] psst\n", // only chat lines are padded
+		"\n* bob waves\n",
+	} {
+		if !strings.Contains(view, want) {
+			t.Errorf("view:\n%s\nwant %q", view, want)
+		}
+	}
+}
+
+func TestNameColors(t *testing.T) {
+	profile := lipgloss.ColorProfile()
+	lipgloss.SetColorProfile(termenv.ANSI256)
+	t.Cleanup(func() { lipgloss.SetColorProfile(profile) })
+
+	m, _ := loggedIn(t, "alice")
+	m.colorNames = true
+	m = receive(t, m, "bob: hi", "[PM from bob] psst", "carol: bob said hi")
+	bob := lipgloss.NewStyle().Foreground(nameColor("bob")).Render("bob")
+	carol := lipgloss.NewStyle().Foreground(nameColor("carol")).Render("carol")
+	if bob == "bob" {
+		t.Fatal("names aren't styled under ANSI256")
+	}
+	view := m.View()
+	for _, want := range []string{"\n" + bob + ": hi\n", "\n[PM from " + bob + "] psst\n", "\n" + carol + ": bob said hi\n"} {
+		if !strings.Contains(view, want) {
+			t.Errorf("view:\n%q\nwant %q", view, want)
+		}
+	}
+
+	// Names keep their color, and don't all share one
+	colors := map[lipgloss.AdaptiveColor]bool{}
+	for i := range 20 {
+		name := fmt.Sprint("user", i)
+		if nameColor(name) != nameColor(name) {
+			t.Errorf("%s changed color", name)
+		}
+		colors[nameColor(name)] = true
+	}
+	if len(colors) < 4 {
+		t.Errorf("20 names got %d colors, want them spread over the palette", len(colors))
+	}
+}
+
+func TestTinyTerminals(t *testing.T) {
+	var rooms []string
+	for i := range 30 {
+		rooms = append(rooms, fmt.Sprintf("#r%d (1)", i))
+	}
+	for _, size := range []tea.WindowSizeMsg{{Width: 0, Height: 0}, {Width: 1, Height: 1}, {Width: 3, Height: 2}, {Width: 80, Height: 4}, {Width: -1, Height: -1}} {
+		m, _ := loggedIn(t, "alice")
+		m.timestamps, m.nameWidth, m.alignNames, m.colorNames, m.showIDs = timestamps24h, 4, true, true, true
+		m = update(t, m, size)
+		m = receive(t, m, "bartholomew: hello", "[PM from bob] psst")
+		typeText(t, m, "typing").View()
+
+		m = enter(t, m, "/rooms")
+		m = receive(t, m, "Rooms: "+strings.Join(rooms, ", "))
+		for range 20 {
+			m = press(t, m, tea.KeyDown)
+		}
+		view := m.View()
+		if !strings.Contains(view, "> #r20 (1)") {
+			t.Errorf("%dx%d room menu:\n%s\nwant the cursor on #r20 shown", size.Width, size.Height, view)
+		}
+		if rows := strings.Count(view, "\n") - 2; size.Height > 3 && rows > size.Height-3 {
+			t.Errorf("%dx%d room menu shows %d rooms, more than fit", size.Width, size.Height, rows)
+		}
+	}
+}
+
+func TestNoColor(t *testing.T) {
+	profile := lipgloss.ColorProfile()
+	t.Cleanup(func() { lipgloss.SetColorProfile(profile) })
+	tests := []struct {
+		noColor           bool
+		env, term         string
+		plain, hyperlinks bool
+	}{
+		{false, "", "xterm-256color", false, true},
+		{true, "", "xterm-256color", true, false},
+		{false, "1", "xterm-256color", true, false},
+		{false, "", "dumb", false, false},
+	}
+	for _, tt := range tests {
+		lipgloss.SetColorProfile(termenv.ANSI256)
+		t.Setenv("NO_COLOR", tt.env)
+		t.Setenv("TERM", tt.term)
+		plain, hyperlinks := termStyles(tt.noColor)
+		if plain != tt.plain || hyperlinks != tt.hyperlinks {
+			t.Errorf("-no-color=%v, NO_COLOR=%q, TERM=%s: plain %v, hyperlinks %v; want %v, %v",
+				tt.noColor, tt.env, tt.term, plain, hyperlinks, tt.plain, tt.hyperlinks)
+			continue
+		}
+
+		m, _ := loggedIn(t, "alice")
+		m.plain, m.hyperlinks, m.colorNames = plain, hyperlinks, !plain
+		m = receive(t, m, markdownPrefix+"# **Welcome**", "bob: see https://example.com")
+		view := m.View()
+		if styled := strings.Contains(view, "\x1b["); styled == plain {
+			t.Errorf("-no-color=%v, NO_COLOR=%q: view styled %v, want %v:\n%q", tt.noColor, tt.env, styled, !plain, view)
+		}
+		if linked := strings.Contains(view, "\x1b]8;;"); linked != hyperlinks {
+			t.Errorf("-no-color=%v, NO_COLOR=%q, TERM=%s: hyperlinks in the view %v, want %v", tt.noColor, tt.env, tt.term, linked, hyperlinks)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+// editing.go
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// editMode selects the input keybindings.
+type editMode int
+
+const (
+	editEmacs editMode = iota // readline-style Ctrl bindings
+	editVim                   // modal: Esc for normal mode, i/a to insert
+)
+
+// parseEditMode parses the -editmode flag.
+func parseEditMode(name string) (editMode, error) {
+	switch name {
+	case "emacs":
+		return editEmacs, nil
+	case "vim":
+		return editVim, nil
+	}
+	return 0, fmt.Errorf("unknown edit mode %q (want emacs or vim)", name)
+}
+
+// keyBinding is one key and what it does, as listed by /keys.
+type keyBinding struct {
+	key, action string
+}
+
+// Keys listed by /keys. Keep these in step with update, editInput,
+// emacsKey and vimNormalKey.
+var (
+	commonKeys = []keyBinding{
+		{"Enter", "send the line"},
+		{"Tab", "complete a username (again to cycle)"},
+		{"Ctrl+O", "expand or collapse join/leave runs"},
+		{"Ctrl+C", "quit"},
+		{"←/→", "move the cursor"},
+		{"Home/End", "go to start/end of line"},
+		{"Backspace/Delete", "delete before/under the cursor"},
+	}
+	emacsKeys = []keyBinding{
+		{"Ctrl+A/Ctrl+E", "go to start/end of line"},
+		{"Ctrl+B/Ctrl+F", "move back/forward a character"},
+		{"Ctrl+D", "delete under the cursor"},
+		{"Ctrl+K", "kill to end of line"},
+		{"Ctrl+U", "kill to start of line"},
+		{"Ctrl+W", "kill the word before the cursor"},
+		{"Ctrl+Y", "yank the last kill"},
+	}
+	vimKeys = []keyBinding{
+		{"Esc", "normal mode"},
+		{"h/l", "move left/right (normal)"},
+		{"0/$", "go to start/end of line (normal)"},
+		{"b/w", "previous/next word (normal)"},
+		{"x", "delete under the cursor (normal)"},
+		{"D", "kill to end of line (normal)"},
+		{"i/a", "insert before/after the cursor (normal)"},
+		{"I/A", "insert at start/end of line (normal)"},
+	}
+)
+
+// keyList renders the keys active in mode for /keys, one per line.
+func keyList(mode editMode) []string {
+	name, keys := "emacs", emacsKeys
+	if mode == editVim {
+		name, keys = "vim", vimKeys
+	}
+	keys = append(append([]keyBinding{}, commonKeys...), keys...)
+
+	width := 0
+	for _, k := range keys {
+		width = max(width, len([]rune(k.key)))
+	}
+	lines := []string{"Key bindings (-editmode " + name + "):"}
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("  %-*s  %s", width, k.key, k.action))
+	}
+	return lines
+}
+
+// editInput applies a key to the input line and cursor. Keys common to both
+// modes (arrows, Home/End, Backspace/Delete) always work; the rest depend on
+// the edit mode.
+func (m model) editInput(msg tea.KeyMsg) model {
+	if m.editMode == editVim && m.vimNormal {
+		return m.vimNormalKey(msg)
+	}
+
+	r := []rune(m.input)
+	switch msg.Type {
+	case tea.KeyRunes:
+		r = append(r[:m.cursor], append(append([]rune{}, msg.Runes...), r[m.cursor:]...)...)
+		m.cursor += len(msg.Runes)
+	case tea.KeySpace:
+		r = append(r[:m.cursor], append([]rune{' '}, r[m.cursor:]...)...)
+		m.cursor++
+	case tea.KeyBackspace:
+		if m.cursor > 0 {
+			r = append(r[:m.cursor-1], r[m.cursor:]...)
+			m.cursor--
+		}
+	case tea.KeyDelete:
+		if m.cursor < len(r) {
+			r = append(r[:m.cursor], r[m.cursor+1:]...)
+		}
+	case tea.KeyLeft:
+		m.cursor = max(m.cursor-1, 0)
+	case tea.KeyRight:
+		m.cursor = min(m.cursor+1, len(r))
+	case tea.KeyHome:
+		m.cursor = 0
+	case tea.KeyEnd:
+		m.cursor = len(r)
+	case tea.KeyEsc:
+		if m.editMode == editVim {
+			m.vimNormal = true
+			m.cursor = max(m.cursor-1, 0)
+		}
+	default:
+		if m.editMode == editEmacs {
+			return m.emacsKey(msg)
+		}
+	}
+	m.input = string(r)
+	return m
+}
+
+// emacsKey handles the readline-style Ctrl bindings.
+func (m model) emacsKey(msg tea.KeyMsg) model {
+	r := []rune(m.input)
+	switch msg.Type {
+	case tea.KeyCtrlA:
+		m.cursor = 0
+	case tea.KeyCtrlE:
+		m.cursor = len(r)
+	case tea.KeyCtrlB:
+		m.cursor = max(m.cursor-1, 0)
+	case tea.KeyCtrlF:
+		m.cursor = min(m.cursor+1, len(r))
+	case tea.KeyCtrlD:
+		if m.cursor < len(r) {
+			r = append(r[:m.cursor], r[m.cursor+1:]...)
+		}
+	case tea.KeyCtrlK:
+		m.killBuffer = string(r[m.cursor:])
+		r = r[:m.cursor]
+	case tea.KeyCtrlU:
+		m.killBuffer = string(r[:m.cursor])
+		r = r[m.cursor:]
+		m.cursor = 0
+	case tea.KeyCtrlW:
+		start := wordStart(r, m.cursor)
+		m.killBuffer = string(r[start:m.cursor])
+		r = append(r[:start], r[m.cursor:]...)
+		m.cursor = start
+	case tea.KeyCtrlY:
+		yank := []rune(m.killBuffer)
+		r = append(r[:m.cursor], append(yank, r[m.cursor:]...)...)
+		m.cursor += len(yank)
+	}
+	m.input = string(r)
+	return m
+}
+
+// vimNormalKey handles keys in vim normal mode, where letters are commands.
+func (m model) vimNormalKey(msg tea.KeyMsg) model {
+	r := []rune(m.input)
+	last := max(len(r)-1, 0)
+	switch msg.Type {
+	case tea.KeyLeft:
+		m.cursor = max(m.cursor-1, 0)
+	case tea.KeyRight:
+		m.cursor = min(m.cursor+1, last)
+	case tea.KeyRunes:
+		switch string(msg.Runes) {
+		case "h":
+			m.cursor = max(m.cursor-1, 0)
+		case "l":
+			m.cursor = min(m.cursor+1, last)
+		case "0":
+			m.cursor = 0
+		case "$":
+			m.cursor = last
+		case "b":
+			m.cursor = wordStart(r, m.cursor)
+		case "w":
+			m.cursor = min(wordEnd(r, m.cursor), last)
+		case "x":
+			if m.cursor < len(r) {
+				r = append(r[:m.cursor], r[m.cursor+1:]...)
+				m.cursor = min(m.cursor, max(len(r)-1, 0))
+			}
+		case "D":
+			m.killBuffer = string(r[m.cursor:])
+			r = r[:m.cursor]
+			m.cursor = max(m.cursor-1, 0)
+		case "i":
+			m.vimNormal = false
+		case "a":
+			m.vimNormal = false
+			m.cursor = min(m.cursor+1, len(r))
+		case "I":
+			m.vimNormal = false
+			m.cursor = 0
+		case "A":
+			m.vimNormal = false
+			m.cursor = len(r)
+		}
+	}
+	m.input = string(r)
+	return m
+}
+
+// wordStart returns the offset of the start of the word before cursor,
+// skipping any spaces directly behind it.
+func wordStart(r []rune, cursor int) int {
+	i := cursor
+	for i > 0 && unicode.IsSpace(r[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(r[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd returns the offset of the start of the word after cursor.
+func wordEnd(r []rune, cursor int) int {
+	i := cursor
+	for i < len(r) && !unicode.IsSpace(r[i]) {
+		i++
+	}
+	for i < len(r) && unicode.IsSpace(r[i]) {
+		i++
+	}
+	return i
+}
+
+// renderInput draws the input line with the cursor shown in reverse video,
+// or as a | when m.plain. Password input is masked.
+func (m model) renderInput() string {
+	r := []rune(m.input)
+	if m.state == statePassword {
+		r = []rune(strings.Repeat("*", len(r)))
+	}
+	cursor := min(m.cursor, len(r))
+	if m.plain {
+		return string(r[:cursor]) + "|" + string(r[cursor:])
+	}
+
+	under := " "
+	rest := ""
+	if cursor < len(r) {
+		under = string(r[cursor])
+		rest = string(r[cursor+1:])
+	}
+	return string(r[:cursor]) + "\x1b[7m" + under + "\x1b[0m" + rest
+}
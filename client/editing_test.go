@@ -0,0 +1,84 @@
+// editing_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestEmacsBindings(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m = typeText(t, m, "world")
+	m = press(t, m, tea.KeyCtrlA)
+	m = typeText(t, m, "hello ")
+	if m.input != "hello world" || m.cursor != 6 {
+		t.Fatalf("after Ctrl-A and typing: input %q, cursor %d", m.input, m.cursor)
+	}
+
+	m = press(t, m, tea.KeyCtrlK)
+	if m.input != "hello " || m.killBuffer != "world" {
+		t.Errorf("after Ctrl-K: input %q, kill buffer %q", m.input, m.killBuffer)
+	}
+	m = press(t, m, tea.KeyCtrlA, tea.KeyCtrlY)
+	if m.input != "worldhello " {
+		t.Errorf("after Ctrl-A Ctrl-Y: input %q", m.input)
+	}
+	m = press(t, m, tea.KeyCtrlE, tea.KeyCtrlW)
+	if m.input != "" || m.killBuffer != "worldhello " {
+		t.Errorf("after Ctrl-E Ctrl-W: input %q, kill buffer %q", m.input, m.killBuffer)
+	}
+}
+
+func TestVimBindings(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.editMode = editVim
+	m = typeText(t, m, "hello world")
+	m = press(t, m, tea.KeyEsc)
+	m = typeText(t, m, "0x")
+	if m.input != "ello world" || !m.vimNormal {
+		t.Errorf("after Esc 0 x: input %q, normal mode %v", m.input, m.vimNormal)
+	}
+	// "i" goes back to typing
+	m = typeText(t, m, "iH")
+	if m.input != "Hello world" || m.vimNormal {
+		t.Errorf("after i H: input %q, normal mode %v", m.input, m.vimNormal)
+	}
+}
+
+func TestKeysCommand(t *testing.T) {
+	for _, tt := range []struct {
+		mode      editMode
+		want, not string
+		heading   string
+	}{
+		{editEmacs, "Ctrl+K", "i/a", "Key bindings (-editmode emacs):"},
+		{editVim, "i/a", "Ctrl+K", "Key bindings (-editmode vim):"},
+	} {
+		m, _ := loggedIn(t, "alice")
+		m.editMode = tt.mode
+		before := len(m.messages)
+		m = enter(t, m, "/keys")
+		got := m.messages[before:]
+		if len(got) == 0 || got[0] != tt.heading {
+			t.Fatalf("/keys = %q, want it to start %q", got, tt.heading)
+		}
+		listed := func(key string) bool {
+			for _, line := range got[1:] {
+				if strings.HasPrefix(strings.TrimSpace(line), key+" ") {
+					return true
+				}
+			}
+			return false
+		}
+		for _, key := range []string{"Enter", "Tab", "Ctrl+C", tt.want} {
+			if !listed(key) {
+				t.Errorf("%s: /keys doesn't list %s: %q", tt.heading, key, got)
+			}
+		}
+		if listed(tt.not) {
+			t.Errorf("%s: /keys lists %s from the other mode: %q", tt.heading, tt.not, got)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// edits.go
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// When a message in the room is edited or deleted (/edit and /delete on
+// the server), the server sends editPrefix or deletePrefix lines with its
+// ID, and the line already on screen is changed in place. That's why every
+// line keeps the ID it came with (see messageIDPrefix).
+
+// Lines about a changed message: "[edit 42] alice: fixed (edited)" and
+// "[delete 42]".
+const (
+	editPrefix   = "[edit "
+	deletePrefix = "[delete "
+)
+
+// deletedLine stands in for a deleted message.
+const deletedLine = "(message deleted)"
+
+// changedMessage parses an edit or delete line, returning the message's ID
+// and, for an edit, its new line. ok is false for any other line.
+func changedMessage(line string) (id int64, edited string, deleted, ok bool) {
+	if rest, found := strings.CutPrefix(line, editPrefix); found {
+		num, text, found := strings.Cut(rest, "] ")
+		n, err := strconv.ParseInt(num, 10, 64)
+		return n, text, false, found && err == nil
+	}
+	if rest, found := strings.CutPrefix(line, deletePrefix); found {
+		n, err := strconv.ParseInt(strings.TrimSuffix(rest, "]"), 10, 64)
+		return n, "", true, strings.HasSuffix(rest, "]") && err == nil
+	}
+	return 0, "", false, false
+}
+
+// applyEdit replaces the line of message id with edited, or with
+// deletedLine if it was deleted. An edit to a message that's no longer on
+// screen is shown as a new line, so it isn't missed.
+func (m model) applyEdit(id int64, edited string, deleted bool) model {
+	for i := len(m.ids) - 1; i >= 0; i-- {
+		if m.ids[i] != id {
+			continue
+		}
+		if deleted {
+			m.messages[i], m.ids[i] = deletedLine, 0
+		} else {
+			m.messages[i] = edited
+		}
+		return m
+	}
+	if !deleted && !m.ignored[senderOf(edited)] {
+		m.messages = append(m.messages, edited)
+		m.ids = append(m.ids, id)
+	}
+	return m
+}
@@ -0,0 +1,39 @@
+// edits_test.go
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEditsRewriteTheirLine(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m.scrollback = 4
+	// Replayed history carries IDs, like live messages
+	m = receive(t, m, "[id 1] bob: one", "carol has joined the chat", "[id 2] carol: two", "[id 3] bob: three")
+	check := func(step string, messages []string, ids []int64) {
+		t.Helper()
+		if !slices.Equal(m.messages, messages) || !slices.Equal(m.ids, ids) {
+			t.Fatalf("after %s: messages %q, ids %v; want %q, %v", step, m.messages, m.ids, messages, ids)
+		}
+	}
+	check("the history", []string{"bob: one", "carol has joined the chat", "carol: two", "bob: three"}, []int64{1, 0, 2, 3})
+
+	m = receive(t, m, "[edit 2] carol: two, fixed (edited)")
+	check("an edit", []string{"bob: one", "carol has joined the chat", "carol: two, fixed (edited)", "bob: three"}, []int64{1, 0, 2, 3})
+
+	// A deleted line keeps its place but loses its ID, so a later line
+	// still lines up with its own
+	m = receive(t, m, "[delete 1]", "[id 4] bob: four")
+	check("a delete", []string{"carol has joined the chat", "carol: two, fixed (edited)", "bob: three", "bob: four"}, []int64{0, 2, 3, 4})
+	m = receive(t, m, "[delete 3]", "[edit 4] bob: four, fixed (edited)")
+	check("a delete then an edit", []string{"carol has joined the chat", "carol: two, fixed (edited)", deletedLine, "bob: four, fixed (edited)"}, []int64{0, 2, 0, 4})
+
+	// An edit to a line scrolled away is added at the end with its ID, so
+	// a delete after it finds it
+	m = receive(t, m, "[id 5] bob: five", "[id 6] bob: six")
+	m = receive(t, m, "[edit 2] carol: two, again (edited)")
+	check("an edit off screen", []string{"bob: four, fixed (edited)", "bob: five", "bob: six", "carol: two, again (edited)"}, []int64{4, 5, 6, 2})
+	m = receive(t, m, "[delete 2]")
+	check("its delete", []string{"bob: four, fixed (edited)", "bob: five", "bob: six", deletedLine}, []int64{4, 5, 6, 0})
+}
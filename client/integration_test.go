@@ -0,0 +1,215 @@
+// integration_test.go
+package main
+
+import (
+	"bufio"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// The integration test runs the real server, built from ../server, on a
+// loopback port, and drives models against it over TCP. Their lines come
+// through readServer, as in main; the test hands them to Update in order.
+
+// startServer builds the server and runs it on a free loopback port until t
+// ends. It returns the address and the registration code the server logged.
+func startServer(t *testing.T) (addr, regKey string) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("builds and runs the server")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go command to build the server with")
+	}
+	bin := filepath.Join(t.TempDir(), "server")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	build.Dir = filepath.Join("..", "server")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building the server: %v\n%s", err, out)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr = ln.Addr().String()
+	ln.Close()
+
+	cmd := exec.Command(bin, "-listen", addr, "-hash-iterations", "1000", "-auth-delay", "0", "-history-lines", "0")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("starting the server: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	// The log says the code, then that it's listening
+	logged := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logged <- scanner.Text()
+		}
+		close(logged)
+	}()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-logged:
+			if !ok {
+				t.Fatal("the server exited before listening")
+			}
+			if _, key, found := strings.Cut(line, "Registration Key for new signups: "); found {
+				regKey = key
+			}
+			if strings.Contains(line, "Accepting chat clients on") {
+				// Keep draining, so the server never blocks on its log
+				go func() {
+					for range logged {
+					}
+				}()
+				return addr, regKey
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the server to listen")
+		}
+	}
+}
+
+// liveClient is a model connected to a real server. Everything readServer
+// delivers waits in msgs until the test hands it to the model.
+type liveClient struct {
+	t    *testing.T
+	m    model
+	msgs chan tea.Msg
+	seen int // messages already looked through by until
+}
+
+// dialLive connects a new model to the server at addr, in the login state
+// as main starts it.
+func dialLive(t *testing.T, addr string) *liveClient {
+	t.Helper()
+	conn, err := dialServer(addr, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &liveClient{t: t, msgs: make(chan tea.Msg, 1000)}
+	c.m = model{
+		conn:   conn,
+		state:  stateLogin,
+		online: make(map[string]bool),
+		addr:   addr,
+		listen: func(conn net.Conn) { go readServer(conn, func(msg tea.Msg) { c.msgs <- msg }) },
+	}
+	c.m.listen(conn)
+	return c
+}
+
+// until hands the model what the server sent until a message it hasn't
+// shown before contains want, and returns that message.
+func (c *liveClient) until(want string) string {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		for ; c.seen < len(c.m.messages); c.seen++ {
+			if line := c.m.messages[c.seen]; strings.Contains(line, want) {
+				c.seen++
+				return line
+			}
+		}
+		select {
+		case msg := <-c.msgs:
+			before := c.m.state
+			c.m = update(c.t, c.m, msg)
+			// The welcome starts the messages over
+			if before != stateChat && c.m.state == stateChat {
+				c.seen = 0
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q; messages %q", want, c.m.messages)
+		}
+	}
+}
+
+// enter types text in the model and presses Enter.
+func (c *liveClient) enter(text string) {
+	c.t.Helper()
+	c.m = enter(c.t, c.m, text)
+}
+
+// registerLive registers an account through a new model, and returns its
+// username once the server has closed the connection, as it does after
+// registering.
+func registerLive(t *testing.T, addr, regKey, password string) string {
+	t.Helper()
+	c := dialLive(t, addr)
+	c.until("Enter 'login' or 'register'")
+	c.enter("register")
+	c.until("registration code")
+	c.enter(regKey)
+	username := strings.TrimPrefix(c.until("Your randomly generated username is: "), "Your randomly generated username is: ")
+	c.until("Enter your desired password")
+	c.enter(password)
+	c.until("Registration successful!")
+	c.until("Connection closed by server.")
+	if c.m.state != stateDisconnected {
+		t.Errorf("state after registering = %v, want stateDisconnected", c.m.state)
+	}
+	return username
+}
+
+// loginLive logs username in through a new model and returns it once the
+// server says it's live.
+func loginLive(t *testing.T, addr, username, password string) *liveClient {
+	t.Helper()
+	c := dialLive(t, addr)
+	c.until("Enter 'login' or 'register'")
+	c.enter("login")
+	c.until("Username:")
+	c.enter(username)
+	c.until("Password")
+	if c.m.state != statePassword {
+		t.Errorf("state at the password prompt = %v, want statePassword", c.m.state)
+	}
+	c.enter(password)
+	c.until("Welcome back, " + username + "!")
+	c.until("--- now live in #general ---")
+	if c.m.state != stateChat || c.m.username != username {
+		t.Fatalf("after logging in: state %v as %q, want stateChat as %s", c.m.state, c.m.username, username)
+	}
+	return c
+}
+
+func TestClientAgainstServer(t *testing.T) {
+	addr, regKey := startServer(t)
+	alice := registerLive(t, addr, regKey, "alice's password")
+	bob := registerLive(t, addr, regKey, "bob's password")
+
+	a := loginLive(t, addr, alice, "alice's password")
+	b := loginLive(t, addr, bob, "bob's password")
+	a.until(bob + " has joined the chat")
+
+	a.enter("hello, bob")
+	b.until(alice + ": hello, bob")
+	if view := b.m.View(); !strings.Contains(view, alice+": hello, bob") {
+		t.Errorf("bob's view:\n%s\nwant alice's message", view)
+	}
+	if view := a.m.View(); !strings.Contains(view, "You: hello, bob") {
+		t.Errorf("alice's view:\n%s\nwant their own message", view)
+	}
+
+	b.enter("/msg " + alice + " just us")
+	a.until("[PM from " + bob + "] just us")
+}
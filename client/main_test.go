@@ -0,0 +1,116 @@
+// main_test.go
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The tests of main run it in a child process, since it exits: the test
+// binary is run again with just that test, which calls runChildMain.
+
+// mainCommand returns a command that runs main with args in a child
+// process, from the test named test.
+func mainCommand(test string, args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^"+test+"$")
+	cmd.Env = append(os.Environ(), "CLIENT_TEST_MAIN=1", "CLIENT_TEST_ARGS="+strings.Join(args, "\n"))
+	return cmd
+}
+
+// runChildMain runs main with the arguments mainCommand was given, if this
+// is the child process, and reports whether it was.
+func runChildMain() bool {
+	if os.Getenv("CLIENT_TEST_MAIN") != "1" {
+		return false
+	}
+	os.Args = []string{"client"}
+	if args := os.Getenv("CLIENT_TEST_ARGS"); args != "" {
+		os.Args = append(os.Args, strings.Split(args, "\n")...)
+	}
+	main()
+	return true
+}
+
+func TestNoAddress(t *testing.T) {
+	if runChildMain() {
+		return
+	}
+	cmd := mainCommand("TestNoAddress")
+	cmd.Stdin = strings.NewReader("")
+	out, err := cmd.CombinedOutput()
+
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 2 {
+		t.Fatalf("client with empty stdin: %v, want exit status 2; output %q", err, out)
+	}
+	for _, want := range []string{"Error: no server address provided.", "client -addr host:port"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("output %q, want %q", out, want)
+		}
+	}
+}
+
+func TestProfile(t *testing.T) {
+	if runChildMain() {
+		return
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	profiles := filepath.Join(t.TempDir(), "profiles")
+	os.WriteFile(profiles, []byte("# test profiles\n[home]\naddr = 127.0.0.1:1\n\n[work]\naddr = "+ln.Addr().String()+"\nusername = alice\n"), 0o600)
+
+	// Connecting to the listener shows the work profile's address was used
+	cmd := mainCommand("TestProfile", "-profiles", profiles, "-profile", "work")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the client didn't connect to the profile's address")
+	}
+
+	os.WriteFile(profiles, []byte("[work]\ncolour = never\n"), 0o600)
+	out, err := mainCommand("TestProfile", "-profiles", profiles, "-profile", "work").CombinedOutput()
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) || exit.ExitCode() != 2 || !strings.Contains(string(out), `profile: unknown setting "colour"`) {
+		t.Errorf("profile with an unknown setting: %v, output %q; want exit status 2 naming it", err, out)
+	}
+}
+
+func TestAltScreenByDefault(t *testing.T) {
+	if runChildMain() {
+		return
+	}
+	// Bubble Tea needs a terminal to run the client, so this checks the
+	// default in the usage; TestInitCommands checks the program leaves the
+	// alternate screen
+	out, _ := mainCommand("TestAltScreenByDefault", "-h").CombinedOutput()
+	_, usage, _ := strings.Cut(string(out), "-alt-screen")
+	usage, _, _ = strings.Cut(usage, "\n  -")
+	if !strings.Contains(usage, "(default true)") {
+		t.Errorf("usage of -alt-screen %q, want it on by default; output %q", usage, out)
+	}
+}
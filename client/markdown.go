@@ -0,0 +1,114 @@
+// markdown.go
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// markdownPrefix marks a server line (the MOTD or an /announce) that may be
+// rendered as Markdown. Other lines, chat included, are shown as sent.
+const markdownPrefix = "[md] "
+
+// textStyle is what rendered Markdown styles build on: lipgloss would
+// otherwise turn tabs into spaces. Like every other style, it draws nothing
+// under NO_COLOR or -no-color (see termStyles).
+var textStyle = lipgloss.NewStyle().TabWidth(lipgloss.NoTabConversion)
+
+var (
+	headingPattern = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	bulletPattern  = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	codePattern    = regexp.MustCompile("`([^`]+)`")
+	boldPattern    = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	italicPattern  = regexp.MustCompile(`\*([^*\s][^*]*)\*|\b_([^_\s][^_]*)_\b`)
+)
+
+// renderMarkdown renders one line of basic Markdown for the terminal:
+// headings, bullet lists, **bold**, *italic* and `code`. Anything else,
+// numbered lists included, is left as written. If plain, nothing is styled:
+// headings and lists are laid out the same, but emphasis and code spans are
+// left as written, which reads better than losing them.
+func renderMarkdown(line string, plain bool) string {
+	inline := renderInline
+	if plain {
+		inline = func(text string, _ lipgloss.Style) string { return text }
+	}
+	if m := headingPattern.FindStringSubmatch(line); m != nil {
+		if plain {
+			return m[1]
+		}
+		return inline(m[1], textStyle.Bold(true))
+	}
+	if m := bulletPattern.FindStringSubmatch(line); m != nil {
+		return m[1] + "• " + inline(m[2], textStyle)
+	}
+	return inline(line, textStyle)
+}
+
+// renderInline renders the emphasis and code spans in text, on top of
+// style. Each span is rendered on its own, as lipgloss resets every
+// attribute at the end of one. Code spans are shown literally, so their
+// contents are never styled further.
+func renderInline(text string, style lipgloss.Style) string {
+	var sb strings.Builder
+	for {
+		loc := codePattern.FindStringSubmatchIndex(text)
+		if loc == nil {
+			sb.WriteString(renderBold(text, style))
+			return sb.String()
+		}
+		sb.WriteString(renderBold(text[:loc[0]], style))
+		sb.WriteString(style.Reverse(true).Render(text[loc[2]:loc[3]]))
+		text = text[loc[1]:]
+	}
+}
+
+// renderBold renders **bold** and __bold__ spans, and the italics in and
+// around them.
+func renderBold(text string, style lipgloss.Style) string {
+	var sb strings.Builder
+	for {
+		loc := boldPattern.FindStringSubmatchIndex(text)
+		if loc == nil {
+			sb.WriteString(renderItalic(text, style))
+			return sb.String()
+		}
+		sb.WriteString(renderItalic(text[:loc[0]], style))
+		sb.WriteString(renderItalic(submatch(text, loc), style.Bold(true)))
+		text = text[loc[1]:]
+	}
+}
+
+// renderItalic renders *italic* and _italic_ spans.
+func renderItalic(text string, style lipgloss.Style) string {
+	var sb strings.Builder
+	for {
+		loc := italicPattern.FindStringSubmatchIndex(text)
+		if loc == nil {
+			sb.WriteString(renderSpan(text, style))
+			return sb.String()
+		}
+		sb.WriteString(renderSpan(text[:loc[0]], style))
+		sb.WriteString(renderSpan(submatch(text, loc), style.Italic(true)))
+		text = text[loc[1]:]
+	}
+}
+
+// renderSpan renders text in style, leaving nothing behind for no text.
+func renderSpan(text string, style lipgloss.Style) string {
+	if text == "" {
+		return ""
+	}
+	return style.Render(text)
+}
+
+// submatch returns whichever of a pattern's two alternatives matched, by
+// the indexes loc that FindStringSubmatchIndex returned.
+func submatch(text string, loc []int) string {
+	if loc[2] >= 0 {
+		return text[loc[2]:loc[3]]
+	}
+	return text[loc[4]:loc[5]]
+}
@@ -0,0 +1,38 @@
+// markdown_test.go
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+func TestMarkdownLines(t *testing.T) {
+	profile := lipgloss.ColorProfile()
+	lipgloss.SetColorProfile(termenv.ANSI256)
+	t.Cleanup(func() { lipgloss.SetColorProfile(profile) })
+
+	m, _ := loggedIn(t, "alice")
+	m = receive(t, m, "[md] # Release *notes*", "[md] - **Bold** news, *quietly* put, with `/help`", "bob: **not** markdown")
+	bold, italic, code := textStyle.Bold(true), textStyle.Italic(true), textStyle.Reverse(true)
+	want := []string{
+		bold.Render("Release ") + bold.Italic(true).Render("notes"),
+		"• " + bold.Render("Bold") + " news, " + italic.Render("quietly") + " put, with " + code.Render("/help"),
+		"bob: **not** markdown",
+	}
+	if want[0] == "Release notes" {
+		t.Fatal("Markdown isn't styled under ANSI256")
+	}
+	if got := m.messages[len(m.messages)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("messages end %q, want %q", got, want)
+	}
+
+	m.plain = true
+	m = receive(t, m, "[md] ## Plain", "[md] * **as** written")
+	want = []string{"Plain", "• **as** written"}
+	if got := m.messages[len(m.messages)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("with -no-color, messages end %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+// notices.go
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// noticePattern matches the server's join/leave notices, for the chat
+// ("alice has joined the chat") or a room ("alice has left #dev").
+var noticePattern = regexp.MustCompile(`^\S+ has (joined|left) (the chat|#\S+)$`)
+
+// collapseNotices replaces each run of two or more consecutive join/leave
+// notices in lines with one summary line. Ctrl+O toggles it in View. It also
+// returns, for each line out, the index in lines of the first one it shows.
+func collapseNotices(lines []string) ([]string, []int) {
+	var out []string
+	var from []int
+	for i := 0; i < len(lines); {
+		end := i
+		for end < len(lines) && noticePattern.MatchString(lines[end]) {
+			end++
+		}
+		switch {
+		case end == i:
+			out = append(out, lines[i])
+			end++
+		case end-i == 1:
+			out = append(out, lines[i])
+		default:
+			out = append(out, summarizeNotices(lines[i:end]))
+		}
+		from = append(from, i)
+		i = end
+	}
+	return out, from
+}
+
+// summarizeNotices describes a run of notices, e.g.
+// "· 3 users joined, 1 left — Ctrl+O to expand".
+func summarizeNotices(run []string) string {
+	var joined, left int
+	for _, line := range run {
+		if noticePattern.FindStringSubmatch(line)[1] == "joined" {
+			joined++
+		} else {
+			left++
+		}
+	}
+
+	var parts []string
+	if joined > 0 {
+		parts = append(parts, countUsers(joined)+" joined")
+	}
+	if left > 0 {
+		if joined > 0 {
+			parts = append(parts, fmt.Sprintf("%d left", left))
+		} else {
+			parts = append(parts, countUsers(left)+" left")
+		}
+	}
+	return "· " + strings.Join(parts, ", ") + " — Ctrl+O to expand"
+}
+
+func countUsers(n int) string {
+	if n == 1 {
+		return "1 user"
+	}
+	return fmt.Sprintf("%d users", n)
+}
@@ -0,0 +1,92 @@
+// notify.go
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// notifyMode selects which incoming messages ring the terminal bell. Each
+// mode includes the ones before it.
+type notifyMode int
+
+const (
+	notifyNone    notifyMode = iota // never
+	notifyPM                        // private messages
+	notifyMention                   // ...and messages that mention you
+	notifyAll                       // ...and every message from someone else
+)
+
+// parseNotifyMode parses the -notify flag.
+func parseNotifyMode(name string) (notifyMode, error) {
+	switch name {
+	case "none":
+		return notifyNone, nil
+	case "pm":
+		return notifyPM, nil
+	case "mention":
+		return notifyMention, nil
+	case "all":
+		return notifyAll, nil
+	}
+	return 0, fmt.Errorf("unknown notify mode %q (want pm, mention, all or none)", name)
+}
+
+// notifyModeNames are the names of notify modes, as -notify and /notify
+// take them.
+var notifyModeNames = [...]string{notifyNone: "none", notifyPM: "pm", notifyMention: "mention", notifyAll: "all"}
+
+// notifyCommand handles "/notify [on|off|pm|mention|all|none]", changing
+// which messages ring the bell from then on; on its own it shows the mode.
+// "on" brings back the last mode used (that of -notify, or mention) and
+// "off" is none.
+func (m model) notifyCommand(args []string) model {
+	const usage = "Usage: /notify on|off|pm|mention|all|none"
+	switch {
+	case len(args) == 0:
+		m.messages = append(m.messages, "Notifications: "+notifyModeNames[m.notify])
+		return m
+	case len(args) > 1:
+		m.messages = append(m.messages, usage)
+		return m
+	}
+	switch args[0] {
+	case "on":
+		m.notify = m.notifyOn
+		if m.notify == notifyNone {
+			m.notify = notifyMention
+		}
+	case "off":
+		m.notify = notifyNone
+	default:
+		mode, err := parseNotifyMode(args[0])
+		if err != nil {
+			m.messages = append(m.messages, usage)
+			return m
+		}
+		m.notify = mode
+		if mode != notifyNone {
+			m.notifyOn = mode
+		}
+	}
+	m.messages = append(m.messages, "Notifications: "+notifyModeNames[m.notify])
+	return m
+}
+
+// wantsBell reports whether a displayed server line should ring the bell
+// under the model's notify mode.
+func (m model) wantsBell(line string) bool {
+	sender := senderOf(line)
+	if sender == "" || sender == m.username {
+		return false
+	}
+	// Everything after the sender's name, so their name can't match ours
+	text := line[strings.Index(line, sender)+len(sender):]
+	switch {
+	case strings.HasPrefix(line, "[PM from "):
+		return m.notify >= notifyPM
+	case m.username != "" && strings.Contains(text, m.username):
+		return m.notify >= notifyMention
+	}
+	return m.notify >= notifyAll
+}
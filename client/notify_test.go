@@ -0,0 +1,61 @@
+// notify_test.go
+package main
+
+import (
+	"strings"
+	"testing"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestNotifyRingsBell(t *testing.T) {
+	lines := []string{"[PM from bob] psst", "bob: over to you, alice", "bob: hello", "alice: hello bob"}
+	tests := []struct {
+		mode notifyMode
+		want []bool // whether each of lines rings
+	}{
+		{notifyNone, []bool{false, false, false, false}},
+		{notifyPM, []bool{true, false, false, false}},
+		{notifyMention, []bool{true, true, false, false}},
+		{notifyAll, []bool{true, true, true, false}},
+	}
+	for _, tt := range tests {
+		m, _ := loggedIn(t, "alice")
+		m.notify = tt.mode
+		for i, line := range lines {
+			m = receive(t, m, line)
+			if rang := strings.HasSuffix(m.View(), "\a"); rang != tt.want[i] {
+				t.Errorf("-notify %s, %q: bell %v, want %v", notifyModeNames[tt.mode], line, rang, tt.want[i])
+			}
+			if strings.Contains(update(t, m, tea.WindowSizeMsg{Width: 80, Height: 24}).View(), "\a") {
+				t.Errorf("-notify %s, %q: bell still in the view after the next update", notifyModeNames[tt.mode], line)
+			}
+		}
+	}
+}
+
+func TestNotifyCommand(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	steps := []struct {
+		command, reply string
+		rings          bool // whether a mention rings afterwards
+	}{
+		{"/notify", "Notifications: none", false},
+		{"/notify on", "Notifications: mention", true}, // the default when -notify was none
+		{"/notify pm", "Notifications: pm", false},
+		{"/notify off", "Notifications: none", false},
+		{"/notify on", "Notifications: pm", false}, // the last mode used
+		{"/notify all", "Notifications: all", true},
+		{"/notify loudly", "Usage: /notify on|off|pm|mention|all|none", true},
+	}
+	for _, step := range steps {
+		m = enter(t, m, step.command)
+		if got := m.messages[len(m.messages)-1]; got != step.reply {
+			t.Errorf("%q replied %q, want %q", step.command, got, step.reply)
+		}
+		m = receive(t, m, "bob: over to you, alice")
+		if rang := strings.HasSuffix(m.View(), "\a"); rang != step.rings {
+			t.Errorf("after %q a mention rang %v, want %v", step.command, rang, step.rings)
+		}
+	}
+}
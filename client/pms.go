@@ -0,0 +1,98 @@
+// pms.go
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Recent PMs are kept apart from the chat, so /pms can show them after
+// they've scrolled away or been buried by room messages. They're only kept
+// in memory, for this run of the client.
+
+// Limits on what /pms keeps and shows.
+const (
+	maxPMs       = 100 // PMs kept, oldest dropped first
+	pmsListed    = 20  // PMs listed by /pms on its own
+	pmSnippetLen = 40  // characters of each PM /pms shows
+)
+
+// pmSentPattern matches the server's copy of a PM we sent, e.g.
+// "[PM to bob (delivered)] hi".
+var pmSentPattern = regexp.MustCompile(`^\[PM to (\S+) \((?:delivered|queued)\)\] (.*)$`)
+
+// pm is one private message, sent or received.
+type pm struct {
+	at       time.Time
+	incoming bool
+	peer     string // who it's from, or to
+	body     string
+}
+
+// recordPM adds line to the recent PMs if it's one we received or sent.
+func (m model) recordPM(line string) model {
+	var p pm
+	if rest, ok := strings.CutPrefix(line, "[PM from "); ok {
+		peer, body, found := strings.Cut(rest, "] ")
+		if !found {
+			return m
+		}
+		p = pm{incoming: true, peer: peer, body: body}
+	} else if match := pmSentPattern.FindStringSubmatch(line); match != nil {
+		p = pm{peer: match[1], body: match[2]}
+	} else {
+		return m
+	}
+	p.at = time.Now()
+	m.pms = append(m.pms, p)
+	if len(m.pms) > maxPMs {
+		m.pms = m.pms[len(m.pms)-maxPMs:]
+	}
+	return m
+}
+
+// pmsCommand handles "/pms [username]": on its own it lists the latest PMs
+// cut short, and with a username it replays the whole conversation with
+// that user that's been kept.
+func (m model) pmsCommand(args []string) model {
+	if len(args) > 1 {
+		m.messages = append(m.messages, "Usage: /pms [username]")
+		return m
+	}
+	var shown []pm
+	for _, p := range m.pms {
+		if len(args) == 0 || p.peer == args[0] {
+			shown = append(shown, p)
+		}
+	}
+	if len(shown) == 0 {
+		if len(args) == 0 {
+			m.messages = append(m.messages, "No private messages yet.")
+		} else {
+			m.messages = append(m.messages, "No private messages with "+args[0]+".")
+		}
+		return m
+	}
+
+	if len(args) == 0 {
+		shown = shown[max(len(shown)-pmsListed, 0):]
+		m.messages = append(m.messages, "Recent private messages (/pms <username> for a whole conversation):")
+	} else {
+		m.messages = append(m.messages, "Private messages with "+args[0]+":")
+	}
+	for _, p := range shown {
+		body := p.body
+		if len(args) == 0 && utf8.RuneCountInString(body) > pmSnippetLen {
+			body = string([]rune(body)[:pmSnippetLen-1]) + "…"
+		}
+		direction := "to"
+		if p.incoming {
+			direction = "from"
+		}
+		m.messages = append(m.messages, fmt.Sprintf("  %s %s %s: %s", p.at.Format("15:04"), direction, p.peer, body))
+	}
+	return m
+}
@@ -0,0 +1,62 @@
+// pms_test.go
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPMsCommand(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	m = enter(t, m, "/pms")
+	if got := m.messages[len(m.messages)-1]; got != "No private messages yet." {
+		t.Errorf("/pms with none = %q", got)
+	}
+
+	long := strings.Repeat("la", 30)
+	m = receive(t, m,
+		"[PM from bob] are you around?",
+		"carol: room chatter",
+		"[PM to bob (delivered)] yes",
+		"[PM from carol] "+long,
+		"[PM to dave (queued)] later",
+	)
+	for i := range m.pms {
+		m.pms[i].at = time.Date(2026, 1, 2, 9, 30+i, 0, 0, time.Local)
+	}
+
+	m = enter(t, m, "/pms")
+	want := []string{
+		"Recent private messages (/pms <username> for a whole conversation):",
+		"  09:30 from bob: are you around?",
+		"  09:31 to bob: yes",
+		"  09:32 from carol: " + long[:pmSnippetLen-1] + "…",
+		"  09:33 to dave: later",
+	}
+	if got := m.messages[len(m.messages)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("/pms listed %q, want %q", got, want)
+	}
+
+	m = enter(t, m, "/pms carol")
+	want = []string{"Private messages with carol:", "  09:32 from carol: " + long}
+	if got := m.messages[len(m.messages)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("/pms carol replayed %q, want %q", got, want)
+	}
+	m = enter(t, m, "/pms erin")
+	if got := m.messages[len(m.messages)-1]; got != "No private messages with erin." {
+		t.Errorf("/pms erin = %q", got)
+	}
+
+	// It's all local: the next thing the server gets is chat
+	m = enter(t, m, "done")
+	select {
+	case line := <-s.lines:
+		if line != "done" {
+			t.Errorf("server got %q, want only the chat message", line)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("the chat message wasn't sent")
+	}
+}
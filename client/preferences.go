@@ -0,0 +1,44 @@
+// preferences.go
+package main
+
+// The server keeps preferences saved with "/set <name> <value>" and sends
+// them after every login (see preferenceLine), so settings follow the user
+// from one session or device to the next. These are the ones the client
+// restores; they override the matching flags. Other names are left for
+// other clients, and a cleared preference leaves the setting as it is.
+
+// applyPreference restores the saved preference name, if it's one of
+// ours: notify (as -notify), timestamps (as -timestamps) or ids (on or
+// off, as -message-ids).
+func (m model) applyPreference(name, value string) model {
+	if value == "" {
+		return m
+	}
+	valid := true
+	switch name {
+	case "notify":
+		mode, err := parseNotifyMode(value)
+		if valid = err == nil; valid {
+			m.notify = mode
+			if mode != notifyNone {
+				m.notifyOn = mode
+			}
+		}
+	case "timestamps":
+		mode, err := parseTimestampMode(value)
+		if valid = err == nil; valid {
+			m.timestamps = mode
+			if mode != timestampsOff {
+				m.timestampsOn = mode
+			}
+		}
+	case "ids":
+		if valid = value == "on" || value == "off"; valid {
+			m.showIDs = value == "on"
+		}
+	}
+	if !valid {
+		m.messages = append(m.messages, "Ignoring saved preference "+name+": "+value)
+	}
+	return m
+}
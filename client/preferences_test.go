@@ -0,0 +1,40 @@
+// preferences_test.go
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPreferencesRestored(t *testing.T) {
+	m, _ := newTestModel(t)
+	m.notify, m.timestamps = notifyAll, timestamps24h
+	m = receive(t, m,
+		"Welcome back, alice!",
+		"[pref] notify pm",
+		"[pref] timestamps 12h",
+		"[pref] ids on",
+		"[pref] theme solarized", // another client's
+		"[pref] timestamps",      // cleared, so left as it is
+	)
+	if m.notify != notifyPM || m.notifyOn != notifyPM || m.timestamps != timestamps12h || !m.showIDs {
+		t.Errorf("after the preferences: notify %v, timestamps %v, ids %v; want pm, 12h and on", m.notify, m.timestamps, m.showIDs)
+	}
+	for _, line := range m.messages {
+		if strings.HasPrefix(line, "[pref]") {
+			t.Errorf("preference line %q shown", line)
+		}
+	}
+
+	// /timestamps on brings back the saved format; a bad value is ignored
+	m = enter(t, m, "/timestamps off")
+	m = enter(t, m, "/timestamps on")
+	m = receive(t, m, "[pref] notify loudly")
+	if m.timestamps != timestamps12h || m.notify != notifyPM {
+		t.Errorf("timestamps %v and notify %v, want 12h and pm kept", m.timestamps, m.notify)
+	}
+	if !slices.Contains(m.messages, "Ignoring saved preference notify: loudly") {
+		t.Errorf("messages %q, want the bad preference reported", m.messages)
+	}
+}
@@ -0,0 +1,98 @@
+// profile.go
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A profiles file holds named sets of flag values, so a server's settings
+// don't have to be typed on every run:
+//
+//	[work]
+//	addr = chat.example.com:9000
+//	username = alice
+//	editmode = vim
+//
+// Keys are client flag names. -profile work applies them as if given on
+// the command line, except for flags that actually were given there.
+
+// defaultProfilesPath returns where profiles are read from without
+// -profiles, or "" if there's no user config directory.
+func defaultProfilesPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "secure-chat", "profiles")
+}
+
+// loadProfile reads the named profile from the file at path.
+func loadProfile(path, name string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		settings map[string]string
+		section  string
+		found    bool
+		lineNo   int
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == name {
+				found = true
+				settings = make(map[string]string)
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section == "" {
+			return nil, fmt.Errorf("%s:%d: expected [profile] or key = value", path, lineNo)
+		}
+		if section == name {
+			settings[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no profile named %q", path, name)
+	}
+	return settings, nil
+}
+
+// applyProfile sets the flags named in settings, leaving alone those given
+// on the command line.
+func applyProfile(settings map[string]string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for key, value := range settings {
+		if key == "profile" || key == "profiles" || flag.Lookup(key) == nil {
+			return fmt.Errorf("profile: unknown setting %q", key)
+		}
+		if explicit[key] {
+			continue
+		}
+		if err := flag.Set(key, value); err != nil {
+			return fmt.Errorf("profile: %s: %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+// reconnect.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// reconnectLogin selects what happens to credentials when reconnecting.
+type reconnectLogin int
+
+const (
+	reconnectPrompt reconnectLogin = iota // log in again by hand
+	reconnectReuse                        // replay this session's login, kept in memory only
+)
+
+// parseReconnectLogin parses the -reconnect-login flag.
+func parseReconnectLogin(name string) (reconnectLogin, error) {
+	switch name {
+	case "prompt":
+		return reconnectPrompt, nil
+	case "reuse":
+		return reconnectReuse, nil
+	}
+	return 0, fmt.Errorf("unknown reconnect login %q (want prompt or reuse)", name)
+}
+
+// credentials is a username and password typed at the login prompts, and
+// the answer to login or register, such as "login ephemeral", before them.
+type credentials struct {
+	choice, user, pass string
+}
+
+// After a server restart the client reconnects by itself once the announced
+// delay has passed, retrying a few times if the server isn't back yet.
+const (
+	restartRetries    = 5
+	restartRetryDelay = 2 * time.Second
+)
+
+// autoReconnectMsg fires when it's time to reconnect after a restart.
+type autoReconnectMsg struct{}
+
+func reconnectAfter(delay time.Duration) tea.Cmd {
+	return tea.Tick(delay, func(time.Time) tea.Msg { return autoReconnectMsg{} })
+}
+
+// reconnectedMsg reports the outcome of dialing the server again.
+type reconnectedMsg struct {
+	conn net.Conn
+	err  error
+}
+
+// maxServerLine is the longest line, in bytes, readServer takes from the
+// server. Long history and banner lines fit easily; anything bigger is
+// skipped rather than ending the session.
+const maxServerLine = 1 << 20
+
+// errLineTooLong reports a line over maxServerLine, which readLine discards.
+var errLineTooLong = errors.New("line too long")
+
+// skippedLineMsg reports that a line from the server was over maxServerLine
+// and wasn't shown.
+type skippedLineMsg struct{}
+
+// readServer delivers each line from conn via send, then reports why
+// reading stopped.
+func readServer(conn net.Conn, send func(tea.Msg)) {
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := readLine(reader, maxServerLine)
+		if errors.Is(err, errLineTooLong) {
+			send(skippedLineMsg{})
+			continue
+		}
+		if line != "" || err == nil {
+			send(serverLineMsg(line))
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			send(serverErrMsg{conn: conn, err: err})
+			return
+		}
+	}
+}
+
+// readLine reads a line from r and returns it without its newline. A line
+// over limit bytes is read to its end and dropped with errLineTooLong, so
+// the next call starts on the following line.
+func readLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(bytes.TrimSuffix(chunk, []byte("\n"))) > limit {
+			tooLong, line = true, nil
+		}
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case tooLong && err == nil:
+			return "", errLineTooLong
+		}
+		return strings.TrimSuffix(string(line), "\n"), err
+	}
+}
+
+// disconnected drops the broken connection and waits for the user to
+// reconnect or quit.
+func (m model) disconnected() (tea.Model, tea.Cmd) {
+	// Chat typed from now on is queued as whoever was logged in
+	if m.username != "" {
+		m.queuedAs = m.username
+	}
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	m.state = stateDisconnected
+	m.input, m.cursor = "", 0
+	m.online = make(map[string]bool)
+	m.awaitingRooms, m.inBanner, m.usernamePrompt = false, false, false
+	m.pending = credentials{}
+	m.restartIn = 0
+	m.commandPrefix = ""
+	m.banner, m.room, m.topic = nil, "", ""
+	// Learned again from the next welcome; until then nobody is logged in
+	m.username = ""
+	return m, nil
+}
+
+// restarting is disconnected for a connection the server closed after
+// announcing a restart: it reconnects by itself after the announced delay.
+func (m model) restarting() (tea.Model, tea.Cmd) {
+	delay := m.restartIn
+	m.autoRetries = restartRetries
+	m.messages = append(m.messages, fmt.Sprintf("Server is restarting; reconnecting in %s...", delay))
+	next, _ := m.disconnected()
+	return next, reconnectAfter(delay)
+}
+
+// updateDisconnected handles keys while disconnected: Enter dials the
+// server again, or queues what was typed (see queueTyped), and Ctrl+C
+// quits. Once someone has logged in, other keys edit the input line.
+func (m model) updateDisconnected(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch {
+	case msg.Type == tea.KeyCtrlC:
+		return m.quit()
+	case msg.Type == tea.KeyEnter && m.input != "":
+		return m.queueTyped(), nil
+	case msg.Type == tea.KeyEnter:
+		return m.dial()
+	case m.queuedAs != "":
+		m = m.editInput(msg)
+	}
+	return m, nil
+}
+
+// queueTyped handles Enter on input typed while disconnected. Chat is
+// queued, to be sent once we're logged in again as queuedAs; anything else
+// stays on the input line, since a command can't wait for a login.
+func (m model) queueTyped() model {
+	text, chat := m.asChat(m.input)
+	if !chat {
+		m.messages = append(m.messages, "Commands can't be queued; reconnect to send it.")
+		return m
+	}
+	m.queued = append(m.queued, m.input)
+	m.messages = append(m.messages, "You: "+text+" (queued)")
+	m.input, m.cursor = "", 0
+	return m
+}
+
+// dial connects to the server again in the background.
+func (m model) dial() (tea.Model, tea.Cmd) {
+	if m.dialing {
+		return m, nil
+	}
+	m.dialing = true
+	m.messages = append(m.messages, "Connecting to "+m.addr+"...")
+	addr, config := m.addr, m.tlsConfig
+	return m, func() tea.Msg {
+		conn, err := dialServer(addr, config)
+		return reconnectedMsg{conn: conn, err: err}
+	}
+}
+
+// connect handles /connect: it leaves the current server and dials addr,
+// where the login starts over. A saved login belongs to the old server, so
+// it's forgotten.
+func (m model) connect(addr string) (tea.Model, tea.Cmd) {
+	m.messages = append(m.messages, "Leaving "+m.addr+".")
+	if len(m.queued) > 0 {
+		m.messages = append(m.messages, fmt.Sprintf("Dropped %s meant for %s.", queuedCount(len(m.queued)), m.addr))
+		m.queued = nil
+	}
+	next, _ := m.disconnected()
+	nm := next.(model)
+	nm.addr = addr
+	nm.saved = credentials{}
+	nm.autoRetries = 0
+	return nm.dial()
+}
+
+// reconnected starts a new session on conn. With -reconnect-login=reuse and
+// a login from earlier in this run, it answers the login prompts itself.
+func (m model) reconnected(msg reconnectedMsg) (tea.Model, tea.Cmd) {
+	m.dialing = false
+	if msg.err != nil {
+		if m.autoRetries > 0 {
+			m.autoRetries--
+			m.messages = append(m.messages, fmt.Sprintf("Reconnect failed: %v; retrying in %s...", msg.err, restartRetryDelay))
+			return m, reconnectAfter(restartRetryDelay)
+		}
+		m.messages = append(m.messages, fmt.Sprintf("Reconnect failed: %v", msg.err))
+		return m, nil
+	}
+	m.autoRetries = 0
+	m.conn = msg.conn
+	m.state = stateLogin
+	m.listen(m.conn)
+
+	if m.reconnectLogin == reconnectReuse && m.saved.user != "" {
+		choice := m.saved.choice
+		if choice == "" {
+			choice = "login"
+		}
+		if _, err := fmt.Fprintf(m.conn, "%s\n%s\n%s\n", choice, m.saved.user, m.saved.pass); err != nil {
+			m.messages = append(m.messages, fmt.Sprintf("Connection lost: %v", err))
+			return m.disconnected()
+		}
+	}
+	return m, nil
+}
+
+// flushQueued sends the chat messages that failed to send before the
+// connection dropped, now that we're logged in again. If a send fails, it
+// stops there and the rest stay queued for the next login. Messages are
+// only sent as the user who wrote them; after a login as anyone else, or
+// one the welcome didn't name, they're dropped.
+func (m model) flushQueued() (tea.Model, tea.Cmd) {
+	total := len(m.queued)
+	if m.username != m.queuedAs {
+		m.messages = append(m.messages, fmt.Sprintf("Dropped %s written as %s, who isn't logged in now.", queuedCount(total), m.queuedAs))
+		m.queued = nil
+		return m, nil
+	}
+	m.messages = append(m.messages, fmt.Sprintf("Sending %s...", queuedCount(total)))
+	for i, line := range m.queued {
+		if _, err := fmt.Fprintln(m.conn, line); err != nil {
+			m.queued = m.queued[i:]
+			m.messages = append(m.messages, fmt.Sprintf("Sent %d of %d; %d still queued. Connection lost: %v", i, total, len(m.queued), err))
+			return m.disconnected()
+		}
+		text, _ := m.asChat(line)
+		m.messages = append(m.messages, "You: "+text)
+	}
+	m.queued = nil
+	m.messages = append(m.messages, fmt.Sprintf("Sent %s.", queuedCount(total)))
+	return m, nil
+}
+
+func queuedCount(n int) string {
+	if n == 1 {
+		return "1 queued message"
+	}
+	return fmt.Sprintf("%d queued messages", n)
+}
+
+// noteLogin remembers what the user types at the login prompts, for
+// -reconnect-login=reuse. Nothing is kept in prompt mode.
+func (m model) noteLogin(input string) model {
+	if m.reconnectLogin != reconnectReuse {
+		return m
+	}
+	switch {
+	case m.usernamePrompt:
+		m.pending = credentials{choice: m.pending.choice, user: input}
+	case m.state == stateLogin && strings.HasPrefix(strings.ToLower(strings.TrimSpace(input)), "login"):
+		// Kept so an ephemeral session comes back ephemeral
+		m.pending = credentials{choice: strings.TrimSpace(input)}
+	case m.state == statePassword && m.pending.user != "":
+		m.pending.pass = input
+	}
+	return m
+}
@@ -0,0 +1,216 @@
+// reconnect_test.go
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func TestRestartReconnects(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	m, _ := loggedIn(t, "alice")
+	m.addr = ln.Addr().String()
+
+	m = receive(t, m, "Server restarting. Reconnect in ~1s.", "[restart] 1")
+	next, wait := m.Update(serverErrMsg{conn: m.conn})
+	m = next.(model)
+	if m.state != stateDisconnected || wait == nil {
+		t.Fatalf("after the restart: state %v, want disconnected and waiting to reconnect", m.state)
+	}
+
+	start := time.Now()
+	msg := wait()
+	if waited := time.Since(start); waited < 900*time.Millisecond {
+		t.Errorf("reconnected after %s, want the announced second", waited)
+	}
+	next, dial := m.Update(msg)
+	m = next.(model)
+	if dial == nil {
+		t.Fatal("no dial after the delay")
+	}
+	m = update(t, m, dial())
+	if m.state != stateLogin || m.conn == nil {
+		t.Fatalf("after reconnecting: state %v, conn %v; want a new login", m.state, m.conn)
+	}
+	m.conn.Close()
+}
+
+func TestConnectSwitchesServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	m, old := loggedIn(t, "alice")
+	m.addr = "old.example:9000"
+	m.saved = credentials{user: "alice", pass: "secret"}
+
+	next, dial := typeText(t, m, "/connect "+ln.Addr().String()).Update(tea.KeyMsg{Type: tea.KeyEnter})
+	m = next.(model)
+	if dial == nil || m.addr != ln.Addr().String() || m.saved.user != "" {
+		t.Fatalf("after /connect: addr %q, saved login %q; want the new address, the login forgotten and a dial", m.addr, m.saved.user)
+	}
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-old.lines:
+			closed = !ok
+		case <-time.After(testTimeout):
+			t.Fatal("/connect left the old connection open")
+		}
+	}
+
+	m = update(t, m, dial())
+	if m.state != stateLogin || m.conn == nil {
+		t.Fatalf("after connecting: state %v, conn %v; want a new login", m.state, m.conn)
+	}
+	defer m.conn.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	m = receive(t, m, "Enter 'login' or 'register': ")
+	want := []string{"Leaving old.example:9000.", "Connecting to " + ln.Addr().String() + "...", "Enter 'login' or 'register':"}
+	if got := m.messages[len(m.messages)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("messages end %q, want %q", got, want)
+	}
+}
+
+func TestQueuedMessagesFlush(t *testing.T) {
+	m, s := loggedIn(t, "alice")
+	s.conn.Close()
+	m = enter(t, m, "one")
+	if m.messages[len(m.messages)-2] != "✗ You: one (queued)" {
+		t.Fatalf("messages %q, want the message queued", m.messages)
+	}
+
+	// The connection drops again before the flush gets anywhere
+	conn, s := pipe(t)
+	m = update(t, m, reconnectedMsg{conn: conn})
+	s.conn.Close()
+	m = receive(t, m, "Welcome back, alice!")
+	if got := m.messages[len(m.messages)-1]; !strings.HasPrefix(got, "Sent 0 of 1; 1 still queued. Connection lost: ") {
+		t.Errorf("messages %q, want the failed flush reported", m.messages)
+	}
+	if m.state != stateDisconnected || !slices.Equal(m.queued, []string{"one"}) {
+		t.Fatalf("state %v, queued %q; want disconnected with the message still queued", m.state, m.queued)
+	}
+
+	conn, s = pipe(t)
+	m = update(t, m, reconnectedMsg{conn: conn})
+	m = receive(t, m, "Welcome back, alice!")
+	s.expect("/who")
+	s.expect("one")
+	want := []string{"Welcome back, alice!", "Sending 1 queued message...", "You: one", "Sent 1 queued message."}
+	if !slices.Equal(m.messages, want) || m.queued != nil {
+		t.Errorf("messages %q, queued %q; want %q and the queue empty", m.messages, m.queued, want)
+	}
+
+	// Logged in as someone else, the queue is dropped rather than sent
+	s.conn.Close()
+	m = enter(t, m, "two")
+	conn, s = pipe(t)
+	m = update(t, m, reconnectedMsg{conn: conn})
+	m = receive(t, m, "Welcome back, bob!")
+	s.expect("/who")
+	want = []string{"Welcome back, bob!", "Dropped 1 queued message written as alice, who isn't logged in now."}
+	if !slices.Equal(m.messages, want) || m.queued != nil {
+		t.Errorf("messages %q, queued %q; want %q and the queue empty", m.messages, m.queued, want)
+	}
+	select {
+	case line := <-s.lines:
+		t.Errorf("sent %q as bob", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTypedWhileDisconnected(t *testing.T) {
+	m, _ := loggedIn(t, "alice")
+	m = update(t, m, serverErrMsg{conn: m.conn})
+	if m.state != stateDisconnected {
+		t.Fatalf("state %v, want stateDisconnected", m.state)
+	}
+	m = enter(t, m, "one")
+	m = enter(t, m, "/who")
+	if got := m.messages[len(m.messages)-2:]; got[0] != "You: one (queued)" || got[1] != "Commands can't be queued; reconnect to send it." {
+		t.Errorf("messages end %q, want the chat queued and the command refused", got)
+	}
+	if !slices.Equal(m.queued, []string{"one"}) || m.input != "/who" {
+		t.Fatalf("queued %q, input %q; want the chat queued and the command kept", m.queued, m.input)
+	}
+	if view := m.View(); !strings.Contains(view, "queued until you're back as alice") || !strings.Contains(view, "> /who") {
+		t.Errorf("View() = %q, want the queue noted and the input shown", view)
+	}
+
+	// Once logged in again as alice, the queue is sent
+	conn, s := pipe(t)
+	m = update(t, m, reconnectedMsg{conn: conn})
+	m = receive(t, m, "Welcome back, alice!")
+	s.expect("/who")
+	s.expect("one")
+	if m.queued != nil {
+		t.Errorf("queued %q after the flush, want none", m.queued)
+	}
+
+	// Logged in as someone else, the queue is dropped rather than sent
+	m = update(t, m, serverErrMsg{conn: m.conn})
+	m = enter(t, m, "two")
+	conn, s = pipe(t)
+	m = update(t, m, reconnectedMsg{conn: conn})
+	m = receive(t, m, "Welcome back, bob!")
+	s.expect("/who")
+	want := []string{"Welcome back, bob!", "Dropped 1 queued message written as alice, who isn't logged in now."}
+	if !slices.Equal(m.messages, want) || m.queued != nil {
+		t.Errorf("messages %q, queued %q; want %q and the queue empty", m.messages, m.queued, want)
+	}
+	select {
+	case line := <-s.lines:
+		t.Errorf("sent %q as bob", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestLongServerLines(t *testing.T) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	long := strings.Repeat("a", 200<<10)
+	go func() {
+		defer server.Close()
+		for _, line := range []string{long + "\n", strings.Repeat("b", 2*maxServerLine) + "\n", strings.Repeat("c", maxServerLine) + "\n", "after\n", "unterminated"} {
+			server.Write([]byte(line))
+		}
+	}()
+
+	msgs := make(chan tea.Msg, 10)
+	go readServer(client, func(msg tea.Msg) { msgs <- msg })
+	want := []tea.Msg{serverLineMsg(long), skippedLineMsg{}, serverLineMsg(strings.Repeat("c", maxServerLine)), serverLineMsg("after"), serverLineMsg("unterminated"), serverErrMsg{conn: client}}
+	for i, w := range want {
+		select {
+		case got := <-msgs:
+			if got != w {
+				g, _ := got.(serverLineMsg)
+				t.Errorf("message %d = %T (%d bytes), want %T", i, got, len(g), w)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for message %d, %T", i, w)
+		}
+	}
+
+	// The model carries on past a skipped line
+	m, _ := loggedIn(t, "alice")
+	m = update(t, m, skippedLineMsg{})
+	m = receive(t, m, "bob: still here")
+	if !slices.Contains(m.messages, "Skipped a line from the server over 1024 KB.") || m.state != stateChat {
+		t.Errorf("after a skipped line: state %v, messages %q", m.state, m.messages)
+	}
+}
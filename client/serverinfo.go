@@ -0,0 +1,67 @@
+// serverinfo.go
+package main
+
+import (
+	"crypto/tls"
+	"regexp"
+	"strings"
+)
+
+// /server sums up what the client has learned about the server it's on:
+// where it is, how the connection is protected, its command prefix and
+// banner, and the room we're in with its topic. The server announces no
+// version, so none is shown. Everything is gathered from the lines the
+// server sends anyway, and forgotten on disconnect.
+
+// topicSetPattern matches the server's line for a new topic, e.g. "alice set
+// the topic of #general: Welcome!". The name can't contain a colon, so a chat
+// message ("alice: ...") can't pass for one.
+var topicSetPattern = regexp.MustCompile(`^[^\s:]+ set the topic of (#\S+): (.*)$`)
+
+// trackServerInfo notes the room and topic from a server line.
+func (m model) trackServerInfo(line string) model {
+	if rest, ok := strings.CutPrefix(line, "--- now live in "); ok {
+		m.room, m.topic = strings.TrimSuffix(rest, " ---"), ""
+	} else if rest, ok := strings.CutPrefix(line, "You joined "); ok {
+		m.room, m.topic = strings.TrimSuffix(rest, "."), ""
+	} else if rest, ok := strings.CutPrefix(line, "Topic of "); ok {
+		if room, topic, found := strings.Cut(rest, ": "); found && room == m.room {
+			m.topic = topic
+		}
+	} else if match := topicSetPattern.FindStringSubmatch(line); match != nil && match[1] == m.room {
+		m.topic = match[2]
+	}
+	return m
+}
+
+// serverInfo handles /server, showing what we know about the server.
+func (m model) serverInfo() model {
+	connection := "unencrypted TCP"
+	if conn, ok := m.conn.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		connection = tls.VersionName(state.Version) + ", " + tls.CipherSuiteName(state.CipherSuite)
+	}
+	room, topic := m.room, m.topic
+	if room == "" {
+		room = "(not logged in)"
+	}
+	if topic == "" {
+		topic = "(none)"
+	}
+	m.messages = append(m.messages,
+		"Server: "+m.addr,
+		"  Connection: "+connection,
+		"  Commands start with: "+m.serverCommand(""),
+		"  Room: "+room,
+		"  Topic: "+topic,
+	)
+	if len(m.banner) == 0 {
+		m.messages = append(m.messages, "  Banner: (none)")
+		return m
+	}
+	m.messages = append(m.messages, "  Banner:")
+	for _, line := range m.banner {
+		m.messages = append(m.messages, "    "+line)
+	}
+	return m
+}
@@ -0,0 +1,50 @@
+// serverinfo_test.go
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestServerInfo(t *testing.T) {
+	m, _ := newTestModel(t)
+	m.addr = "chat.example:9000"
+	m = enter(t, m, "/server")
+	want := []string{
+		"Server: chat.example:9000",
+		"  Connection: unencrypted TCP",
+		"  Commands start with: /",
+		"  Room: (not logged in)",
+		"  Topic: (none)",
+		"  Banner: (none)",
+	}
+	if got := m.messages[len(m.messages)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("/server before logging in = %q, want %q", got, want)
+	}
+
+	m = receive(t, m,
+		"[banner]", "Friendly Chat", "Be nice.", "[/banner]",
+		"[commands] !",
+		"Welcome back, alice!",
+		"--- now live in #general ---",
+		"Topic of #general: Hello",
+		"You joined #dev.",
+		"bob: #dev topic changes are announced like this:",
+		"bob set the topic of #dev: Builds",
+		"carol set the topic of #ops: not ours",
+	)
+	m = enter(t, m, "!server")
+	want = []string{
+		"Server: chat.example:9000",
+		"  Connection: unencrypted TCP",
+		"  Commands start with: !",
+		"  Room: #dev",
+		"  Topic: Builds",
+		"  Banner:",
+		"    Friendly Chat",
+		"    Be nice.",
+	}
+	if got := m.messages[len(m.messages)-len(want):]; !slices.Equal(got, want) {
+		t.Errorf("/server after logging in = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+// tls_test.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenTLS listens on a loopback port with a new self-signed certificate
+// for 127.0.0.1, serving connections until t ends. It returns the
+// listener and a PEM file of the certificate, for loadTLSConfig.
+func listenTLS(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("Welcome to the secure chat server!\n"))
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return ln, caFile
+}
+
+func TestTLSConnection(t *testing.T) {
+	ln, caFile := listenTLS(t)
+	config, err := loadTLSConfig(caFile)
+	if err != nil {
+		t.Fatalf("loadTLSConfig: %v", err)
+	}
+	conn, err := dialServer(ln.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("dialServer over TLS: %v", err)
+	}
+	defer conn.Close()
+	m, _ := newTestModel(t)
+	m.conn = conn
+	if view := m.View(); !strings.Contains(view, "[TLS] Type /exit to quit.") {
+		t.Errorf("view over TLS:\n%s\nwant [TLS]", view)
+	}
+
+	// Without the CA the certificate isn't trusted
+	if conn, err := dialServer(ln.Addr().String(), &tls.Config{MinVersion: tls.VersionTLS12}); err == nil {
+		conn.Close()
+		t.Error("dialServer trusted a self-signed certificate")
+	}
+	if _, err := loadTLSConfig(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Error("loadTLSConfig with a missing CA file succeeded")
+	}
+
+	m, _ = newTestModel(t)
+	if view := m.View(); !strings.Contains(view, "[unencrypted] Type /exit to quit.") {
+		t.Errorf("view over a plain connection:\n%s\nwant [unencrypted]", view)
+	}
+}
@@ -0,0 +1,63 @@
+// auth.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// errInvalidCredentials is returned by an Authenticator when the username or
+// secret is wrong. Any other error means authentication itself failed.
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// Account is an authenticated user.
+type Account struct {
+	Username string
+	Admin    bool
+	Pending  bool // registered but not yet approved (see Config.RequireApproval)
+}
+
+// Authenticator verifies login credentials. The default checks the local
+// user database; deployments can supply their own to authenticate against
+// LDAP, exchange an OAuth/OIDC token, and so on.
+type Authenticator interface {
+	// Authenticate checks the secret (password or token) supplied for
+	// username and returns the account, or errInvalidCredentials.
+	Authenticate(username, secret string) (Account, error)
+}
+
+// AuthenticatorFunc adapts an ordinary function to the Authenticator
+// interface, which is handy for small integrations and stubs.
+type AuthenticatorFunc func(username, secret string) (Account, error)
+
+// Authenticate calls f(username, secret).
+func (f AuthenticatorFunc) Authenticate(username, secret string) (Account, error) {
+	return f(username, secret)
+}
+
+// localAuthenticator checks passwords against the users table.
+type localAuthenticator struct {
+	db        *sql.DB
+	dummyHash string // made at the configured cost, for usernames that don't exist
+}
+
+func (a localAuthenticator) Authenticate(username, password string) (Account, error) {
+	var storedPassword string
+	var admin, approved bool
+	row := a.db.QueryRow("SELECT password, admin, approved FROM users WHERE username = ?", username)
+	err := row.Scan(&storedPassword, &admin, &approved)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Hash anyway, so how long a failed login takes doesn't tell an
+		// unknown username from a wrong password
+		checkPassword(a.dummyHash, password)
+		return Account{}, errInvalidCredentials
+	}
+	if err != nil {
+		return Account{}, err
+	}
+
+	if !checkPassword(storedPassword, password) {
+		return Account{}, errInvalidCredentials
+	}
+	return Account{Username: username, Admin: admin, Pending: !approved}, nil
+}
@@ -0,0 +1,141 @@
+// edits.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Edits and deletes: "/edit <id> <text>" replaces one of your messages in
+// your room and "/delete <id>" removes it, within EditWindow of sending it;
+// "last" stands for your latest message there. The room's creator and
+// moderators, and admins, can delete anyone's message at any time. Only
+// messages kept in history have IDs (see messageIDPrefix).
+//
+// The stored message is changed, so history replayed to later joiners
+// shows the final text, marked as edited, and leaves deleted messages out.
+// Members already in the room are sent editPrefix and deletePrefix lines
+// to update what they show. A deleted message is kept out of history and
+// exports but not erased, so a report about it can still be reviewed.
+
+// Lines telling clients about a changed message, followed by its ID:
+// "[edit 42] alice: fixed (edited)" and "[delete 42]".
+const (
+	editPrefix   = "[edit "
+	deletePrefix = "[delete "
+)
+
+// editedMarker ends the line of a message that has been edited.
+const editedMarker = " (edited)"
+
+// storedMessage is a room message as kept in the messages table.
+type storedMessage struct {
+	id        int64
+	username  string
+	encrypted bool
+	sentAt    time.Time
+}
+
+// findMessage looks up the message idText names in room, for client: an ID,
+// or "last" for client's latest message there. Deleted messages aren't
+// found. ok is false if client has been told why there's none.
+func (s *Server) findMessage(client *Client, room, idText, usage string) (msg storedMessage, ok bool) {
+	var row *sql.Row
+	if idText == "last" {
+		row = s.db.QueryRow("SELECT id, username, encrypted, sent_at FROM messages WHERE room = ? AND username = ? AND deleted = 0 ORDER BY id DESC LIMIT 1",
+			room, client.username)
+	} else if id, err := strconv.ParseInt(idText, 10, 64); err == nil && id > 0 {
+		row = s.db.QueryRow("SELECT id, username, encrypted, sent_at FROM messages WHERE id = ? AND room = ? AND deleted = 0", id, room)
+	} else {
+		client.println(usage)
+		return msg, false
+	}
+
+	err := row.Scan(&msg.id, &msg.username, &msg.encrypted, &msg.sentAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && idText == "last":
+		client.printf("You have no messages kept in %s.\n", room)
+		return msg, false
+	case errors.Is(err, sql.ErrNoRows):
+		client.printf("No message %s in %s.\n", idText, room)
+		return msg, false
+	case err != nil:
+		log.Printf("[%s] Failed to look up message %s in %s: %v", client.id, idText, room, err)
+		client.println("Failed to find the message. Please try again.")
+		return msg, false
+	}
+	return msg, true
+}
+
+// ownRecent reports whether client may still change msg as its sender,
+// telling client why not otherwise.
+func (s *Server) ownRecent(client *Client, msg storedMessage, verb string) bool {
+	switch {
+	case msg.username != client.username:
+		client.printf("You can only %s your own messages.\n", verb)
+		return false
+	case s.config.EditWindow <= 0:
+		client.printf("Users can't %s their messages on this server.\n", verb)
+		return false
+	case time.Since(msg.sentAt) > s.config.EditWindow:
+		client.printf("Message %d is too old to %s (the limit is %s).\n", msg.id, verb, s.config.EditWindow)
+		return false
+	}
+	return true
+}
+
+// editMessage handles "/edit <id|last> <text>".
+func (s *Server) editMessage(client *Client, idText, text string) {
+	room := s.currentRoom(client)
+	msg, ok := s.findMessage(client, room, idText, "Usage: /edit <message id|last> <new text>")
+	if !ok || !s.ownRecent(client, msg, "edit") {
+		return
+	}
+	body := text
+	if msg.encrypted {
+		body = s.sealBody(room, text)
+	}
+	if _, err := s.db.Exec("UPDATE messages SET body = ?, edited = 1 WHERE id = ?", body, msg.id); err != nil {
+		log.Printf("[%s] Failed to edit message %d: %v", client.id, msg.id, err)
+		client.println("Failed to edit the message. Please try again.")
+		return
+	}
+	log.Printf("[%s] %s edited message %d in %s", client.id, client.username, msg.id, room)
+
+	line := s.formatMessage(msg.sentAt, room, client.username, text) + editedMarker
+	s.broadcastRoom(room, editPrefix+strconv.FormatInt(msg.id, 10)+"] "+line, client)
+	client.printf("Edited message %d.\n", msg.id)
+}
+
+// deleteMessage handles "/delete <id|last>".
+func (s *Server) deleteMessage(client *Client, idText string) {
+	room := s.currentRoom(client)
+	msg, ok := s.findMessage(client, room, idText, "Usage: /delete <message id|last>")
+	if !ok {
+		return
+	}
+	s.roomsMutex.Lock()
+	r := s.rooms[room]
+	moderator := r != nil && s.canModerate(client, r)
+	s.roomsMutex.Unlock()
+	if !moderator && !s.ownRecent(client, msg, "delete") {
+		return
+	}
+	if _, err := s.db.Exec("UPDATE messages SET deleted = 1 WHERE id = ?", msg.id); err != nil {
+		log.Printf("[%s] Failed to delete message %d: %v", client.id, msg.id, err)
+		client.println("Failed to delete the message. Please try again.")
+		return
+	}
+	log.Printf("[%s] %s deleted message %d in %s, from %s", client.id, client.username, msg.id, room, msg.username)
+
+	// Whoever saw the message is told, even if they've blocked the deleter
+	line := deletePrefix + strconv.FormatInt(msg.id, 10) + "]"
+	keep := func(other *Client) bool { return other != client && other.room == room }
+	for _, other := range s.recipients(keep) {
+		s.deliver(other, line)
+	}
+	client.printf("Deleted message %d.\n", msg.id)
+}
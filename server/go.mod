@@ -2,4 +2,7 @@ module cachevalley.co/chat/server
 
 go 1.23.4
 
-require github.com/xeodou/go-sqlcipher v0.0.0-20200727080346-d681773ef093
+require (
+	github.com/xeodou/go-sqlcipher v0.0.0-20200727080346-d681773ef093
+	golang.org/x/crypto v0.31.0
+)
@@ -0,0 +1,156 @@
+// groups.go
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Groups are named sets of users, such as "staff", that admins manage with
+// /group. /msggroup sends a message to the group's members who are online,
+// whatever room they're in. Memberships are stored in the user_groups table.
+
+// groupNamePattern restricts group names to a short slug.
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// groupNameReserved reports whether members would see lines from the
+// group, "[name] sender: text", as one the client acts on itself, such as
+// a markdownPrefix line.
+func groupNameReserved(name string) bool {
+	tag := "[" + strings.ToLower(name) + "] "
+	return slices.Contains([]string{markdownPrefix, restartPrefix, commandPrefixLine, preferenceLine}, tag)
+}
+
+// groupCommand handles "/group add|remove <group> <username>" and
+// "/group list [group]", and returns the reply for whoever issued it.
+func (s *Server) groupCommand(args []string) string {
+	const usage = "Usage: /group add|remove <group> <username>, or /group list [group]"
+	if len(args) == 0 {
+		return usage
+	}
+	switch {
+	case args[0] == "list" && len(args) == 1:
+		return s.listGroups()
+	case args[0] == "list" && len(args) == 2:
+		members, err := s.groupMembers(args[1])
+		if err != nil {
+			log.Printf("Failed to list group %s: %v", args[1], err)
+			return "Failed to list the group."
+		}
+		if len(members) == 0 {
+			return "Group " + args[1] + " has no members."
+		}
+		names := make([]string, 0, len(members))
+		for name := range members {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "Members of " + args[1] + ": " + strings.Join(names, ", ")
+	case (args[0] == "add" || args[0] == "remove") && len(args) == 3:
+	default:
+		return usage
+	}
+
+	group, username := args[1], args[2]
+	if !groupNamePattern.MatchString(group) {
+		return "Invalid group name. Use up to 32 letters, digits, '-' or '_'."
+	}
+	if groupNameReserved(group) {
+		return "The group name " + group + " is reserved."
+	}
+	if args[0] == "remove" {
+		res, err := s.db.Exec("DELETE FROM user_groups WHERE name = ? AND username = ?", group, username)
+		if err != nil {
+			log.Printf("Failed to remove %s from group %s: %v", username, group, err)
+			return "Failed to update the group."
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return username + " isn't in " + group + "."
+		}
+		log.Printf("Removed %s from group %s", username, group)
+		return "Removed " + username + " from " + group + "."
+	}
+
+	if !s.userExists(username) {
+		return "No such user " + username + "."
+	}
+	if _, err := s.db.Exec("INSERT OR IGNORE INTO user_groups (name, username) VALUES (?, ?)", group, username); err != nil {
+		log.Printf("Failed to add %s to group %s: %v", username, group, err)
+		return "Failed to update the group."
+	}
+	log.Printf("Added %s to group %s", username, group)
+	return "Added " + username + " to " + group + "."
+}
+
+// listGroups returns every group with its member count, on one line.
+func (s *Server) listGroups() string {
+	rows, err := s.db.Query("SELECT name, COUNT(*) FROM user_groups GROUP BY name ORDER BY name")
+	if err != nil {
+		log.Printf("Failed to list groups: %v", err)
+		return "Failed to list groups."
+	}
+	defer rows.Close()
+	var entries []string
+	for rows.Next() {
+		var name string
+		var members int
+		if err := rows.Scan(&name, &members); err != nil {
+			log.Printf("Failed to list groups: %v", err)
+			return "Failed to list groups."
+		}
+		entries = append(entries, fmt.Sprintf("%s (%d)", name, members))
+	}
+	if len(entries) == 0 {
+		return "There are no groups."
+	}
+	return "Groups: " + strings.Join(entries, ", ")
+}
+
+// groupMembers returns the usernames in group.
+func (s *Server) groupMembers(group string) (map[string]bool, error) {
+	rows, err := s.db.Query("SELECT username FROM user_groups WHERE name = ?", group)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		members[name] = true
+	}
+	return members, rows.Err()
+}
+
+// sendGroup handles /msggroup: it delivers body to every online session of
+// the group's members, other than the sender's own and those of members who
+// have blocked the sender. Only admins and members may message a group.
+func (s *Server) sendGroup(from *Client, group, body string) {
+	members, err := s.groupMembers(group)
+	if err != nil {
+		log.Printf("Failed to load group %s: %v", group, err)
+		from.println("Failed to send to the group.")
+		return
+	}
+	if !members[from.username] && !s.isAdmin(from) {
+		from.printf("Only admins and members of %s can message it.\n", group)
+		return
+	}
+
+	s.logMessage(from, "group "+group, body)
+	keep := func(client *Client) bool {
+		return members[client.username] && client != from && !s.blocks[client.username][from.username]
+	}
+	recipients := s.recipients(keep)
+	line := fmt.Sprintf("[%s] %s: %s", group, from.username, body)
+	for _, client := range recipients {
+		s.deliver(client, line)
+	}
+	from.printf("[to %s (%d online)] %s\n", group, len(recipients), body)
+}
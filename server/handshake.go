@@ -0,0 +1,142 @@
+// handshake.go
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+// errHandshakeBudget means a connection used up its pre-auth allowance.
+var errHandshakeBudget = errors.New("pre-auth budget exhausted")
+
+// handshakeReader reads the lines of the pre-auth handshake (choice,
+// registration code, username, password), charging each against an overall
+// byte and line budget so a connection can't stay unauthenticated forever
+// by sending endless invalid input.
+type handshakeReader struct {
+	r     *bufio.Reader
+	bytes int // bytes left
+	lines int // lines left
+}
+
+// newHandshakeReader returns a handshakeReader with the configured budget;
+// a budget of 0 or less is unlimited.
+func (s *Server) newHandshakeReader(r *bufio.Reader) *handshakeReader {
+	h := &handshakeReader{r: r, bytes: s.config.HandshakeBytes, lines: s.config.HandshakeLines}
+	if h.bytes <= 0 {
+		h.bytes = math.MaxInt
+	}
+	if h.lines <= 0 {
+		h.lines = math.MaxInt
+	}
+	return h
+}
+
+// readLine returns the next line without its newline, or errHandshakeBudget
+// once the line or byte budget runs out.
+func (h *handshakeReader) readLine() (string, error) {
+	if h.lines <= 0 {
+		return "", errHandshakeBudget
+	}
+	h.lines--
+	var line []byte
+	for {
+		if h.bytes <= 0 {
+			return "", errHandshakeBudget
+		}
+		b, err := h.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		h.bytes--
+		if b == '\n' {
+			return string(line), nil
+		}
+		line = append(line, b)
+	}
+}
+
+// handshakeFailed handles an error from readLine: a spent budget or the
+// handshake timeout is reported to the client before it's disconnected,
+// anything else is just logged.
+func handshakeFailed(conn net.Conn, logger *log.Logger, what string, err error) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errHandshakeBudget):
+		logger.Printf("Closing: pre-auth budget exhausted while reading %s", what)
+		fmt.Fprintln(conn, "Too many invalid attempts. Closing connection.")
+	case errors.As(err, &netErr) && netErr.Timeout():
+		logger.Printf("Closing: handshake timed out while reading %s", what)
+		fmt.Fprintln(conn, "Took too long to log in. Closing connection.")
+	default:
+		logger.Printf("Error reading %s: %v", what, err)
+	}
+}
+
+// waitToGreet waits out GreetDelay before the banner, watching the
+// connection meanwhile. Real clients wait to be greeted, so one that sends
+// anything first is taken for a scanner or bot: it's told why and false is
+// returned, as it is if the connection fails.
+func (s *Server) waitToGreet(conn net.Conn, r *bufio.Reader, logger *log.Logger) bool {
+	if s.config.GreetDelay <= 0 {
+		return true
+	}
+	conn.SetReadDeadline(time.Now().Add(s.config.GreetDelay))
+	_, err := r.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	switch {
+	case err == nil:
+		logger.Println("Closing: sent data before the greeting")
+		fmt.Fprintln(conn, "Please wait for the greeting before sending. Closing connection.")
+		return false
+	case !errors.Is(err, os.ErrDeadlineExceeded):
+		logger.Printf("Error before the greeting: %v", err)
+		return false
+	}
+	return true
+}
+
+// connectionThrottled reports whether the IP of addr has abandoned
+// AbandonLimit connections within AbandonWindow: connected, then left before
+// choosing to log in or register, as scanners do. Refused connections don't
+// count, so the IP is let back in once its earlier ones leave the window.
+func (s *Server) connectionThrottled(addr net.Addr) bool {
+	if s.config.AbandonLimit <= 0 {
+		return false
+	}
+	ip := addrIP(addr)
+
+	s.attemptsMutex.Lock()
+	defer s.attemptsMutex.Unlock()
+	recent := s.abandoned[ip][:0]
+	for _, at := range s.abandoned[ip] {
+		if time.Since(at) < s.config.AbandonWindow {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) == 0 {
+		delete(s.abandoned, ip)
+		return false
+	}
+	s.abandoned[ip] = recent
+	return len(recent) >= s.config.AbandonLimit
+}
+
+// connectionAbandoned records that a connection from addr ended before it
+// chose to log in or register, for connectionThrottled.
+func (s *Server) connectionAbandoned(addr net.Addr) {
+	if s.config.AbandonLimit <= 0 {
+		return
+	}
+	ip := addrIP(addr)
+	s.attemptsMutex.Lock()
+	s.abandoned[ip] = append(s.abandoned[ip], time.Now())
+	sweepAttempts(s.abandoned, s.config.AbandonWindow)
+	s.attemptsMutex.Unlock()
+}
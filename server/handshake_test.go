@@ -0,0 +1,98 @@
+// handshake_test.go
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeBudget(t *testing.T) {
+	s := newTestServer(t, Config{HandshakeLines: 3})
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	for range 3 {
+		c.send("nope")
+		c.expect("Invalid choice")
+	}
+	// The budget is spent before a fourth line is read
+	if got := c.expectClosed(); len(got) == 0 || got[len(got)-1] != "Too many invalid attempts. Closing connection." {
+		t.Errorf("last lines %q, want the budget spent", got)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	s := newTestServer(t, Config{HandshakeTime: 300 * time.Millisecond})
+	alice := register(t, s)
+
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("login")
+	c.expect("Username:")
+	if got := c.expectClosed(); len(got) == 0 || got[len(got)-1] != "Took too long to log in. Closing connection." {
+		t.Errorf("last lines %q, want the handshake timed out", got)
+	}
+
+	// Once logged in, the deadline is gone
+	a := login(t, s, alice)
+	time.Sleep(500 * time.Millisecond)
+	a.send("/whoami")
+	if line := a.expect("Username: "); !strings.HasSuffix(line, alice) {
+		t.Errorf("/whoami = %q", line)
+	}
+}
+
+func TestChoiceTries(t *testing.T) {
+	s := newTestServer(t, Config{ChoiceTries: 2})
+	alice := register(t, s)
+
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("lgoin")
+	c.expect("Invalid choice (attempts left: 1). Enter 'login' or 'register':")
+	c.send("login")
+	c.expect("Username:")
+	c.send(alice)
+	c.expect("Password")
+	c.send(testPassword)
+	c.expect("--- now live in ")
+
+	c = s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("lgoin")
+	c.expect("attempts left: 1")
+	c.send("regsiter")
+	if got := c.expectClosed(); len(got) == 0 || got[len(got)-1] != "Invalid choice. Closing connection." {
+		t.Errorf("last lines %q, want the connection closed after two tries", got)
+	}
+}
+
+func TestGreetDelay(t *testing.T) {
+	s := newTestServer(t, Config{GreetDelay: 100 * time.Millisecond, AbandonLimit: 2, AbandonWindow: time.Minute})
+
+	// Talking before the greeting gets the connection dropped, unwelcomed
+	c := s.dial(t)
+	c.send("login")
+	if got := c.expectClosed(); !slices.Equal(got, []string{"Please wait for the greeting before sending. Closing connection."}) {
+		t.Errorf("early talker got %q, want only to be told why it's closed", got)
+	}
+
+	// Waiting is rewarded, after the delay; leaving without a choice counts
+	// as abandoned too
+	start := time.Now()
+	c = s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Errorf("greeted after %s, want at least 100ms", waited)
+	}
+	c.conn.Close()
+
+	waitFor(t, "the throttle", func() bool {
+		return s.connectionThrottled(pipeAddr{})
+	})
+	c = s.dial(t)
+	if got := c.expectClosed(); !slices.Equal(got, []string{"Too many connections from your address. Please try again later."}) {
+		t.Errorf("after two abandoned connections got %q, want to be refused", got)
+	}
+}
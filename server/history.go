@@ -0,0 +1,269 @@
+// history.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// storeMessage records a chat message in the room's history, as the room's
+// persistence policy says, and returns its ID, or 0 when it isn't kept:
+// with persistence off, in whisper rooms and in rooms set to none.
+func (s *Server) storeMessage(room, username, body string) int64 {
+	if !s.config.Persist {
+		return 0
+	}
+	policy := s.roomPolicy(room)
+	if policy == persistNone {
+		return 0
+	}
+	encrypted := policy == persistEncrypted
+	if encrypted {
+		body = s.sealBody(room, body)
+	}
+
+	res, err := s.db.Exec("INSERT INTO messages (room, username, body, encrypted, sent_at) VALUES (?, ?, ?, ?, ?)",
+		room, username, body, encrypted, time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to store message: %v", err)
+		return 0
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// recentHistory returns the most recent messages of client's room, oldest
+// first, in the same format as live messages, as last edited. Deleted
+// messages and those from users the client has blocked are left out. They're
+// all read before any is written, so a slow client doesn't hold the database
+// connection (see openDatabase).
+func (s *Server) recentHistory(client *Client) []string {
+	if !s.config.Persist || s.config.HistoryLines <= 0 {
+		return nil
+	}
+	rows, err := s.db.Query(`
+        SELECT id, username, body, encrypted, edited, sent_at FROM (
+            SELECT id, username, body, encrypted, edited, sent_at FROM messages WHERE room = ? AND deleted = 0 ORDER BY id DESC LIMIT ?
+        ) ORDER BY id`, client.room, s.config.HistoryLines)
+	if err != nil {
+		log.Printf("Failed to load history for %s: %v", client.room, err)
+		return nil
+	}
+	defer rows.Close()
+
+	var history []string
+	for rows.Next() {
+		var id int64
+		var username, body string
+		var encrypted, edited bool
+		var sentAt time.Time
+		if err := rows.Scan(&id, &username, &body, &encrypted, &edited, &sentAt); err != nil {
+			log.Printf("Failed to read history for %s: %v", client.room, err)
+			return history
+		}
+		if s.hasBlocked(client.username, username) {
+			continue
+		}
+		line := s.formatMessage(sentAt, client.room, username, s.openBody(client.room, body, encrypted))
+		if edited {
+			line += editedMarker
+		}
+		history = append(history, withMessageID(id, line))
+	}
+	return history
+}
+
+// queuePrivate stores a PM for a registered user who is offline, to be
+// delivered when they next log in. Each user's queue is capped.
+func (s *Server) queuePrivate(from *Client, to, body string) {
+	if !s.userExists(to) || s.config.OfflineCap <= 0 {
+		from.printf("%s is not online.\n", to)
+		return
+	}
+
+	var queued int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM offline_messages WHERE recipient = ?", to).Scan(&queued)
+	if err != nil {
+		log.Printf("Failed to count offline messages for %s: %v", to, err)
+		from.printf("%s is not online.\n", to)
+		return
+	}
+	if queued >= s.config.OfflineCap {
+		from.printf("%s is offline and can't receive more messages right now.\n", to)
+		return
+	}
+
+	_, err = s.db.Exec("INSERT INTO offline_messages (recipient, sender, body, sent_at) VALUES (?, ?, ?, ?)",
+		to, from.username, body, time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to queue message for %s: %v", to, err)
+		from.printf("%s is not online.\n", to)
+		return
+	}
+	from.printf("[PM to %s (queued)] %s\n", to, body)
+	from.printf("%s is offline; your message will be delivered when they log in.\n", to)
+}
+
+// deliverOffline sends client the PMs queued while it was offline, then
+// removes them from the queue.
+func (s *Server) deliverOffline(client *Client) {
+	rows, err := s.db.Query("SELECT id, sender, body FROM offline_messages WHERE recipient = ? ORDER BY id", client.username)
+	if err != nil {
+		log.Printf("Failed to load offline messages for %s: %v", client.username, err)
+		return
+	}
+	type pending struct {
+		id           int64
+		sender, body string
+	}
+	var queued []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.sender, &p.body); err != nil {
+			log.Printf("Failed to read offline messages for %s: %v", client.username, err)
+			break
+		}
+		queued = append(queued, p)
+	}
+	rows.Close()
+	if len(queued) == 0 {
+		return
+	}
+
+	s.clientsMutex.Lock()
+	for _, p := range queued {
+		s.markUnread(client.username, p.sender)
+	}
+	s.clientsMutex.Unlock()
+	client.printf("You have %d offline messages:\n", len(queued))
+	for _, p := range queued {
+		client.printf("[PM from %s] %s\n", p.sender, p.body)
+	}
+	_, err = s.db.Exec("DELETE FROM offline_messages WHERE recipient = ? AND id <= ?", client.username, queued[len(queued)-1].id)
+	if err != nil {
+		log.Printf("Failed to clear offline messages for %s: %v", client.username, err)
+	}
+}
+
+// historyRecord is one exported message, written as a line of JSON.
+type historyRecord struct {
+	Time     time.Time `json:"time"`
+	Room     string    `json:"room"`
+	Username string    `json:"username"`
+	Body     string    `json:"body"`
+	Edited   bool      `json:"edited,omitempty"`
+}
+
+// exportCommand handles "/export [#room] [file]" and returns the reply for
+// whoever issued it. Without a room every room is exported; without a file
+// name one is made up from the current time.
+func (s *Server) exportCommand(args []string) string {
+	if !s.config.Persist {
+		return "Message history is off (-persist-messages=false); nothing to export."
+	}
+	room := ""
+	if len(args) > 0 && strings.HasPrefix(args[0], "#") {
+		room, args = args[0], args[1:]
+	}
+	if len(args) > 1 {
+		return "Usage: /export [#room] [file]"
+	}
+
+	name := fmt.Sprintf("history-%s.jsonl", time.Now().UTC().Format("20060102-150405"))
+	if len(args) == 1 {
+		name = args[0]
+	}
+	// Admins pick the file name, not where it goes
+	if !filepath.IsLocal(name) {
+		return "Export file must be a relative path inside the export directory."
+	}
+	path := filepath.Join(s.config.ExportDir, name)
+
+	n, err := s.exportHistory(room, path)
+	if err != nil {
+		log.Printf("Failed to export history to %s: %v", path, err)
+		return "Export failed."
+	}
+	log.Printf("Exported %d messages to %s", n, path)
+	return fmt.Sprintf("Exported %d messages to %s.", n, path)
+}
+
+// exportBatch is how many messages exportHistory reads from the database at
+// a time.
+var exportBatch = 500
+
+// exportHistory writes the stored messages of room (or of every room if
+// room is empty) to path as JSON Lines, oldest first. They're read in
+// batches of exportBatch by ID, each batch's rows closed before it's written,
+// so a large history is never held in memory and the database connection
+// (see openDatabase) is free for logins and chat between batches.
+func (s *Server) exportHistory(room, path string) (int, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+
+	n := 0
+	for after := int64(0); ; {
+		batch, err := s.historyBatch(room, after)
+		if err != nil {
+			return n, err
+		}
+		for _, m := range batch {
+			m.rec.Body = s.openBody(m.rec.Room, m.rec.Body, m.encrypted)
+			if err := enc.Encode(m.rec); err != nil {
+				return n, err
+			}
+			n++
+			after = m.id
+		}
+		if len(batch) < exportBatch {
+			break
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.Close()
+}
+
+// exportedMessage is a message read for exportHistory, not yet decrypted.
+type exportedMessage struct {
+	id        int64
+	rec       historyRecord
+	encrypted bool
+}
+
+// historyBatch reads up to exportBatch stored messages of room (or of every
+// room if room is empty) with IDs after the given one, in order.
+func (s *Server) historyBatch(room string, after int64) ([]exportedMessage, error) {
+	query := "SELECT id, sent_at, room, username, body, encrypted, edited FROM messages WHERE deleted = 0 AND id > ?"
+	args := []any{after}
+	if room != "" {
+		query += " AND room = ?"
+		args = append(args, room)
+	}
+	rows, err := s.db.Query(query+" ORDER BY id LIMIT ?", append(args, exportBatch)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var batch []exportedMessage
+	for rows.Next() {
+		var m exportedMessage
+		if err := rows.Scan(&m.id, &m.rec.Time, &m.rec.Room, &m.rec.Username, &m.rec.Body, &m.encrypted, &m.rec.Edited); err != nil {
+			return nil, err
+		}
+		batch = append(batch, m)
+	}
+	return batch, rows.Err()
+}
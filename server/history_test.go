@@ -0,0 +1,104 @@
+// history_test.go
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExportHistory(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t, Config{Persist: true, ExportDir: dir})
+	// Batches smaller than the history, to check they join up in order
+	defer func(batch int) { exportBatch = batch }(exportBatch)
+	exportBatch = 2
+	alice := register(t, s)
+	a := login(t, s, alice)
+	for _, text := range []string{"first", "second", "third"} {
+		a.send(text)
+	}
+	a.send("/who")
+	a.expect("Online: ")
+
+	if got, want := s.exportCommand([]string{"#general", "out.jsonl"}), "Exported 3 messages to "+filepath.Join(dir, "out.jsonl")+"."; got != want {
+		t.Fatalf("/export = %q, want %q", got, want)
+	}
+	f, err := os.Open(filepath.Join(dir, "out.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var bodies []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		if rec.Room != "#general" || rec.Username != alice || rec.Time.IsZero() {
+			t.Errorf("record %+v, want %s in #general with a time", rec, alice)
+		}
+		bodies = append(bodies, rec.Body)
+	}
+	if want := []string{"first", "second", "third"}; !slices.Equal(bodies, want) {
+		t.Errorf("exported %q, want %q", bodies, want)
+	}
+
+	if got := s.exportCommand([]string{"#general", "out.jsonl"}); got != "Export failed." {
+		t.Errorf("export over an existing file = %q, want it refused", got)
+	}
+}
+
+func TestOfflineMessages(t *testing.T) {
+	s := newTestServer(t, Config{OfflineCap: 2})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+
+	a.send("/msg " + bob + " are you there?")
+	a.expect("[PM to " + bob + " (queued)] are you there?")
+	a.send("/msg " + bob + " call me")
+	a.expect("[PM to " + bob + " (queued)] call me")
+	a.send("/msg " + bob + " one too many")
+	a.expect(bob + " is offline and can't receive more messages right now.")
+
+	b := tryLogin(t, s, bob)
+	got := b.until("--- now live in ")
+	want := []string{"You have 2 offline messages:", "[PM from " + alice + "] are you there?", "[PM from " + alice + "] call me"}
+	if i := slices.Index(got, want[0]); i < 0 || len(got) < i+len(want) || !slices.Equal(got[i:i+len(want)], want) {
+		t.Errorf("after login: %q, want %q", got, want)
+	}
+
+	// The receipt reaches the sender, and the queue is delivered only once
+	b.send("/read " + alice)
+	a.expect("[PM read by " + bob + "]")
+	for _, line := range tryLogin(t, s, bob).until("--- now live in ") {
+		if strings.Contains(line, "offline messages") {
+			t.Errorf("second login got %q", line)
+		}
+	}
+}
+
+func TestPersistToggle(t *testing.T) {
+	for _, persist := range []bool{false, true} {
+		s := newTestServer(t, Config{Persist: persist, HistoryLines: 10})
+		alice, bob := register(t, s), register(t, s)
+		a := login(t, s, alice)
+		a.send("remember me")
+		a.send("/whoami")
+		a.expect("Username: " + alice)
+
+		var stored int
+		s.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&stored)
+		replayed := slices.ContainsFunc(tryLogin(t, s, bob).until("--- now live in "), func(line string) bool {
+			return strings.HasSuffix(line, alice+": remember me")
+		})
+		if want := map[bool]int{false: 0, true: 1}[persist]; stored != want || replayed != persist {
+			t.Errorf("persist %v: %d messages stored and replayed %v, want %d and %v", persist, stored, replayed, want, persist)
+		}
+	}
+}
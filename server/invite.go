@@ -0,0 +1,146 @@
+// invite.go
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Invite tokens are an alternative to the shared registration code: /invite
+// signs a username, expiry time and random token ID with the server's invite
+// key, and the register path checks the signature, so nothing is stored per
+// invite. An invite can only be used once, since its username is then taken.
+// With InviteSingleUse the IDs of redeemed invites are also recorded until
+// they expire, so a token is refused on reuse whatever became of its user.
+
+// defaultInviteTTL is how long an invite is valid unless /invite says.
+const defaultInviteTTL = 24 * time.Hour
+
+// invitedNamePattern restricts the usernames an invite can be issued for.
+var invitedNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+var (
+	errInvalidInvite = errors.New("invalid invite token")
+	errExpiredInvite = errors.New("invite token has expired")
+)
+
+// invite is the content of a valid invite token.
+type invite struct {
+	username string
+	id       string // random, identifies the token for InviteSingleUse
+	expires  time.Time
+}
+
+// signInvite returns an invite token for username that expires at expires.
+func (s *Server) signInvite(username string, expires time.Time) string {
+	payload := username + "|" + strconv.FormatInt(expires.Unix(), 10) + "|" + randomHex(8)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(s.inviteMAC(payload))
+}
+
+func (s *Server) inviteMAC(payload string) []byte {
+	mac := hmac.New(sha256.New, s.inviteKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verifyInvite checks an invite token and returns what it was issued for.
+func (s *Server) verifyInvite(token string) (invite, error) {
+	encPayload, encSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return invite{}, errInvalidInvite
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return invite{}, errInvalidInvite
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil || !hmac.Equal(sig, s.inviteMAC(string(payload))) {
+		return invite{}, errInvalidInvite
+	}
+
+	fields := strings.Split(string(payload), "|")
+	if len(fields) != 3 {
+		return invite{}, errInvalidInvite
+	}
+	unix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return invite{}, errInvalidInvite
+	}
+	inv := invite{username: fields[0], id: fields[2], expires: time.Unix(unix, 0)}
+	if time.Now().After(inv.expires) {
+		return invite{}, errExpiredInvite
+	}
+	return inv, nil
+}
+
+// inviteRedeemed reports whether inv was already used to register, as far
+// as InviteSingleUse records tell.
+func (s *Server) inviteRedeemed(inv invite) bool {
+	s.invitesMutex.Lock()
+	defer s.invitesMutex.Unlock()
+	_, used := s.redeemedInvites[inv.id]
+	return used
+}
+
+// redeemInvite records that inv was used to register, if InviteSingleUse
+// is on. Records are dropped once their invite has expired, since expiry
+// alone then refuses it.
+func (s *Server) redeemInvite(inv invite) {
+	if !s.config.InviteSingleUse {
+		return
+	}
+	s.invitesMutex.Lock()
+	defer s.invitesMutex.Unlock()
+	now := time.Now()
+	for id, expires := range s.redeemedInvites {
+		if now.After(expires) {
+			delete(s.redeemedInvites, id)
+		}
+	}
+	s.redeemedInvites[inv.id] = inv.expires
+}
+
+// userExists reports whether username is registered.
+func (s *Server) userExists(username string) bool {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = ?)", username).Scan(&exists)
+	if err != nil {
+		log.Printf("Failed to look up %s: %v", username, err)
+	}
+	return exists
+}
+
+// inviteCommand handles /invite <username> [ttl] and returns its reply.
+func (s *Server) inviteCommand(args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return "Usage: /invite <username> [valid-for, e.g. 24h]"
+	}
+	username := args[0]
+	if !invitedNamePattern.MatchString(username) {
+		return "Invalid username. Use up to 32 letters, digits, '-' or '_'."
+	}
+	if usernameReserved(username) {
+		return "The username " + username + " is reserved."
+	}
+	ttl := defaultInviteTTL
+	if len(args) == 2 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return "Invalid duration " + args[1] + "."
+		}
+		ttl = d
+	}
+
+	expires := time.Now().Add(ttl)
+	return fmt.Sprintf("Invite for %s, valid until %s. Enter it instead of the registration code: %s",
+		username, expires.UTC().Format("2006-01-02 15:04 MST"), s.signInvite(username, expires))
+}
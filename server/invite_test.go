@@ -0,0 +1,106 @@
+// invite_test.go
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sendCode starts registering with code instead of the registration code.
+func sendCode(t *testing.T, s *testServer, code string) *testConn {
+	t.Helper()
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	c.expect("registration code")
+	c.send(code)
+	return c
+}
+
+func TestInviteTokens(t *testing.T) {
+	s := newTestServer(t, Config{RegCodeTries: 1})
+	reply := s.inviteCommand([]string{"carol", "1h"})
+	_, token, ok := strings.Cut(reply, "instead of the registration code: ")
+	if !ok {
+		t.Fatalf("/invite = %q, want a token", reply)
+	}
+
+	c := sendCode(t, s, token)
+	c.expect("Your invited username is: carol")
+	c.expect("Enter your desired password")
+	c.send(testPassword)
+	c.expect("Registration successful!")
+	login(t, s, "carol")
+
+	// Tampered: the signature no longer matches the payload
+	encoded, sig, _ := strings.Cut(s.signInvite("dave", time.Now().Add(time.Hour)), ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(encoded)
+	forged := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(payload), "dave", "root", 1))) + "." + sig
+	sendCode(t, s, forged).expect("Invalid registration code. Closing connection.")
+
+	expired := s.signInvite("erin", time.Now().Add(-time.Minute))
+	sendCode(t, s, expired).expect("This invite has expired. Closing connection.")
+	if s.userExists("dave") || s.userExists("root") || s.userExists("erin") {
+		t.Error("a tampered or expired invite registered its user")
+	}
+}
+
+func TestInviteRace(t *testing.T) {
+	s := newTestServer(t, Config{})
+	reply := s.inviteCommand([]string{"carol", "1h"})
+	_, token, _ := strings.Cut(reply, "instead of the registration code: ")
+
+	// Both get past the invite check before either registers
+	a, b := sendCode(t, s, token), sendCode(t, s, token)
+	for _, c := range []*testConn{a, b} {
+		c.expect("Your invited username is: carol")
+		c.expect("Enter your desired password")
+	}
+	a.send(testPassword)
+	b.send(testPassword)
+
+	var won, lost int
+	for _, c := range []*testConn{a, b} {
+		got := strings.Join(c.expectClosed(), "\n")
+		switch {
+		case strings.Contains(got, "Registration successful!"):
+			won++
+		case strings.Contains(got, "This invite has just been used. Ask for a new one."):
+			lost++
+		default:
+			t.Errorf("registering carol: %q, want success or that the invite was just used", got)
+		}
+	}
+	if won != 1 || lost != 1 {
+		t.Errorf("%d registrations succeeded and %d were told the invite was used, want 1 and 1", won, lost)
+	}
+	login(t, s, "carol")
+}
+
+func TestInviteSingleUse(t *testing.T) {
+	for _, singleUse := range []bool{false, true} {
+		s := newTestServer(t, Config{RegCodeTries: 1, InviteSingleUse: singleUse})
+		reply := s.inviteCommand([]string{"carol", "1h"})
+		_, token, _ := strings.Cut(reply, "instead of the registration code: ")
+
+		c := sendCode(t, s, token)
+		c.expect("Your invited username is: carol")
+		c.expect("Enter your desired password")
+		c.send(testPassword)
+		c.expect("Registration successful!")
+
+		// Once the account is gone, only the record of redeemed invites
+		// stops the token being used again
+		if _, err := s.db.Exec("DELETE FROM users WHERE username = 'carol'"); err != nil {
+			t.Fatal(err)
+		}
+		c = sendCode(t, s, token)
+		if singleUse {
+			c.expect("This invite has already been used. Closing connection.")
+		} else {
+			c.expect("Your invited username is: carol")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// keepalive_linux_test.go
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestKeepAliveConfigured reads back the socket options configureConn sets,
+// which needs Linux's names for them.
+func TestKeepAliveConfigured(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialed.Close()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := &Server{config: Config{KeepAlive: net.KeepAliveConfig{Enable: true, Idle: 45 * time.Second, Interval: 5 * time.Second, Count: 4}}}
+	s.configureConn(conn)
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][3]int{
+		"SO_KEEPALIVE":  {syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1},
+		"TCP_KEEPIDLE":  {syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 45},
+		"TCP_KEEPINTVL": {syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 5},
+		"TCP_KEEPCNT":   {syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 4},
+	}
+	for name, opt := range want {
+		var got int
+		var getErr error
+		raw.Control(func(fd uintptr) { got, getErr = syscall.GetsockoptInt(int(fd), opt[0], opt[1]) })
+		if getErr != nil {
+			t.Errorf("%s: %v", name, getErr)
+		} else if got != opt[2] {
+			t.Errorf("%s = %d, want %d", name, got, opt[2])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// listen.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// defaultListenAddr is where chat clients connect when no -listen is given.
+const defaultListenAddr = ":9000"
+
+// listenSpec is one -listen address. It's served over TLS when it has a
+// certificate, and in plaintext otherwise.
+type listenSpec struct {
+	addr     string
+	certFile string
+	keyFile  string
+}
+
+// parseListenSpec parses a -listen value: an address, optionally followed by
+// ",cert=FILE,key=FILE" to serve it over TLS, e.g. ":9443,cert=chat.crt,key=chat.key".
+func parseListenSpec(value string) (listenSpec, error) {
+	parts := strings.Split(value, ",")
+	spec := listenSpec{addr: parts[0]}
+	if _, _, err := net.SplitHostPort(spec.addr); err != nil {
+		return listenSpec{}, fmt.Errorf("invalid address %q: %v", spec.addr, err)
+	}
+	for _, opt := range parts[1:] {
+		key, v, _ := strings.Cut(opt, "=")
+		switch key {
+		case "cert":
+			spec.certFile = v
+		case "key":
+			spec.keyFile = v
+		default:
+			return listenSpec{}, fmt.Errorf("unknown option %q (want cert=FILE or key=FILE)", opt)
+		}
+	}
+	if (spec.certFile == "") != (spec.keyFile == "") {
+		return listenSpec{}, fmt.Errorf("%s: TLS needs both cert= and key=", spec.addr)
+	}
+	return spec, nil
+}
+
+// listen opens the listener for spec.
+func (spec listenSpec) listen() (net.Listener, error) {
+	if spec.certFile == "" {
+		return net.Listen("tcp", spec.addr)
+	}
+	cert, err := tls.LoadX509KeyPair(spec.certFile, spec.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	ln, err := net.Listen("tcp", spec.addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	return tls.NewListener(ln, config), nil
+}
+
+// tlsHandshake completes conn's TLS handshake, which would otherwise wait
+// for the first read or write, and with it the greeting, with no deadline.
+// It gets HandshakeTime, like the login that follows.
+func (s *Server) tlsHandshake(conn *tls.Conn) error {
+	ctx := context.Background()
+	if s.config.HandshakeTime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.config.HandshakeTime)
+		defer cancel()
+	}
+	return conn.HandshakeContext(ctx)
+}
+
+// String describes spec for the startup log.
+func (spec listenSpec) String() string {
+	if spec.certFile != "" {
+		return spec.addr + " (TLS)"
+	}
+	return spec.addr
+}
@@ -0,0 +1,98 @@
+// listen_test.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTLS has s serve a second, TLS listener alongside its plain one, with
+// a new self-signed certificate, until t ends. It returns the listener, to
+// dial, and a client config that trusts the certificate.
+func serveTLS(t *testing.T, s *testServer) (*pipeListener, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"chat.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	ln := newPipeListener()
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}, MinVersion: tls.VersionTLS12}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(tls.NewListener(ln, config)) }()
+	t.Cleanup(func() {
+		ln.Close()
+		if err := <-served; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Serve over TLS returned %v, want net.ErrClosed", err)
+		}
+	})
+	return ln, &tls.Config{RootCAs: roots, ServerName: "chat.test"}
+}
+
+func TestPlainAndTLSListeners(t *testing.T) {
+	s := newTestServer(t, Config{})
+	tlsLn, clientConfig := serveTLS(t, s)
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+
+	conn, err := tlsLn.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newTestConn(t, tls.Client(conn, clientConfig))
+	b.expect("Enter 'login' or 'register'")
+	b.send("login")
+	b.expect("Username:")
+	b.send(bob)
+	b.expect("Password")
+	b.send(testPassword)
+	b.expect("--- now live in ")
+
+	a.expect(bob + " has joined the chat")
+	a.send("plain to TLS")
+	b.expect(alice + ": plain to TLS")
+	b.send("TLS to plain")
+	a.expect(bob + ": TLS to plain")
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	s := newTestServer(t, Config{HandshakeTime: 200 * time.Millisecond, GreetDelay: time.Hour})
+	tlsLn, _ := serveTLS(t, s)
+	logs := captureLog(t)
+
+	// A client that never starts the handshake is dropped in HandshakeTime,
+	// not held for the greeting's delay
+	conn, err := tlsLn.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestConn(t, conn).expectClosed()
+	waitFor(t, "the failed handshake to be logged", func() bool {
+		return strings.Contains(logs.String(), "TLS handshake failed")
+	})
+}
@@ -0,0 +1,100 @@
+// metrics.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The metrics endpoint serves activity counters in the Prometheus text
+// format. Per-user series are opt-in and capped at MetricsUsers users, since
+// every tracked user adds series forever; messages from users past the cap
+// still count towards the totals.
+
+// userActivity is what the metrics endpoint reports about one user.
+type userActivity struct {
+	messages int64
+	lastSeen time.Time
+}
+
+// recordMessage counts a chat message sent by username.
+func (s *Server) recordMessage(username string) {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+	s.messageCount++
+	if s.config.MetricsUsers <= 0 {
+		return
+	}
+	a, ok := s.userActivity[username]
+	if !ok {
+		if len(s.userActivity) >= s.config.MetricsUsers {
+			s.untrackedCount++
+			return
+		}
+		a = &userActivity{}
+		s.userActivity[username] = a
+	}
+	a.messages++
+	a.lastSeen = time.Now()
+}
+
+// metricsHandler serves GET /metrics.
+func (s *Server) metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", s.handleMetrics)
+	return mux
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.roomsMutex.Lock()
+	s.clientsMutex.Lock()
+	clients, rooms := len(s.clients), len(s.rooms)
+	s.clientsMutex.Unlock()
+	s.roomsMutex.Unlock()
+
+	var sb strings.Builder
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("securechat_clients", "gauge", "Clients logged in.", int64(clients))
+	metric("securechat_rooms", "gauge", "Rooms that exist, including #general.", int64(rooms))
+
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+	metric("securechat_messages_total", "counter", "Chat messages sent to rooms.", s.messageCount)
+	if s.config.MetricsUsers > 0 {
+		metric("securechat_untracked_messages_total", "counter",
+			"Chat messages from users past the per-user metrics cap.", s.untrackedCount)
+		s.writeUserMetrics(&sb)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, sb.String())
+}
+
+// writeUserMetrics writes the per-user series. The caller must hold
+// metricsMutex.
+func (s *Server) writeUserMetrics(sb *strings.Builder) {
+	users := make([]string, 0, len(s.userActivity))
+	for name := range s.userActivity {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+
+	sb.WriteString("# HELP securechat_user_messages_total Chat messages sent to rooms, by user.\n")
+	sb.WriteString("# TYPE securechat_user_messages_total counter\n")
+	for _, name := range users {
+		fmt.Fprintf(sb, "securechat_user_messages_total{user=\"%s\"} %d\n", labelEscaper.Replace(name), s.userActivity[name].messages)
+	}
+	sb.WriteString("# HELP securechat_user_last_seen_timestamp_seconds When the user last sent a chat message.\n")
+	sb.WriteString("# TYPE securechat_user_last_seen_timestamp_seconds gauge\n")
+	for _, name := range users {
+		fmt.Fprintf(sb, "securechat_user_last_seen_timestamp_seconds{user=\"%s\"} %d\n", labelEscaper.Replace(name), s.userActivity[name].lastSeen.Unix())
+	}
+}
+
+// labelEscaper escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
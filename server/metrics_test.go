@@ -0,0 +1,43 @@
+// metrics_test.go
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserMetrics(t *testing.T) {
+	s := newTestServer(t, Config{MetricsUsers: 2})
+	alice, bob, carol := register(t, s), register(t, s), register(t, s)
+	for _, m := range []struct {
+		username string
+		messages int
+	}{{alice, 2}, {bob, 1}, {carol, 3}} {
+		c := login(t, s, m.username)
+		for i := 0; i < m.messages; i++ {
+			c.send("hello")
+		}
+		// Messages are counted before the next line is read
+		c.send("/whoami")
+		c.expect("Session started: ")
+	}
+
+	rec := httptest.NewRecorder()
+	s.metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	got := rec.Body.String()
+	for _, want := range []string{
+		"securechat_messages_total 6\n",
+		`securechat_user_messages_total{user="` + alice + `"} 2` + "\n",
+		`securechat_user_messages_total{user="` + bob + `"} 1` + "\n",
+		"securechat_untracked_messages_total 3\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("/metrics has no %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, carol) {
+		t.Errorf("/metrics tracks %s past the cap of 2 users:\n%s", carol, got)
+	}
+}
@@ -0,0 +1,167 @@
+// moderation.go
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Room moderation: admins and a room's creator can make other users
+// moderators of that room with /mod. Moderators may kick and mute users and
+// set the topic, in that room only; they get no other admin rights.
+// Moderation commands apply to the room the issuer is in. Admins, and a
+// room's creator, can't be kicked or muted by anyone.
+
+// canModerate reports whether client may kick, mute and set the topic in
+// room. The caller must hold roomsMutex.
+func (s *Server) canModerate(client *Client, room *Room) bool {
+	return room.creator == client.username || room.moderators[client.username] || s.isAdmin(client)
+}
+
+// moderatedRoom returns client's current room if client may moderate it,
+// and otherwise tells client why not and returns nil.
+func (s *Server) moderatedRoom(client *Client) *Room {
+	name := s.currentRoom(client)
+	s.roomsMutex.Lock()
+	room := s.rooms[name]
+	allowed := room != nil && s.canModerate(client, room)
+	s.roomsMutex.Unlock()
+	if !allowed {
+		client.printf("Only admins and moderators of %s can do that.\n", name)
+		return nil
+	}
+	return room
+}
+
+// setModerator handles /mod and /unmod, which only admins and the creator of
+// client's room may use.
+func (s *Server) setModerator(client *Client, username string, mod bool) {
+	name := s.currentRoom(client)
+	s.roomsMutex.Lock()
+	room := s.rooms[name]
+	allowed := room != nil && (room.creator == client.username || s.isAdmin(client))
+	if allowed {
+		if mod {
+			if room.moderators == nil {
+				room.moderators = make(map[string]bool)
+			}
+			room.moderators[username] = true
+		} else {
+			delete(room.moderators, username)
+		}
+	}
+	s.roomsMutex.Unlock()
+
+	if !allowed {
+		client.printf("Only admins and the creator of %s can choose its moderators.\n", name)
+		return
+	}
+	if mod {
+		log.Printf("[%s] %s made %s a moderator of %s", client.id, client.username, username, name)
+		client.printf("%s is now a moderator of %s.\n", username, name)
+	} else {
+		log.Printf("[%s] %s removed %s as a moderator of %s", client.id, client.username, username, name)
+		client.printf("%s is no longer a moderator of %s.\n", username, name)
+	}
+}
+
+// kickUser handles /kick: every session of username in client's room is
+// moved back to the default room.
+func (s *Server) kickUser(client *Client, username string) {
+	room := s.moderatedRoom(client)
+	if room == nil {
+		return
+	}
+	if room.name == defaultRoom {
+		client.printf("Nobody can be kicked from %s.\n", defaultRoom)
+		return
+	}
+	if username == client.username || username == room.creator || s.userIsAdmin(username) {
+		client.printf("You can't kick %s from %s.\n", username, room.name)
+		return
+	}
+
+	var kicked []*Client
+	s.clientsMutex.Lock()
+	for _, other := range s.clients {
+		if other.username == username && other.room == room.name {
+			kicked = append(kicked, other)
+		}
+	}
+	s.clientsMutex.Unlock()
+	if len(kicked) == 0 {
+		client.printf("%s isn't in %s.\n", username, room.name)
+		return
+	}
+
+	log.Printf("[%s] %s kicked %s from %s", client.id, client.username, username, room.name)
+	for _, other := range kicked {
+		s.deliver(other, fmt.Sprintf("You were kicked from %s by %s.", room.name, client.username))
+		s.moveToRoom(other, defaultRoom)
+	}
+	client.printf("Kicked %s from %s.\n", username, room.name)
+}
+
+// setMuted handles /mute and /unmute. Muted users stay in the room and
+// still see it, but their messages to it are refused.
+func (s *Server) setMuted(client *Client, username string, muted bool) {
+	room := s.moderatedRoom(client)
+	if room == nil {
+		return
+	}
+	if username == client.username || username == room.creator || s.userIsAdmin(username) {
+		client.printf("You can't mute %s in %s.\n", username, room.name)
+		return
+	}
+
+	s.roomsMutex.Lock()
+	if muted {
+		if room.muted == nil {
+			room.muted = make(map[string]bool)
+		}
+		room.muted[username] = true
+	} else {
+		delete(room.muted, username)
+	}
+	s.roomsMutex.Unlock()
+
+	if muted {
+		log.Printf("[%s] %s muted %s in %s", client.id, client.username, username, room.name)
+		client.printf("Muted %s in %s.\n", username, room.name)
+	} else {
+		log.Printf("[%s] %s unmuted %s in %s", client.id, client.username, username, room.name)
+		client.printf("Unmuted %s in %s.\n", username, room.name)
+	}
+}
+
+// userIsAdmin reports whether username is an admin account.
+func (s *Server) userIsAdmin(username string) bool {
+	var admin bool
+	err := s.db.QueryRow("SELECT admin FROM users WHERE username = ?", username).Scan(&admin)
+	return err == nil && admin
+}
+
+// mayPost reports whether client may post to the named room now, and if not
+// tells client why: during read-only maintenance only admins may, and a user
+// muted in the room may not. Everything that posts to a room checks here, as
+// do PMs, group messages and edits, against the room they're sent from, so
+// none of them is a way around a mute.
+func (s *Server) mayPost(client *Client, room string) bool {
+	if _, readOnly := s.maintenanceState(); readOnly && !s.isAdmin(client) {
+		client.println("Messages are disabled during maintenance.")
+		return false
+	}
+	if s.isMuted(room, client.username) {
+		client.printf("You are muted in %s.\n", room)
+		return false
+	}
+	return true
+}
+
+// isMuted reports whether username has been muted in the named room.
+func (s *Server) isMuted(name, username string) bool {
+	s.roomsMutex.Lock()
+	defer s.roomsMutex.Unlock()
+	room, ok := s.rooms[name]
+	return ok && room.muted[username]
+}
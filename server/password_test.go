@@ -0,0 +1,85 @@
+// password_test.go
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestBenchHash(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	benchHash([]string{"-iterations", "1234", "-rounds", "2"})
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := regexp.MustCompile(`^pbkdf2-sha256, 1234 iterations: [0-9.]+[µm]?s per hash\n$`)
+	if !want.Match(out) {
+		t.Errorf("bench-hash printed %q, want it to match %s", out, want)
+	}
+}
+
+func TestHashIterations(t *testing.T) {
+	s := newTestServer(t, Config{HashIterations: 1234})
+	username := register(t, s)
+
+	var stored string
+	if err := s.db.QueryRow("SELECT password FROM users WHERE username = ?", username).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "pbkdf2-sha256$1234$") {
+		t.Errorf("stored hash %q, want one made with 1234 iterations", stored)
+	}
+	if dummy := s.auth.(localAuthenticator).dummyHash; !strings.HasPrefix(dummy, "pbkdf2-sha256$1234$") {
+		t.Errorf("dummy hash %q, want one made with 1234 iterations", dummy)
+	}
+
+	login(t, s, username)
+	tryLogin(t, s, "nobody").expect("Invalid username or password.")
+}
+
+func TestPBKDF2Vectors(t *testing.T) {
+	// RFC 7914, section 11
+	for _, v := range []struct {
+		password, salt string
+		iterations     int
+		want           string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	} {
+		got := hex.EncodeToString(pbkdf2SHA256([]byte(v.password), []byte(v.salt), v.iterations, len(v.want)/2))
+		if got != v.want {
+			t.Errorf("PBKDF2-HMAC-SHA256(%q, %q, %d) = %s, want %s", v.password, v.salt, v.iterations, got, v.want)
+		}
+	}
+}
+
+func TestStoredHashesVerify(t *testing.T) {
+	// Made by the server before it used x/crypto/pbkdf2, so accounts and
+	// room passwords hashed then still work
+	const stored = "pbkdf2-sha256$1000$c2VjdXJlLWNoYXQgc2FsdA$0PwsLkbsg1/0QEiSKdzO7Fvasgp7OZr320LlhKIabqI"
+	if !checkPassword(stored, "correct horse") {
+		t.Errorf("checkPassword(%q) = false for the right password", stored)
+	}
+	if checkPassword(stored, "correct horse!") {
+		t.Errorf("checkPassword(%q) = true for a wrong password", stored)
+	}
+
+	hashed := hashPassword("battery staple", 1000)
+	if !checkPassword(hashed, "battery staple") || checkPassword(hashed, "battery") {
+		t.Errorf("a new hash %q doesn't check out", hashed)
+	}
+}
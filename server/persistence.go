@@ -0,0 +1,121 @@
+// persistence.go
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Per-room persistence: -room-persistence picks how a room's messages are
+// kept in history, on top of -persist-messages. "none" rooms are never
+// stored, like whisper rooms. "encrypted" rooms are stored with each body
+// sealed under a key of their own, generated at startup and held only in
+// memory, so reading them back takes more than the database key.
+
+// persistPolicy is how a room's messages are kept in history.
+type persistPolicy int
+
+const (
+	persistPlain     persistPolicy = iota // stored as sent, protected by the database key
+	persistNone                           // never stored
+	persistEncrypted                      // stored with the body sealed (see sealBody)
+)
+
+// unreadableBody stands in for a sealed body that can't be opened.
+const unreadableBody = "[message can't be decrypted]"
+
+// parseRoomPersistence parses a "#room=policy,#room=policy" list for
+// -room-persistence, where a policy is none, plain or encrypted.
+func parseRoomPersistence(spec string) (map[string]persistPolicy, error) {
+	policies := make(map[string]persistPolicy)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		room, name, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if !roomNamePattern.MatchString(room) {
+			return nil, fmt.Errorf("invalid room name %q", room)
+		}
+		switch name {
+		case "plain":
+			policies[room] = persistPlain
+		case "none":
+			policies[room] = persistNone
+		case "encrypted":
+			policies[room] = persistEncrypted
+		default:
+			return nil, fmt.Errorf("invalid policy %q for %s (want none, plain or encrypted)", name, room)
+		}
+	}
+	return policies, nil
+}
+
+// newBodyCipher returns an AES-256-GCM cipher under a new random key, for
+// sealing the messages of encrypted rooms.
+func newBodyCipher() cipher.AEAD {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate message key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatalf("Failed to set up message key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		log.Fatalf("Failed to set up message key: %v", err)
+	}
+	return aead
+}
+
+// roomPolicy returns how the named room's messages are kept.
+func (s *Server) roomPolicy(room string) persistPolicy {
+	s.roomsMutex.Lock()
+	r, exists := s.rooms[room]
+	ephemeral := exists && r.ephemeral
+	s.roomsMutex.Unlock()
+	if ephemeral {
+		return persistNone
+	}
+	return s.config.RoomPersistence[room]
+}
+
+// sealBody encrypts body for storage in room: a random nonce followed by the
+// ciphertext, in base64. The room name is authenticated along with it, so a
+// sealed body can't be passed off as another room's.
+func (s *Server) sealBody(room, body string) string {
+	nonce := make([]byte, s.bodyCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		log.Fatalf("Failed to generate nonce: %v", err)
+	}
+	sealed := s.bodyCipher.Seal(nonce, nonce, []byte(body), []byte(room))
+	return base64.StdEncoding.EncodeToString(sealed)
+}
+
+// openBody returns a stored message body as sent, decrypting it if it was
+// sealed. A body that can't be opened is logged and shown as unreadableBody.
+func (s *Server) openBody(room, body string, encrypted bool) string {
+	if !encrypted {
+		return body
+	}
+	sealed, err := base64.StdEncoding.DecodeString(body)
+	if err == nil && len(sealed) < s.bodyCipher.NonceSize() {
+		err = errors.New("too short")
+	}
+	var plain []byte
+	if err == nil {
+		n := s.bodyCipher.NonceSize()
+		plain, err = s.bodyCipher.Open(nil, sealed[:n], sealed[n:], []byte(room))
+	}
+	if err != nil {
+		log.Printf("Failed to decrypt a message in %s: %v", room, err)
+		return unreadableBody
+	}
+	return string(plain)
+}
@@ -0,0 +1,129 @@
+// preferences.go
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Preferences are settings a user keeps on the server with "/set <name>
+// <value>", such as how their client notifies them, so every session and
+// device gets the same ones. The server doesn't interpret them: they're
+// sent to clients as preferenceLine lines after the welcome, and again to
+// every session of the user when one changes. They're stored in the
+// preferences table, so like everything else they last until the server
+// stops.
+
+// preferenceLine starts a preference sent to a client, followed by its
+// name and value: "[pref] notify pm". A cleared preference has no value.
+const preferenceLine = "[pref] "
+
+// Limits on what a user may store.
+const (
+	maxPreferences     = 32  // preferences per user
+	maxPreferenceValue = 200 // characters per value
+)
+
+// preferenceNamePattern restricts preference names to a short lowercase slug.
+var preferenceNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+
+// setPreference handles "/set [name [value]]": with a value it saves the
+// preference, without one it clears it, and on its own it lists them.
+func (s *Server) setPreference(client *Client, args []string) {
+	if len(args) == 0 {
+		client.println(s.listPreferences(client.username))
+		return
+	}
+	name, value := args[0], strings.Join(args[1:], " ")
+	if !preferenceNamePattern.MatchString(name) {
+		client.println("Invalid preference name. Use up to 32 lowercase letters, digits, '-' or '_', starting with a letter.")
+		return
+	}
+	if utf8.RuneCountInString(value) > maxPreferenceValue {
+		client.printf("Preference values are limited to %d characters.\n", maxPreferenceValue)
+		return
+	}
+
+	var err error
+	if value == "" {
+		_, err = s.db.Exec("DELETE FROM preferences WHERE username = ? AND name = ?", client.username, name)
+	} else {
+		var others int
+		err = s.db.QueryRow("SELECT COUNT(*) FROM preferences WHERE username = ? AND name != ?", client.username, name).Scan(&others)
+		if err == nil && others >= maxPreferences {
+			client.printf("You have the most preferences allowed (%d). Clear one with /set <name>.\n", maxPreferences)
+			return
+		}
+		if err == nil {
+			_, err = s.db.Exec("INSERT OR REPLACE INTO preferences (username, name, value) VALUES (?, ?, ?)", client.username, name, value)
+		}
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to set preference %s for %s: %v", client.id, name, client.username, err)
+		client.println("Failed to save the preference. Please try again.")
+		return
+	}
+
+	// Every session of the user picks up the change, this one included
+	line := strings.TrimSuffix(preferenceLine+name+" "+value, " ")
+	for _, other := range s.recipients(func(other *Client) bool { return other.username == client.username }) {
+		s.deliver(other, line)
+	}
+	if value == "" {
+		client.printf("Cleared preference %s.\n", name)
+	} else {
+		client.printf("Saved preference %s: %s\n", name, value)
+	}
+}
+
+// listPreferences returns the "/set" reply listing username's preferences.
+func (s *Server) listPreferences(username string) string {
+	prefs, err := s.preferences(username)
+	if err != nil {
+		log.Printf("Failed to list preferences for %s: %v", username, err)
+		return "Failed to list your preferences."
+	}
+	if len(prefs) == 0 {
+		return "You have no preferences set. Save one with /set <name> <value>."
+	}
+	lines := []string{"Your preferences:"}
+	for _, p := range prefs {
+		lines = append(lines, "  "+p[0]+": "+p[1])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// preferences returns username's preferences as name and value pairs,
+// sorted by name.
+func (s *Server) preferences(username string) ([][2]string, error) {
+	rows, err := s.db.Query("SELECT name, value FROM preferences WHERE username = ? ORDER BY name", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var prefs [][2]string
+	for rows.Next() {
+		var p [2]string
+		if err := rows.Scan(&p[0], &p[1]); err != nil {
+			return nil, err
+		}
+		prefs = append(prefs, p)
+	}
+	return prefs, rows.Err()
+}
+
+// sendPreferences sends client its user's preferences, for its client to
+// restore. They're read in full first, so a slow client doesn't hold the
+// database connection (see openDatabase).
+func (s *Server) sendPreferences(client *Client) {
+	prefs, err := s.preferences(client.username)
+	if err != nil {
+		log.Printf("[%s] Failed to load preferences for %s: %v", client.id, client.username, err)
+		return
+	}
+	for _, p := range prefs {
+		client.println(preferenceLine + p[0] + " " + p[1])
+	}
+}
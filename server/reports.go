@@ -0,0 +1,119 @@
+// reports.go
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reports: anyone can flag a message in their room to its moderators with
+// "/report <id> <reason>", using the ID it was sent with (see
+// messageIDPrefix). Only messages kept in history have IDs. The online
+// admins, and the room's creator and moderators, are told at once; every
+// report is also stored in the reports table for admins to review with
+// /reports.
+
+// reportsShown is how many of the latest reports /reports lists.
+const reportsShown = 20
+
+// withMessageID prefixes a room message line with its ID, if it has one.
+func withMessageID(id int64, line string) string {
+	if id == 0 {
+		return line
+	}
+	return messageIDPrefix + strconv.FormatInt(id, 10) + "] " + line
+}
+
+// reportMessage handles "/report <id> <reason>".
+func (s *Server) reportMessage(client *Client, idText, reason string) {
+	id, err := strconv.Atoi(idText)
+	if err != nil || id <= 0 {
+		client.println("Usage: /report <message id> <reason>")
+		return
+	}
+
+	// Only messages in the reporter's own room can be reported, so IDs
+	// can't be used to probe other rooms
+	room := s.currentRoom(client)
+	var sender, body string
+	var encrypted bool
+	err = s.db.QueryRow("SELECT username, body, encrypted FROM messages WHERE id = ? AND room = ?", id, room).Scan(&sender, &body, &encrypted)
+	if errors.Is(err, sql.ErrNoRows) {
+		client.printf("No message %d in %s.\n", id, room)
+		return
+	}
+	if err == nil {
+		_, err = s.db.Exec("INSERT INTO reports (message_id, reporter, reason, reported_at) VALUES (?, ?, ?, ?)",
+			id, client.username, reason, time.Now().UTC())
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to report message %d: %v", client.id, id, err)
+		client.println("Failed to send the report. Please try again.")
+		return
+	}
+	log.Printf("[%s] %s reported message %d in %s", client.id, client.username, id, room)
+	body = s.openBody(room, body, encrypted)
+
+	// The room's moderators are copied first: recipients holds clientsMutex,
+	// which comes after roomsMutex
+	mods := make(map[string]bool)
+	s.roomsMutex.Lock()
+	if r, ok := s.rooms[room]; ok {
+		for name := range r.moderators {
+			mods[name] = true
+		}
+		if r.creator != "" {
+			mods[r.creator] = true
+		}
+	}
+	s.roomsMutex.Unlock()
+
+	line := fmt.Sprintf("[report] %s reported message %d in %s, from %s: %q Reason: %s", client.username, id, room, sender, body, reason)
+	keep := func(other *Client) bool {
+		return other != client && (other.admin || mods[other.username])
+	}
+	for _, other := range s.recipients(keep) {
+		s.deliver(other, line)
+	}
+	client.printf("Reported message %d to the moderators of %s.\n", id, room)
+}
+
+// reportsCommand handles /reports, listing the latest reports, newest first,
+// and returns the reply for whoever issued it.
+func (s *Server) reportsCommand(args []string) string {
+	if len(args) != 0 {
+		return "Usage: /reports"
+	}
+	rows, err := s.db.Query(`
+        SELECT r.message_id, r.reporter, r.reason, r.reported_at, m.room, m.username, m.body, m.encrypted
+        FROM reports r JOIN messages m ON m.id = r.message_id
+        ORDER BY r.id DESC LIMIT ?`, reportsShown)
+	if err != nil {
+		log.Printf("Failed to list reports: %v", err)
+		return "Failed to list reports."
+	}
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var id int64
+		var reporter, reason, room, sender, body string
+		var encrypted bool
+		var at time.Time
+		if err := rows.Scan(&id, &reporter, &reason, &at, &room, &sender, &body, &encrypted); err != nil {
+			log.Printf("Failed to list reports: %v", err)
+			return "Failed to list reports."
+		}
+		body = s.openBody(room, body, encrypted)
+		lines = append(lines, fmt.Sprintf("%s %s reported message %d in %s, from %s: %q Reason: %s",
+			at.UTC().Format("2006-01-02 15:04 MST"), reporter, id, room, sender, body, reason))
+	}
+	if len(lines) == 0 {
+		return "There are no reports."
+	}
+	return "Latest reports:\n" + strings.Join(lines, "\n")
+}
@@ -3,36 +3,369 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
+	"crypto/tls"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	// Use the xeodou fork of go-sqlcipher
-	_ "github.com/xeodou/go-sqlcipher"
+	sqlite3 "github.com/xeodou/go-sqlcipher"
 )
 
 type Client struct {
-	conn     net.Conn
-	username string
+	id          string // connection ID, prefixed to this session's log lines
+	conn        net.Conn
+	username    string
+	admin       bool
+	ephemeral   bool      // messages aren't kept in history or logged (see sessions.go)
+	room        string    // guarded by clientsMutex
+	away        string    // away message, empty when present; guarded by clientsMutex
+	lastActive  time.Time // when the client last sent anything; guarded by clientsMutex
+	connectedAt time.Time
+	slowWrites  int  // broadcast writes that blocked (see deliver); guarded by clientsMutex
+	dropped     bool // conn was closed by the server (see drop); guarded by clientsMutex
+
+	// writeMutex serializes every write to conn once the client exists:
+	// broadcasts (see deliver), which happen outside clientsMutex, and the
+	// client's own replies (see printf). Lines can't interleave, and one
+	// write's deadline can't clear another's.
+	writeMutex sync.Mutex
+
+	// Broadcasts reaching the client while it's sent its welcome and history
+	// wait here until it goes live (see goLive); guarded by writeMutex.
+	holding bool
+	held    []string
 }
 
-var (
-	clients       = make(map[net.Conn]*Client)
-	clientsMutex  sync.Mutex
-	db            *sql.DB
-	encryptionKey string
-	masterRegKey  string // single registration code for new signups
-	loginAttempts = make(map[string]time.Time) // map of username and last login attempt time
-	registerAttempts = time.Time{} // single timestamp for all registrations
+// Room is a chat channel. Membership is tracked on Client.room; members
+// counts it for the member cap and is guarded by roomsMutex.
+type Room struct {
+	name      string
+	password  string // hashed; empty means anyone may join
+	ephemeral bool   // whisper rooms never persist their messages
+	members   int
+	creator   string // username; empty for rooms the server made
+	topic     string // set with /topic by anyone who can moderate the room
+
+	moderators map[string]bool // usernames made moderators with /mod
+	muted      map[string]bool // usernames muted with /mute
+
+	emptySince time.Time // when members last dropped to 0, or the room was made
+}
+
+// leave uncounts a member of r. The caller must hold roomsMutex.
+func (r *Room) leave() {
+	if r.members--; r.members <= 0 {
+		r.emptySince = time.Now()
+	}
+}
+
+// defaultRoom is where every client lands after logging in.
+const defaultRoom = "#general"
+
+// Banner framing: clients show the lines between these markers verbatim and
+// never treat them as prompts.
+const (
+	bannerStart = "[banner]"
+	bannerEnd   = "[/banner]"
 )
 
+// markdownPrefix marks a line the client may render as Markdown: the MOTD
+// and /announce. Nothing else is sent with it, so chat is never reinterpreted.
+const markdownPrefix = "[md] "
+
+// messageIDPrefix starts a room message kept in history, followed by the
+// message's ID: "[id 42] alice: hi". /report takes the ID; clients may show
+// it or strip it.
+const messageIDPrefix = "[id "
+
+// commandPrefixLine announces, before the welcome, a CommandPrefix other
+// than "/": "[commands] !". Clients send their own commands with it.
+const commandPrefixLine = "[commands] "
+
+// roomNamePattern restricts room names to a leading '#' and a short slug.
+var roomNamePattern = regexp.MustCompile(`^#[A-Za-z0-9_-]{1,32}$`)
+
+// Config holds the server's tunables, normally populated from flags.
+type Config struct {
+	IdleTimeout    time.Duration // max wait for the next message; 0 disables
+	IdleWarning    time.Duration // how long before an idle kick to warn the client
+	MessageTimeout time.Duration // max time for a started message to complete
+	Greeting       string        // extra personal greeting after login; {user} is replaced
+	SilentJoins    bool          // don't announce joins/leaves to the room
+	Banner         string        // ASCII art sent before the welcome line
+	BannerStatus   bool          // add who's online and whether registration is open to the banner
+	MOTD           string        // Markdown sent after the welcome line
+	ExportDir      string        // directory /export writes history files into
+	Persist        bool          // keep room messages for replay and /export
+	HistoryLines   int           // recent messages replayed after login
+	RegCodeTries   int           // registration code attempts before disconnecting
+	ChoiceTries    int           // login/register choice attempts before disconnecting; 0 is unlimited
+	OfflineCap     int           // PMs queued per offline user; 0 disables queuing
+	IdleAfter      time.Duration // silence after which /who shows a user as idle; 0 disables
+	MaxRooms       int           // rooms that may exist at once, including #general; 0 is unlimited
+	MaxRoomMembers int           // clients allowed in one room via /join or /create; 0 is unlimited
+	RoomIdle       time.Duration // how long a room users made may stay empty before it's removed; 0 keeps them
+	EditWindow     time.Duration // how long users may edit or delete their messages after sending; 0 disables
+	MaxSessions    int           // simultaneous logins per user; 0 is unlimited
+	MaxAccounts    int           // registered accounts allowed; 0 is unlimited
+	ProtocolErrors int           // malformed lines tolerated before disconnecting; 0 is unlimited
+	MaxMessage     int           // longest room message or PM in characters; 0 is unlimited
+	TruncateLong   bool          // cut messages over MaxMessage short instead of refusing them
+	RegisterLimit  int           // registration attempts allowed per IP per RegisterWindow; 0 is unlimited
+	RegisterWindow time.Duration // window RegisterLimit applies to
+	AuthDelay      time.Duration // wait before answering a failed login, doubled per recent failure; 0 disables
+	AuthDelayMax   time.Duration // cap on AuthDelay's doubling; below AuthDelay keeps it flat
+	HandshakeBytes int           // bytes a connection may send before logging in; 0 is unlimited
+	GreetDelay     time.Duration // wait before sending a new connection the banner, dropping it if it sends first; 0 disables
+	AbandonLimit   int           // connections one IP may abandon before login per AbandonWindow; 0 is unlimited
+	AbandonWindow  time.Duration // window AbandonLimit applies to
+	HandshakeLines int           // lines a connection may send before logging in; 0 is unlimited
+	HandshakeTime  time.Duration // time a connection has to log in or register; 0 is unlimited
+	CommandPrefix  string        // starts a command from a client, doubled to send it as chat; empty means "/"
+	Sessions       sessionPolicy // whether users may, or must, log in to ephemeral sessions
+
+	// RoomPersistence overrides, per room, how Persist keeps its messages
+	// (see persistence.go). Rooms not listed are stored as sent.
+	RoomPersistence map[string]persistPolicy
+
+	// RoleRooms maps a role ("admin" or "user") to the room its members land
+	// in after login; roles not listed use defaultRoom.
+	RoleRooms map[string]string
+
+	// MessageFormat renders chat lines (live and replayed) from a
+	// messageView; nil means the plain "username: body" form.
+	MessageFormat *template.Template
+
+	// File uploads (see upload.go). UploadURL is the endpoint's public base
+	// URL, as put in references; empty disables /upload and /attach.
+	UploadURL string
+	UploadDir string // where uploaded files are stored
+	UploadMax int64  // largest upload accepted, in bytes
+
+	UploadUserQuota  int64         // bytes of uploads one user may have stored; 0 is unlimited
+	UploadTotalQuota int64         // bytes of uploads stored in all; 0 is unlimited
+	UploadTTL        time.Duration // how long an upload is kept before it's deleted; 0 keeps them
+
+	// KeepAlive configures TCP keepalive on accepted connections.
+	KeepAlive net.KeepAliveConfig
+
+	// Authenticator verifies logins; nil means the local user database.
+	Authenticator Authenticator
+
+	// HashIterations is the PBKDF2 cost of new password hashes (see
+	// password.go); zero means defaultHashIterations.
+	HashIterations int
+
+	// Slow-client detection: a broadcast write that blocks for SlowWrite or
+	// longer means the client isn't reading and its send buffer is full.
+	// After SlowWrites of those it's logged as a slow client, and
+	// disconnected if SlowDisconnect is set. A client whose write doesn't
+	// finish within WriteTimeout is disconnected outright.
+	SlowWrite      time.Duration // 0 disables detection
+	SlowWrites     int
+	SlowDisconnect bool
+	WriteTimeout   time.Duration // longest a broadcast write may block; 0 is unlimited
+
+	// MetricsUsers caps how many users get their own series at /metrics
+	// (see metrics.go); 0 disables per-user metrics.
+	MetricsUsers int
+
+	// InviteSingleUse records redeemed invite tokens so each can only be
+	// used once (see invite.go); otherwise invites are fully stateless.
+	InviteSingleUse bool
+
+	// RequireApproval creates registered accounts pending: they can't log
+	// in until an admin runs /approve. Invited accounts are approved already.
+	RequireApproval bool
+
+	// FirstAdmin makes the first account registered while no admin exists
+	// an admin, so a new server has someone to run /promote without editing
+	// the database. It's approved whatever RequireApproval says.
+	FirstAdmin bool
+
+	// LogContent includes message bodies and topics in the log; by default
+	// only who sent what size of message to whom is logged.
+	LogContent bool
+}
+
+// Server holds the state of one chat server. Everything a connection touches
+// hangs off it, so several servers (e.g. in tests) can run side by side.
+type Server struct {
+	config    Config
+	db        *sql.DB
+	auth      Authenticator
+	regKey    string // single registration code for new signups
+	inviteKey []byte // signs invite tokens (see invite.go)
+
+	bodyCipher cipher.AEAD // seals messages of encrypted rooms (see persistence.go)
+
+	// When both are needed, roomsMutex is taken before clientsMutex.
+	clients      map[net.Conn]*Client
+	clientsMutex sync.Mutex
+	rooms        map[string]*Room
+	roomsMutex   sync.Mutex
+
+	// historyMutex is held while a chat message is broadcast and stored,
+	// and while a new client is added and its history read, so each message
+	// reaches the client either in its replay or live, never both.
+	historyMutex sync.Mutex
+
+	// blocks maps a username to the set of users they've blocked with
+	// /block. Guarded by clientsMutex so broadcasts can check it cheaply.
+	blocks map[string]map[string]bool
+
+	// unread maps a username to the senders of PMs they've received but not
+	// yet acknowledged with /read. Guarded by clientsMutex.
+	unread map[string]map[string]bool
+
+	// sessions counts each user's logged-in connections, including ones
+	// still being set up, for MaxSessions. Guarded by clientsMutex.
+	sessions map[string]int
+
+	// accounts counts the rows in users for MaxAccounts: once at startup,
+	// then as createUser adds them. hasAdmin records whether any of them is
+	// an admin, for FirstAdmin.
+	accountsMutex sync.Mutex
+	accounts      int
+	hasAdmin      bool
+
+	attemptsMutex    sync.Mutex
+	loginAttempts    map[string]time.Time   // map of username and last login attempt time
+	registerAttempts map[string][]time.Time // recent registration attempts by client IP
+	abandoned        map[string][]time.Time // recent connections by client IP that left before a choice
+	authFailures     map[string]authFailure // recent failed logins by "ip:" or "user:" key
+
+	// Maintenance mode, toggled with /maintenance. While on, only admins may
+	// log in; in read-only maintenance non-admins also can't send messages.
+	maintenanceMutex    sync.Mutex
+	maintenanceMode     bool
+	maintenanceReadOnly bool
+
+	// Listeners being served, closed by Shutdown
+	listenersMutex sync.Mutex
+	listeners      []net.Listener
+
+	// IDs of invites used to register, with their expiry (InviteSingleUse)
+	invitesMutex    sync.Mutex
+	redeemedInvites map[string]time.Time
+
+	// Uploaded files by ID, and unused /upload tokens
+	uploadsMutex sync.Mutex
+	uploads      map[string]*upload
+	uploadTokens map[string]uploadToken
+
+	// Activity counters for /metrics
+	metricsMutex   sync.Mutex
+	messageCount   int64
+	untrackedCount int64 // messages from users past the MetricsUsers cap
+	userActivity   map[string]*userActivity
+}
+
+// NewServer returns a server backed by db (see openDatabase) that accepts
+// regKey as its registration code.
+func NewServer(config Config, db *sql.DB, regKey string) *Server {
+	if config.HashIterations <= 0 {
+		config.HashIterations = defaultHashIterations
+	}
+	if config.CommandPrefix == "" {
+		config.CommandPrefix = "/"
+	}
+	auth := config.Authenticator
+	if auth == nil {
+		auth = localAuthenticator{db: db, dummyHash: hashPassword("", config.HashIterations)}
+	}
+	s := &Server{
+		config:        config,
+		db:            db,
+		auth:          auth,
+		regKey:        regKey,
+		inviteKey:     make([]byte, 32),
+		bodyCipher:    newBodyCipher(),
+		clients:       make(map[net.Conn]*Client),
+		rooms:         map[string]*Room{defaultRoom: {name: defaultRoom}},
+		blocks:        make(map[string]map[string]bool),
+		unread:        make(map[string]map[string]bool),
+		sessions:      make(map[string]int),
+		loginAttempts: make(map[string]time.Time),
+
+		registerAttempts: make(map[string][]time.Time),
+		abandoned:        make(map[string][]time.Time),
+		redeemedInvites:  make(map[string]time.Time),
+		authFailures:     make(map[string]authFailure),
+
+		uploads:      make(map[string]*upload),
+		uploadTokens: make(map[string]uploadToken),
+
+		userActivity: make(map[string]*userActivity),
+	}
+	if _, err := rand.Read(s.inviteKey); err != nil {
+		log.Fatalf("Failed to generate invite key: %v", err)
+	}
+	for _, name := range config.RoleRooms {
+		s.rooms[name] = &Room{name: name}
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&s.accounts); err != nil {
+		log.Printf("Failed to count accounts: %v", err)
+	}
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE admin = 1)").Scan(&s.hasAdmin); err != nil {
+		log.Printf("Failed to look for admins: %v", err)
+	}
+	return s
+}
+
+// loginRoom returns the room a user with the given admin flag starts in.
+func (s *Server) loginRoom(admin bool) string {
+	role := "user"
+	if admin {
+		role = "admin"
+	}
+	if room, ok := s.config.RoleRooms[role]; ok {
+		return room
+	}
+	return defaultRoom
+}
+
+// parseRoleRooms parses a "role=#room,role=#room" list for -role-rooms.
+func parseRoleRooms(spec string) (map[string]string, error) {
+	roleRooms := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		role, room, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || (role != "admin" && role != "user") {
+			return nil, fmt.Errorf("invalid role mapping %q (want admin=#room or user=#room)", pair)
+		}
+		if !roomNamePattern.MatchString(room) {
+			return nil, fmt.Errorf("invalid room name %q", room)
+		}
+		roleRooms[role] = room
+	}
+	return roleRooms, nil
+}
+
 // generateEncryptionKey returns a random 256-bit encryption key in hex format
 func generateEncryptionKey() string {
 	key := make([]byte, 32)
@@ -51,6 +384,10 @@ func generateRegistrationKey() string {
 	return hex.EncodeToString(key)[:20]
 }
 
+// maxUsernameTries bounds how often registration draws a new random
+// username after finding the last one taken.
+const maxUsernameTries = 5
+
 // Generates random username
 func generateRandomUsername() string {
     key := make([]byte, 8) // 8 bytes will give us 16 hex characters
@@ -60,15 +397,22 @@ func generateRandomUsername() string {
     return "user_" + hex.EncodeToString(key)[:8] // Returns format: user_<8 random hex chars>
 }
 
-// hashPassword returns the SHA-256 hex digest of a password
-func hashPassword(password string) string {
-	hash := sha256.Sum256([]byte(password))
-	return hex.EncodeToString(hash[:])
+// generateConnID returns a short random token identifying one connection
+// in the logs.
+func generateConnID() string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalf("Failed to generate connection ID: %v", err)
+	}
+	return hex.EncodeToString(id)
 }
 
-func checkLoginAttempt(username string) bool {
+func (s *Server) checkLoginAttempt(username string) bool {
+    s.attemptsMutex.Lock()
+    defer s.attemptsMutex.Unlock()
+
     // Check if there's a recent attempt
-    if lastAttempt, exists := loginAttempts[username]; exists {
+    if lastAttempt, exists := s.loginAttempts[username]; exists {
         // If last attempt was less than 5 seconds ago, block it
         if time.Since(lastAttempt) < 5*time.Second {
             return false
@@ -76,34 +420,168 @@ func checkLoginAttempt(username string) bool {
     }
     
     // Update the last attempt time
-    loginAttempts[username] = time.Now()
+    s.loginAttempts[username] = time.Now()
     return true
 }
 
-func checkRegisterAttempt() bool {
-    // If last registration was less than 5 seconds ago, block it
-    if time.Since(registerAttempts) < 5*time.Second {
-        return false
-    }
-    
-    // Update the last registration time
-    registerAttempts = time.Now()
-    return true
+// checkRegisterAttempt reports whether the client at addr may try to
+// register, allowing RegisterLimit attempts per RegisterWindow from one IP.
+// This is separate from login throttling, so a flood of signups from one
+// address doesn't stop anyone logging in.
+func (s *Server) checkRegisterAttempt(addr net.Addr) bool {
+	if s.config.RegisterLimit <= 0 {
+		return true
+	}
+	ip := addrIP(addr)
+
+	s.attemptsMutex.Lock()
+	defer s.attemptsMutex.Unlock()
+
+	// Forget attempts that have left the window
+	recent := s.registerAttempts[ip][:0]
+	for _, at := range s.registerAttempts[ip] {
+		if time.Since(at) < s.config.RegisterWindow {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= s.config.RegisterLimit {
+		s.registerAttempts[ip] = recent
+		return false
+	}
+	s.registerAttempts[ip] = append(recent, time.Now())
+	sweepAttempts(s.registerAttempts, s.config.RegisterWindow)
+	return true
+}
+
+// sweptIPs is how many IPs an attempts map may hold before sweepAttempts
+// clears out the ones that haven't been back.
+const sweptIPs = 1000
+
+// sweepAttempts deletes the IPs whose latest attempt has left window, once
+// attempts holds more than sweptIPs, so addresses seen once aren't kept
+// forever. Attempts are appended in order, so the latest is last. The
+// caller must hold attemptsMutex.
+func sweepAttempts(attempts map[string][]time.Time, window time.Duration) {
+	if len(attempts) <= sweptIPs {
+		return
+	}
+	for ip, times := range attempts {
+		if len(times) == 0 || time.Since(times[len(times)-1]) >= window {
+			delete(attempts, ip)
+		}
+	}
+}
+
+// addrIP returns the IP part of a client address.
+func addrIP(addr net.Addr) string {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// authFailureTTL is how long failed logins count towards the delay.
+const authFailureTTL = 15 * time.Minute
+
+// authFailure tracks recent failed logins from one IP or for one username.
+type authFailure struct {
+	count int
+	last  time.Time
+}
+
+// failedLogin records a failed login for username from addr and returns how
+// long to wait before answering: AuthDelay, doubled for each earlier recent
+// failure from the same IP or for the same username, up to AuthDelayMax.
+// Legitimate typos cost a second or two; guessing gets slower and slower.
+func (s *Server) failedLogin(addr net.Addr, username string) time.Duration {
+	if s.config.AuthDelay <= 0 {
+		return 0
+	}
+	s.attemptsMutex.Lock()
+	defer s.attemptsMutex.Unlock()
+
+	now := time.Now()
+	for key, f := range s.authFailures {
+		if now.Sub(f.last) > authFailureTTL {
+			delete(s.authFailures, key)
+		}
+	}
+	worst := 0
+	for _, key := range []string{"ip:" + addrIP(addr), "user:" + username} {
+		f := s.authFailures[key]
+		f.count++
+		f.last = now
+		s.authFailures[key] = f
+		worst = max(worst, f.count)
+	}
+
+	delay, limit := s.config.AuthDelay, max(s.config.AuthDelay, s.config.AuthDelayMax)
+	for i := 1; i < worst && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
 }
 
-// initDatabase initializes an in-memory, SQLCipher-encrypted SQLite DB.
-func initDatabase() {
-	var err error
-	// Open the SQLite database in memory using sqlcipher driver.
-	db, err = sql.Open("sqlite3", ":memory:")
+// loggedIn forgets the failed logins for username from addr.
+func (s *Server) loggedIn(addr net.Addr, username string) {
+	s.attemptsMutex.Lock()
+	defer s.attemptsMutex.Unlock()
+	delete(s.authFailures, "ip:"+addrIP(addr))
+	delete(s.authFailures, "user:"+username)
+}
+
+// errDatabaseLost is returned for every query once the connection holding
+// the in-memory database has gone, taking the data with it.
+var errDatabaseLost = errors.New("in-memory database connection lost")
+
+// memoryConnector connects to an in-memory database exactly once. If the
+// pool ever discards that connection, connecting again would quietly start
+// a new, empty database, so it fails with errDatabaseLost instead.
+type memoryConnector struct {
+	driver *sqlite3.SQLiteDriver
+	mu     sync.Mutex
+	opened bool
+}
+
+func (c *memoryConnector) Connect(context.Context) (driver.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.opened {
+		return nil, errDatabaseLost
+	}
+	conn, err := c.driver.Open(":memory:")
 	if err != nil {
-		log.Fatalf("Failed to open SQLite database: %v", err)
+		return nil, err
 	}
+	c.opened = true
+	return conn, nil
+}
+
+func (c *memoryConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// openDatabase opens an in-memory SQLite DB encrypted by SQLCipher with the
+// given key and creates the schema. The DB lives on a single connection
+// that is kept for the life of the process.
+func openDatabase(encryptionKey string) (*sql.DB, error) {
+	db := sql.OpenDB(&memoryConnector{driver: &sqlite3.SQLiteDriver{}})
+	// Every connection to ":memory:" is a separate, empty database, so the
+	// pool must never open a second one. With a single connection,
+	// database/sql makes concurrent callers wait their turn for it, which
+	// also means nothing may query while it still holds open rows. It must
+	// also never be closed for being idle or old.
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
 
 	// Set the encryption key for SQLCipher
-	_, err = db.Exec(fmt.Sprintf("PRAGMA key = '%s';", encryptionKey))
+	_, err := db.Exec(fmt.Sprintf("PRAGMA key = '%s';", encryptionKey))
 	if err != nil {
-		log.Fatalf("Failed to set encryption key: %v", err)
+		db.Close()
+		return nil, fmt.Errorf("set encryption key: %w", err)
 	}
 
 	// Create the users table
@@ -111,180 +589,1966 @@ func initDatabase() {
         CREATE TABLE users (
             id INTEGER PRIMARY KEY AUTOINCREMENT,
             username TEXT UNIQUE NOT NULL,
-            password TEXT NOT NULL
+            password TEXT NOT NULL,
+            admin INTEGER NOT NULL DEFAULT 0,
+            approved INTEGER NOT NULL DEFAULT 1
+        );
+    `)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create users table: %w", err)
+	}
+
+	// Create the messages table (room history, never written for whisper rooms)
+	_, err = db.Exec(`
+        CREATE TABLE messages (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            room TEXT NOT NULL,
+            username TEXT NOT NULL,
+            body TEXT NOT NULL,
+            encrypted INTEGER NOT NULL DEFAULT 0,
+            edited INTEGER NOT NULL DEFAULT 0,
+            deleted INTEGER NOT NULL DEFAULT 0,
+            sent_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create messages table: %w", err)
+	}
+
+	// Create the offline_messages table (PMs waiting for their recipient)
+	_, err = db.Exec(`
+        CREATE TABLE offline_messages (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            recipient TEXT NOT NULL,
+            sender TEXT NOT NULL,
+            body TEXT NOT NULL,
+            sent_at DATETIME NOT NULL
         );
+        CREATE INDEX offline_messages_recipient ON offline_messages (recipient);
     `)
 	if err != nil {
-		log.Fatalf("Failed to create users table: %v", err)
+		db.Close()
+		return nil, fmt.Errorf("create offline_messages table: %w", err)
 	}
+
+	// Create the user_groups table (group memberships set with /group)
+	_, err = db.Exec(`
+        CREATE TABLE user_groups (
+            name TEXT NOT NULL,
+            username TEXT NOT NULL,
+            PRIMARY KEY (name, username)
+        );
+    `)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create user_groups table: %w", err)
+	}
+
+	// Create the reports table (messages flagged with /report)
+	_, err = db.Exec(`
+        CREATE TABLE reports (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            message_id INTEGER NOT NULL,
+            reporter TEXT NOT NULL,
+            reason TEXT NOT NULL,
+            reported_at DATETIME NOT NULL
+        );
+    `)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create reports table: %w", err)
+	}
+
+	// Create the preferences table (settings saved with /set)
+	_, err = db.Exec(`
+        CREATE TABLE preferences (
+            username TEXT NOT NULL,
+            name TEXT NOT NULL,
+            value TEXT NOT NULL,
+            PRIMARY KEY (username, name)
+        );
+    `)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create preferences table: %w", err)
+	}
+	return db, nil
+}
+
+// Error classes for createUser, so callers can tell users something useful
+// without exposing database internals.
+var (
+	errUsernameTaken      = errors.New("username already taken")
+	errStorageUnavailable = errors.New("storage unavailable")
+	errAccountLimit       = errors.New("account limit reached")
+	errReservedUsername   = errors.New("username is reserved")
+)
+
+// reservedUsernames can't be registered, whatever the case. Some are words
+// the client takes server lines by ("name: text" from a user called Online
+// would pass for a /who reply), or that it shows our own messages as ("You");
+// the rest are commands, roles and the server itself.
+var reservedUsernames = map[string]bool{
+	"online": true, "rooms": true, "room": true, "username": true, "password": true,
+	"away": true, "you": true, "admin": true, "server": true, "console": true,
+	"system": true, "exit": true, "quit": true, "help": true,
+}
+
+// usernameReserved reports whether name may not be registered: it's one of
+// reservedUsernames or looks like a command.
+func usernameReserved(name string) bool {
+	return strings.HasPrefix(name, "/") || reservedUsernames[strings.ToLower(name)]
+}
+
+// createUser inserts a new account, pending approval unless approved. A
+// reserved username is refused with errReservedUsername. Under
+// FirstAdmin, the first account while there's no admin is made an approved
+// admin, and admin reports it. Past MaxAccounts it fails with
+// errAccountLimit. A constraint violation is reported as errUsernameTaken; a
+// database that can't be written to at all (read-only, full, locked, I/O
+// failure) as errStorageUnavailable wrapping the cause.
+func (s *Server) createUser(username, hashedPassword string, approved bool) (admin bool, err error) {
+	if usernameReserved(username) {
+		return false, errReservedUsername
+	}
+	// Held across the insert so simultaneous registrations can't both take
+	// the last account, or both become the first admin
+	s.accountsMutex.Lock()
+	defer s.accountsMutex.Unlock()
+	if s.config.MaxAccounts > 0 && s.accounts >= s.config.MaxAccounts {
+		return false, errAccountLimit
+	}
+	admin = s.config.FirstAdmin && !s.hasAdmin
+	approved = approved || admin
+	_, err = s.db.Exec("INSERT INTO users (username, password, admin, approved) VALUES (?, ?, ?, ?)", username, hashedPassword, admin, approved)
+	if err == nil {
+		s.accounts++
+		s.hasAdmin = s.hasAdmin || admin
+		return admin, nil
+	}
+
+	var sqlErr sqlite3.Error
+	if errors.As(err, &sqlErr) {
+		switch sqlErr.Code {
+		case sqlite3.ErrConstraint:
+			return false, errUsernameTaken
+		case sqlite3.ErrReadonly, sqlite3.ErrFull, sqlite3.ErrIoErr, sqlite3.ErrBusy,
+			sqlite3.ErrLocked, sqlite3.ErrCantOpen, sqlite3.ErrPerm, sqlite3.ErrNomem:
+			return false, fmt.Errorf("%w: %v", errStorageUnavailable, err)
+		}
+	}
+	return false, err
+}
+
+// accountLimitReached reports whether MaxAccounts accounts exist, so a new
+// registration can be turned away before it's typed in. createUser checks
+// again when it counts.
+func (s *Server) accountLimitReached() bool {
+	s.accountsMutex.Lock()
+	defer s.accountsMutex.Unlock()
+	return s.config.MaxAccounts > 0 && s.accounts >= s.config.MaxAccounts
 }
 
-func handleClient(conn net.Conn) {
+func (s *Server) handleClient(conn net.Conn) {
 	defer conn.Close()
 
+	// Every log line about this connection carries its ID so a session can
+	// be followed from connect to disconnect.
+	id := generateConnID()
+	logger := log.New(log.Writer(), "["+id+"] ", log.Flags()|log.Lmsgprefix)
+	logger.Printf("Connection from %s", conn.RemoteAddr())
+	defer logger.Println("Disconnected")
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.tlsHandshake(tlsConn); err != nil {
+			logger.Printf("TLS handshake failed: %v", err)
+			s.connectionAbandoned(conn.RemoteAddr())
+			return
+		}
+	}
+	if s.connectionThrottled(conn.RemoteAddr()) {
+		logger.Printf("Refusing: too many abandoned connections from %s", addrIP(conn.RemoteAddr()))
+		fmt.Fprintln(conn, "Too many connections from your address. Please try again later.")
+		return
+	}
+	chose := false
+	defer func() {
+		if !chose {
+			s.connectionAbandoned(conn.RemoteAddr())
+		}
+	}()
+	// Scanners sweeping many hosts can't afford to wait out a delay
 	reader := bufio.NewReader(conn)
+	if !s.waitToGreet(conn, reader, logger) {
+		return
+	}
 
+	s.sendBanner(conn)
 	fmt.Fprintln(conn, "Welcome to the secure chat server!")
 	fmt.Fprintln(conn, "Enter 'login' or 'register': ")
 
-	userChoice, err := reader.ReadString('\n')
-	if err != nil {
-		log.Printf("Error reading choice: %v", err)
-		return
+	// Everything read before login counts against the handshake budget, and
+	// must arrive in time; the deadline is lifted once logged in
+	hs := s.newHandshakeReader(reader)
+	if s.config.HandshakeTime > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.config.HandshakeTime))
 	}
+	var userChoice string
+	var ephemeral bool
+	for attempt := 1; ; attempt++ {
+		answer, err := hs.readLine()
+		if err != nil {
+			handshakeFailed(conn, logger, "choice", err)
+			return
+		}
+		problem := "Invalid choice"
+		choice, kind, valid := parseLoginChoice(answer)
+		if valid {
+			var allowed bool
+			if ephemeral, allowed = s.sessionEphemeral(kind); allowed {
+				userChoice = choice
+				break
+			}
+			problem = fmt.Sprintf("This server doesn't allow %s sessions", kind)
+		}
+		if limit := s.config.ChoiceTries; limit > 0 {
+			if attempt >= limit {
+				logger.Printf("Closing: no valid choice in %d attempts", limit)
+				fmt.Fprintf(conn, "%s. Closing connection.\n", problem)
+				return
+			}
+			fmt.Fprintf(conn, "%s (attempts left: %d). Enter 'login' or 'register': \n", problem, limit-attempt)
+			continue
+		}
+		fmt.Fprintf(conn, "%s. Enter 'login' or 'register': \n", problem)
+	}
+	chose = true
 
-	userChoice = strings.TrimSpace(userChoice)
-
-	if strings.ToLower(userChoice) == "register" {
+	if userChoice == "register" {
 		// Check if the user is trying to register too quickly.
-		if !checkRegisterAttempt() {
-			fmt.Fprintln(conn, "Please wait a moment before trying again.")
+		if !s.checkRegisterAttempt(conn.RemoteAddr()) {
+			fmt.Fprintln(conn, "Too many registrations from your address. Please try again later.")
 			return;
 		}
-
-		fmt.Fprintln(conn, "Enter the server's registration code: ")
-		regAttempt, err := reader.ReadString('\n')
-		if err != nil {
-			log.Printf("Error reading registration code: %v", err)
+		if s.accountLimitReached() {
+			fmt.Fprintln(conn, "Registration closed: account limit reached.")
 			return
 		}
 
-		// Trim whitespace and remove square brackets
-		regAttempt = strings.TrimSpace(regAttempt)
-
-		// Replace '[' and ']' characters
-		regAttempt = strings.ReplaceAll(regAttempt, "[", "")
-		regAttempt = strings.ReplaceAll(regAttempt, "]", "")
-
-		// If code doesn't match, disconnect
-		if regAttempt != masterRegKey {
-			fmt.Fprintln(conn, "Invalid registration code. Closing connection.")
+		inv, ok := s.readRegistrationCode(conn, hs, logger)
+		if !ok {
 			return
 		}
-
-		usr := generateRandomUsername()
-		fmt.Fprintf(conn, "Your randomly generated username is: %s\n", usr)
+		usr := inv.username
+		invited := usr != ""
+		if invited {
+			fmt.Fprintf(conn, "Your invited username is: %s\n", usr)
+		} else {
+			usr = generateRandomUsername()
+			fmt.Fprintf(conn, "Your randomly generated username is: %s\n", usr)
+		}
 
 		// Note: actual password hiding is a client-side feature
 		fmt.Fprintln(conn, "Enter your desired password (typing not hidden): ")
-		pwd, err := reader.ReadString('\n')
+		pwd, err := hs.readLine()
 		if err != nil {
-			log.Printf("Error reading password: %v", err)
+			handshakeFailed(conn, logger, "password", err)
 			return
 		}
 		pwd = strings.TrimSpace(pwd)
 
-		hashed := hashPassword(pwd)
-		// Insert into DB
-		_, err = db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", usr, hashed)
-		if err != nil {
-			fmt.Fprintf(conn, "Failed to register: %v\n", err)
+		hashed := hashPassword(pwd, s.config.HashIterations)
+		// Insert into DB. The UNIQUE constraint settles races between
+		// registrations of the same name, whatever was checked before: a
+		// generated name that was taken meanwhile is simply replaced.
+		approved := invited || !s.config.RequireApproval
+		admin, err := s.createUser(usr, hashed, approved)
+		for tries := 1; !invited && errors.Is(err, errUsernameTaken) && tries < maxUsernameTries; tries++ {
+			usr = generateRandomUsername()
+			if admin, err = s.createUser(usr, hashed, approved); err == nil {
+				fmt.Fprintf(conn, "That username was just taken. Your username is now: %s\n", usr)
+			}
+		}
+		switch {
+		case errors.Is(err, errAccountLimit):
+			logger.Printf("Refusing to register %s: account limit reached", usr)
+			fmt.Fprintln(conn, "Registration closed: account limit reached.")
+			return
+		case errors.Is(err, errReservedUsername):
+			logger.Printf("Refusing to register reserved username %s", usr)
+			fmt.Fprintln(conn, "That username is reserved. Please register again.")
+			return
+		case errors.Is(err, errStorageUnavailable):
+			logger.Printf("Failed to register %s: %v", usr, err)
+			fmt.Fprintln(conn, "Registration temporarily unavailable. Please try again later.")
+			return
+		case errors.Is(err, errUsernameTaken) && invited:
+			fmt.Fprintln(conn, "This invite has just been used. Ask for a new one.")
+			return
+		case errors.Is(err, errUsernameTaken):
+			fmt.Fprintln(conn, "That username is already taken. Please register again.")
+			return
+		case err != nil:
+			logger.Printf("Failed to register %s: %v", usr, err)
+			fmt.Fprintln(conn, "Failed to register. Please try again.")
+			return
+		}
+		if invited {
+			s.redeemInvite(inv)
+		}
+		if admin {
+			logger.Printf("Registered %s as the first admin", usr)
+			fmt.Fprintln(conn, "Registration successful! As the server's first account, you're an admin. You can now login.")
+			return
+		}
+		if !approved {
+			logger.Printf("Registered %s, pending approval", usr)
+			fmt.Fprintln(conn, "Registration successful! An admin must approve your account before you can log in.")
 			return
 		}
 		fmt.Fprintln(conn, "Registration successful! You can now login.")
 		return
 
-	} else if strings.ToLower(userChoice) == "login" {
+	} else if userChoice == "login" {
 		fmt.Fprintln(conn, "Username: ")
-		usr, err := reader.ReadString('\n')
+		usr, err := hs.readLine()
 		if err != nil {
-			log.Printf("Error reading username: %v", err)
+			handshakeFailed(conn, logger, "username", err)
 			return
 		}
 		usr = strings.TrimSpace(usr)
 
 		// Check if the user is trying to login too quickly.
-		if !checkLoginAttempt(usr) {
+		if !s.checkLoginAttempt(usr) {
 			fmt.Fprintln(conn, "Please wait a moment before trying again.")
 			return
 		}
 
 		fmt.Fprintln(conn, "Password (typing not hidden): ")
-		pwd, err := reader.ReadString('\n')
+		pwd, err := hs.readLine()
 		if err != nil {
-			log.Printf("Error reading password: %v", err)
+			handshakeFailed(conn, logger, "password", err)
 			return
 		}
 		pwd = strings.TrimSpace(pwd)
 
-		var storedPassword string
-		row := db.QueryRow("SELECT password FROM users WHERE username = ?", usr)
-		err = row.Scan(&storedPassword)
+		account, err := s.auth.Authenticate(usr, pwd)
 		if err != nil {
+			if !errors.Is(err, errInvalidCredentials) {
+				logger.Printf("Error authenticating %s: %v", usr, err)
+			} else if delay := s.failedLogin(conn.RemoteAddr(), usr); delay > 0 {
+				logger.Printf("Failed login as %s; answering in %s", usr, delay)
+				time.Sleep(delay)
+			}
 			fmt.Fprintln(conn, "Invalid username or password.")
 			return
 		}
+		s.loggedIn(conn.RemoteAddr(), usr)
+		if account.Pending {
+			fmt.Fprintln(conn, "Your account is awaiting approval by an admin. Please try again later.")
+			return
+		}
+		admin := account.Admin
 
-		if hashPassword(pwd) != storedPassword {
-			fmt.Fprintln(conn, "Invalid username or password.")
+		// Only admins may log in while the server is in maintenance
+		if on, _ := s.maintenanceState(); on && !admin {
+			fmt.Fprintln(conn, "Server in maintenance. Please try again later.")
+			return
+		}
+		if !s.startSession(usr) {
+			logger.Printf("Refusing %s: session limit reached", usr)
+			fmt.Fprintln(conn, "Too many active sessions for this account. Log out elsewhere and try again.")
 			return
 		}
+		defer s.endSession(usr)
+
+		// Logged in: the handshake deadline no longer applies
+		conn.SetReadDeadline(time.Time{})
 
-		fmt.Fprintf(conn, "Welcome back, %s!\n", usr)
+		// Welcome, then history, then "now live": only after that does the
+		// client start receiving live messages, so its first lines always
+		// arrive in the same order. It's added first, holding what's sent to
+		// it meanwhile, so nothing sent during the replay is missed.
+		now := time.Now()
+		client := &Client{id: id, conn: conn, username: usr, admin: admin, ephemeral: ephemeral, room: s.loginRoom(admin), connectedAt: now, lastActive: now, holding: true}
+		s.historyMutex.Lock()
+		s.addClient(client)
+		history := s.recentHistory(client)
+		s.historyMutex.Unlock()
+
+		s.greetUser(client)
+		s.deliverOffline(client)
+		for _, line := range history {
+			client.println(line)
+		}
+		s.goLive(client)
 
-		// Add client
-		clientsMutex.Lock()
-		clients[conn] = &Client{conn: conn, username: usr}
-		clientsMutex.Unlock()
+		if ephemeral {
+			logger.Printf("Logged in as %s (ephemeral session)", usr)
+		} else {
+			logger.Printf("Logged in as %s", usr)
+		}
 
-		broadcast(fmt.Sprintf("%s has joined the chat", usr), conn)
+		s.announcePresence(client, "has joined the chat")
+		defer func() {
+			s.removeClient(client)
+			s.announcePresence(client, "has left the chat")
+		}()
 
 		// Read messages in a loop
-		buf := make([]byte, 1024)
+		protocolErrors := 0
 		for {
-			n, err := conn.Read(buf)
+			message, err := s.readMessage(client, reader)
 			if err != nil {
-				clientsMutex.Lock()
-				delete(clients, conn)
-				clientsMutex.Unlock()
-				broadcast(fmt.Sprintf("%s has left the chat", usr), conn)
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					logger.Printf("Dropping %s: read timed out", usr)
+				}
+				return
+			}
+			// A line buffered before the client was dropped mustn't run as
+			// a command or go out as chat: this is the one check for both
+			if !s.connected(client) {
+				logger.Printf("Ignoring a line from %s after disconnecting them", usr)
 				return
 			}
-			message := string(buf[:n])
-			broadcast(fmt.Sprintf("%s: %s", usr, message), conn)
+			s.clientsMutex.Lock()
+			client.lastActive = time.Now()
+			s.clientsMutex.Unlock()
+			if !wellFormed(message) {
+				protocolErrors++
+				if limit := s.config.ProtocolErrors; limit > 0 && protocolErrors >= limit {
+					logger.Printf("Closing: protocol error limit exceeded by %s", usr)
+					client.println("Protocol error limit exceeded. Closing connection.")
+					return
+				}
+				client.println("Malformed message ignored (invalid UTF-8 or control characters).")
+				continue
+			}
+			if message == "" {
+				continue
+			}
+			if rest, ok := strings.CutPrefix(message, s.config.CommandPrefix); ok {
+				if !strings.HasPrefix(rest, s.config.CommandPrefix) {
+					s.handleCommand(client, "/"+rest)
+					continue
+				}
+				// A doubled prefix escapes it: the rest is chat
+				message = rest
+			}
+			room := s.currentRoom(client)
+			if !s.mayPost(client, room) {
+				continue
+			}
+			if message = s.fitMessage(client, message); message == "" {
+				continue
+			}
+			s.logMessage(client, room, message)
+			s.historyMutex.Lock()
+			var id int64
+			if !client.ephemeral {
+				id = s.storeMessage(room, usr, message)
+			}
+			s.broadcastRoom(room, withMessageID(id, s.formatMessage(time.Now(), room, usr, message)), client)
+			s.historyMutex.Unlock()
+			s.recordMessage(usr)
 		}
-	} else {
-		fmt.Fprintln(conn, "Invalid choice. Closing.")
-		return
 	}
 }
 
-// broadcast sends the message to all connected clients except the sender
-func broadcast(message string, sender net.Conn) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
-	for c, client := range clients {
-		if c != sender {
-			fmt.Fprintln(c, message)
-		}
-		_ = client // avoid unused variable warning
+// logMessage logs that from sent a message to a room or user. Only the
+// metadata is logged unless LogContent is set, so chat doesn't end up in
+// log files by accident. Nothing is logged for ephemeral sessions.
+func (s *Server) logMessage(from *Client, to, body string) {
+	if from.ephemeral {
+		return
+	}
+	if s.config.LogContent {
+		log.Printf("[%s] Message from %s to %s (%d bytes): %s", from.id, from.username, to, len(body), body)
+		return
 	}
+	log.Printf("[%s] Message from %s to %s (%d bytes)", from.id, from.username, to, len(body))
 }
 
-func main() {
-	// Generate ephemeral encryption key
-	encryptionKey = generateEncryptionKey()
-	initDatabase()
+// readRegistrationCode prompts for the registration code or an invite token,
+// allowing a few retries for typos and paste errors. It reports whether a
+// valid one was entered, and for an invite what it was issued for; if not,
+// the client has been told and should be disconnected.
+func (s *Server) readRegistrationCode(conn net.Conn, hs *handshakeReader, logger *log.Logger) (inv invite, ok bool) {
+	fmt.Fprintln(conn, "Enter the server's registration code: ")
+	for attempt := 1; ; attempt++ {
+		regAttempt, err := hs.readLine()
+		if err != nil {
+			handshakeFailed(conn, logger, "registration code", err)
+			return invite{}, false
+		}
 
-	// Also generate a master registration key on startup
-	masterRegKey = generateRegistrationKey()
+		// Trim whitespace and remove square brackets
+		regAttempt = strings.TrimSpace(regAttempt)
 
-	log.Println("Secure (SQLCipher) chat server started on port 9000...")
-	log.Println("Encryption Key generated on startup. Database is ephemeral.")
-	log.Printf("Registration Key for new signups: %s\n", masterRegKey)
+		// Replace '[' and ']' characters
+		regAttempt = strings.ReplaceAll(regAttempt, "[", "")
+		regAttempt = strings.ReplaceAll(regAttempt, "]", "")
 
-	ln, err := net.Listen("tcp", ":9000")
-	if err != nil {
-		log.Fatalf("Error starting server: %v", err)
+		if regAttempt == s.regKey {
+			return invite{}, true
+		}
+		found, err := s.verifyInvite(regAttempt)
+		if err == nil && !s.userExists(found.username) && !s.inviteRedeemed(found) {
+			return found, true
+		}
+		problem := "Invalid registration code"
+		switch {
+		case err == nil:
+			problem = "This invite has already been used"
+		case errors.Is(err, errExpiredInvite):
+			problem = "This invite has expired"
+		}
+
+		// Out of attempts => disconnect
+		if attempt >= s.config.RegCodeTries {
+			fmt.Fprintf(conn, "%s. Closing connection.\n", problem)
+			return invite{}, false
+		}
+		fmt.Fprintf(conn, "%s (attempts left: %d). Enter the server's registration code: \n",
+			problem, s.config.RegCodeTries-attempt)
 	}
-	defer ln.Close()
+}
 
-	for {
+// sendBanner sends the configured banner, followed under BannerStatus by
+// the server's status, framed by bannerStart and bannerEnd. Nothing is sent
+// when there's neither. A line equal to bannerEnd would cut the banner
+// short, so such lines are dropped.
+func (s *Server) sendBanner(conn net.Conn) {
+	var lines []string
+	if s.config.Banner != "" {
+		lines = strings.Split(strings.TrimRight(s.config.Banner, "\r\n"), "\n")
+	}
+	if s.config.BannerStatus {
+		if len(lines) > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, s.serverStatus()...)
+	}
+	if len(lines) == 0 {
+		return
+	}
+	fmt.Fprintln(conn, bannerStart)
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if line != bannerEnd {
+			fmt.Fprintln(conn, line)
+		}
+	}
+	fmt.Fprintln(conn, bannerEnd)
+}
+
+// serverStatus returns the lines BannerStatus adds to the banner, as of
+// now: how many users are online and whether registering would work.
+func (s *Server) serverStatus() []string {
+	s.clientsMutex.Lock()
+	users := make(map[string]bool)
+	for _, client := range s.clients {
+		users[client.username] = true
+	}
+	s.clientsMutex.Unlock()
+
+	registration := "open"
+	switch {
+	case s.accountLimitReached():
+		registration = "closed (account limit reached)"
+	case s.config.RequireApproval:
+		registration = "open, but new accounts need an admin's approval"
+	}
+	lines := []string{
+		fmt.Sprintf("Users online: %d", len(users)),
+		"Registration: " + registration,
+	}
+	if on, _ := s.maintenanceState(); on {
+		lines = append(lines, "Maintenance: only admins can log in")
+	}
+	return lines
+}
+
+// greetUser sends the personal welcome to a client that just logged in.
+// Clients rely on the "Welcome back" line, so a configured greeting is sent
+// after it rather than instead of it, and a command prefix before it, so they
+// know it by the time they send their first command.
+func (s *Server) greetUser(client *Client) {
+	if s.config.CommandPrefix != "/" {
+		client.println(commandPrefixLine + s.config.CommandPrefix)
+	}
+	client.printf("Welcome back, %s!\n", client.username)
+	s.sendPreferences(client)
+	if client.ephemeral {
+		client.println("This session is ephemeral: your messages aren't kept in history or logged.")
+	}
+	if s.config.Greeting != "" {
+		client.println(strings.ReplaceAll(s.config.Greeting, "{user}", client.username))
+	}
+	s.sendMarkdown(client, s.config.MOTD)
+	s.sendTopic(client, client.room)
+}
+
+// sendMarkdown sends text to client one markdownPrefix line at a time.
+func (s *Server) sendMarkdown(client *Client, text string) {
+	if text == "" {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimRight(text, "\r\n"), "\n") {
+		client.println(markdownPrefix + strings.TrimRight(line, "\r"))
+	}
+}
+
+// announce sends a one-line Markdown announcement to every logged-in client.
+func (s *Server) announce(text string) {
+	log.Printf("Announcement: %s", text)
+	for _, client := range s.recipients(func(*Client) bool { return true }) {
+		s.deliver(client, markdownPrefix+text)
+	}
+}
+
+// announcePresence tells the client's room that it joined or left the chat,
+// unless joins are configured to be silent.
+func (s *Server) announcePresence(client *Client, event string) {
+	if s.config.SilentJoins {
+		return
+	}
+	s.broadcastRoom(s.currentRoom(client), fmt.Sprintf("%s %s", client.username, event), client)
+}
+
+// readMessage reads one newline-terminated message from conn. Waiting for a
+// message is bounded by the idle timeout, but once its first byte arrives the
+// rest must follow within the message timeout, so a client trickling bytes
+// can't hold the connection open indefinitely.
+func (s *Server) readMessage(client *Client, reader *bufio.Reader) (string, error) {
+	if err := s.awaitMessage(client, reader); err != nil {
+		return "", err
+	}
+
+	if s.config.MessageTimeout > 0 {
+		client.conn.SetReadDeadline(time.Now().Add(s.config.MessageTimeout))
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// wellFormed reports whether a line from a client is one the protocol
+// allows: valid UTF-8 with no control characters other than tab. Anything
+// else could garble (or drive) other users' terminals.
+func wellFormed(line string) bool {
+	if !utf8.ValidString(line) {
+		return false
+	}
+	for _, r := range line {
+		if r != '\t' && unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// oversizeMarker ends a message cut short to MaxMessage.
+const oversizeMarker = "…"
+
+// fitMessage applies MaxMessage to a message body from client. A longer
+// one is truncated, marker included, or with the default policy refused;
+// either way client is told. It returns "" for a refused message.
+func (s *Server) fitMessage(client *Client, body string) string {
+	limit := s.config.MaxMessage
+	n := utf8.RuneCountInString(body)
+	if limit <= 0 || n <= limit {
+		return body
+	}
+	if !s.config.TruncateLong {
+		client.printf("Message too long (%d characters, the limit is %d). Not sent.\n", n, limit)
+		return ""
+	}
+	r := []rune(body)
+	client.printf("Message too long; sent only its first %d characters.\n", limit-1)
+	return string(r[:limit-1]) + oversizeMarker
+}
+
+// awaitMessage blocks until the next message starts to arrive or the idle
+// timeout passes. If an idle warning is configured, the client is told that
+// long before being dropped; sending anything in the meantime cancels it.
+func (s *Server) awaitMessage(client *Client, reader *bufio.Reader) error {
+	conn := client.conn
+	idle, warn := s.config.IdleTimeout, s.config.IdleWarning
+	if idle <= 0 {
+		conn.SetReadDeadline(time.Time{})
+		_, err := reader.Peek(1)
+		return err
+	}
+	if warn <= 0 || warn >= idle {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		_, err := reader.Peek(1)
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(idle - warn))
+	_, err := reader.Peek(1)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		return err
+	}
+	client.printf("You'll be disconnected in %s due to inactivity.\n", warn)
+	conn.SetReadDeadline(time.Now().Add(warn))
+	_, err = reader.Peek(1)
+	return err
+}
+
+// handleCommand runs a command sent by a logged-in client, spelt with "/"
+// whatever CommandPrefix it was sent with. The read loop has checked that
+// the client is still connected.
+func (s *Server) handleCommand(client *Client, line string) {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "/who":
+		client.println(s.listOnline())
+	case "/whoami":
+		s.whoami(client)
+	case "/away":
+		s.setAway(client, strings.Join(fields[1:], " "))
+	case "/set":
+		s.setPreference(client, fields[1:])
+	case "/msg":
+		if len(fields) < 3 {
+			client.println("Usage: /msg <username> <message>")
+			return
+		}
+		if !s.mayPost(client, s.currentRoom(client)) {
+			return
+		}
+		if body := s.fitMessage(client, strings.Join(fields[2:], " ")); body != "" {
+			s.sendPrivate(client, fields[1], body)
+		}
+	case "/read":
+		if len(fields) != 2 {
+			client.println("Usage: /read <username>")
+			return
+		}
+		s.markRead(client, fields[1])
+	case "/block", "/unblock":
+		if len(fields) != 2 {
+			client.printf("Usage: %s <username>\n", fields[0])
+			return
+		}
+		s.setBlocked(client, fields[1], fields[0] == "/block")
+	case "/rooms":
+		client.println(s.listRooms())
+	case "/join":
+		if len(fields) < 2 || len(fields) > 3 {
+			client.println("Usage: /join #room [password]")
+			return
+		}
+		s.joinRoom(client, fields[1], strings.Join(fields[2:], ""))
+	case "/create":
+		if len(fields) < 2 || len(fields) > 3 {
+			client.println("Usage: /create #room [password]")
+			return
+		}
+		s.createRoom(client, fields[1], strings.Join(fields[2:], ""))
+	case "/topic":
+		s.topicCommand(client, fields[1:])
+	case "/mod", "/unmod":
+		if len(fields) != 2 {
+			client.printf("Usage: %s <username>\n", fields[0])
+			return
+		}
+		s.setModerator(client, fields[1], fields[0] == "/mod")
+	case "/kick":
+		if len(fields) != 2 {
+			client.println("Usage: /kick <username>")
+			return
+		}
+		s.kickUser(client, fields[1])
+	case "/mute", "/unmute":
+		if len(fields) != 2 {
+			client.printf("Usage: %s <username>\n", fields[0])
+			return
+		}
+		s.setMuted(client, fields[1], fields[0] == "/mute")
+	case "/maintenance":
+		if !s.isAdmin(client) {
+			client.println("Permission denied.")
+			return
+		}
+		client.println(s.maintenanceCommand(fields[1:]))
+	case "/export":
+		if !s.isAdmin(client) {
+			client.println("Permission denied.")
+			return
+		}
+		client.println(s.exportCommand(fields[1:]))
+	case "/invite":
+		if !s.isAdmin(client) {
+			client.println("Permission denied.")
+			return
+		}
+		client.println(s.inviteCommand(fields[1:]))
+	case "/approve":
+		if !s.isAdmin(client) {
+			client.println("Permission denied.")
+			return
+		}
+		client.println(s.approveCommand(fields[1:]))
+	case "/group":
+		if !s.isAdmin(client) {
+			client.println("Permission denied.")
+			return
+		}
+		client.println(s.groupCommand(fields[1:]))
+	case "/msggroup":
+		if len(fields) < 3 {
+			client.println("Usage: /msggroup <group> <message>")
+			return
+		}
+		if !s.mayPost(client, s.currentRoom(client)) {
+			return
+		}
+		if body := s.fitMessage(client, strings.Join(fields[2:], " ")); body != "" {
+			s.sendGroup(client, fields[1], body)
+		}
+	case "/edit":
+		if len(fields) < 3 {
+			client.println("Usage: /edit <message id|last> <new text>")
+			return
+		}
+		if !s.mayPost(client, s.currentRoom(client)) {
+			return
+		}
+		if body := s.fitMessage(client, strings.Join(fields[2:], " ")); body != "" {
+			s.editMessage(client, fields[1], body)
+		}
+	case "/delete":
+		if len(fields) != 2 {
+			client.println("Usage: /delete <message id|last>")
+			return
+		}
+		s.deleteMessage(client, fields[1])
+	case "/report":
+		if len(fields) < 3 {
+			client.println("Usage: /report <message id> <reason>")
+			return
+		}
+		s.reportMessage(client, fields[1], strings.Join(fields[2:], " "))
+	case "/reports":
+		if !s.isAdmin(client) {
+			client.println("Permission denied.")
+			return
+		}
+		client.println(s.reportsCommand(fields[1:]))
+	case "/announce":
+		if !s.isAdmin(client) {
+			client.println("Permission denied.")
+			return
+		}
+		if len(fields) < 2 {
+			client.println("Usage: /announce <markdown>")
+			return
+		}
+		s.announce(strings.Join(fields[1:], " "))
+	case "/upload":
+		s.uploadCommand(client)
+	case "/attach":
+		if len(fields) != 2 {
+			client.println("Usage: /attach <url from the upload>")
+			return
+		}
+		s.attachCommand(client, fields[1])
+	default:
+		client.printf("Unknown command: %s%s\n", s.config.CommandPrefix, strings.TrimPrefix(fields[0], "/"))
+	}
+}
+
+// currentRoom returns the room client is chatting in.
+func (s *Server) currentRoom(client *Client) string {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	return client.room
+}
+
+// joinRoom moves client into the named room, creating a public room if it
+// doesn't exist yet. Password-protected rooms require the right password.
+func (s *Server) joinRoom(client *Client, name, password string) {
+	if !roomNamePattern.MatchString(name) {
+		client.println("Invalid room name. Use # followed by letters, digits, '-' or '_'.")
+		return
+	}
+
+	s.roomsMutex.Lock()
+	room, exists := s.rooms[name]
+	if !exists && s.roomLimitReached() {
+		s.roomsMutex.Unlock()
+		client.printf("Can't create %s: the server's room limit has been reached.\n", name)
+		return
+	}
+	if !exists {
+		room = &Room{name: name, creator: client.username, emptySince: time.Now()}
+		s.rooms[name] = room
+		log.Printf("[%s] Room %s created by %s", client.id, name, client.username)
+	}
+	stored := room.password
+	s.roomsMutex.Unlock()
+
+	// Hashing is slow by design, so check outside the lock
+	if stored != "" && !checkPassword(stored, password) {
+		client.printf("Wrong password for %s.\n", name)
+		return
+	}
+	s.moveToRoom(client, name)
+}
+
+// createRoom creates a whisper room: unlisted, never persisted, and
+// optionally password-protected. The creator joins it straight away.
+func (s *Server) createRoom(client *Client, name, password string) {
+	if !roomNamePattern.MatchString(name) {
+		client.println("Invalid room name. Use # followed by letters, digits, '-' or '_'.")
+		return
+	}
+
+	room := &Room{name: name, ephemeral: true, creator: client.username, emptySince: time.Now()}
+	if password != "" {
+		room.password = hashPassword(password, s.config.HashIterations)
+	}
+
+	s.roomsMutex.Lock()
+	_, exists := s.rooms[name]
+	limited := !exists && s.roomLimitReached()
+	if !exists && !limited {
+		s.rooms[name] = room
+	}
+	s.roomsMutex.Unlock()
+
+	if exists {
+		client.printf("Room %s already exists.\n", name)
+		return
+	}
+	if limited {
+		client.printf("Can't create %s: the server's room limit has been reached.\n", name)
+		return
+	}
+	log.Printf("[%s] Whisper room %s created by %s", client.id, name, client.username)
+	s.moveToRoom(client, name)
+}
+
+// topicCommand handles /topic: on its own or with just a room it shows the
+// topic, and with text it sets it. Only admins, the room's creator and its
+// moderators may set a topic.
+func (s *Server) topicCommand(client *Client, args []string) {
+	name := s.currentRoom(client)
+	if len(args) > 0 && strings.HasPrefix(args[0], "#") {
+		name, args = args[0], args[1:]
+	}
+
+	s.roomsMutex.Lock()
+	room, exists := s.rooms[name]
+	allowed := exists && s.canModerate(client, room)
+	s.roomsMutex.Unlock()
+	// Whisper rooms are unlisted, so only their members may see the topic
+	if !exists || (room.ephemeral && name != s.currentRoom(client)) {
+		client.printf("No such room: %s\n", name)
+		return
+	}
+
+	if len(args) == 0 {
+		if !s.sendTopic(client, name) {
+			client.printf("%s has no topic.\n", name)
+		}
+		return
+	}
+	if !allowed {
+		client.printf("Only admins and moderators of %s can set its topic.\n", name)
+		return
+	}
+
+	topic := strings.Join(args, " ")
+	s.roomsMutex.Lock()
+	room.topic = topic
+	s.roomsMutex.Unlock()
+	if s.config.LogContent {
+		log.Printf("[%s] %s set the topic of %s: %s", client.id, client.username, name, topic)
+	} else {
+		log.Printf("[%s] %s set the topic of %s", client.id, client.username, name)
+	}
+	s.broadcastRoom(name, fmt.Sprintf("%s set the topic of %s: %s", client.username, name, topic), client)
+	client.printf("Topic of %s set.\n", name)
+}
+
+// sendTopic tells client the topic of the named room, if it has one.
+func (s *Server) sendTopic(client *Client, name string) bool {
+	s.roomsMutex.Lock()
+	var topic string
+	if room, ok := s.rooms[name]; ok {
+		topic = room.topic
+	}
+	s.roomsMutex.Unlock()
+	if topic == "" {
+		return false
+	}
+	client.printf("Topic of %s: %s\n", name, topic)
+	return true
+}
+
+// roomLimitReached reports whether MaxRooms rooms already exist. The caller
+// must hold roomsMutex.
+func (s *Server) roomLimitReached() bool {
+	return s.config.MaxRooms > 0 && len(s.rooms) >= s.config.MaxRooms
+}
+
+// cleanupRooms runs removeIdleRooms a few times per RoomIdle.
+func (s *Server) cleanupRooms() {
+	ticker := time.NewTicker(max(s.config.RoomIdle/4, time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		s.removeIdleRooms()
+	}
+}
+
+// removeIdleRooms removes rooms users made once they've been empty for
+// RoomIdle. Rooms the server made, such as #general and the -role-rooms,
+// have no creator and always stay.
+func (s *Server) removeIdleRooms() {
+	idle := s.config.RoomIdle
+	s.roomsMutex.Lock()
+	defer s.roomsMutex.Unlock()
+	for name, room := range s.rooms {
+		if room.creator != "" && room.members <= 0 && time.Since(room.emptySince) >= idle {
+			delete(s.rooms, name)
+			log.Printf("Removed %s after %s empty", name, idle)
+		}
+	}
+}
+
+// addClient registers a logged-in client as a member of its room.
+func (s *Server) addClient(client *Client) {
+	s.roomsMutex.Lock()
+	s.clientsMutex.Lock()
+	s.clients[client.conn] = client
+	if r, ok := s.rooms[client.room]; ok {
+		r.members++
+	}
+	s.clientsMutex.Unlock()
+	s.roomsMutex.Unlock()
+}
+
+// startSession counts a new login for username, unless it already has
+// MaxSessions. It's counted from here rather than on the clients map so
+// that simultaneous logins can't both slip under the cap. Every successful
+// call must be matched by endSession.
+func (s *Server) startSession(username string) bool {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	if s.config.MaxSessions > 0 && s.sessions[username] >= s.config.MaxSessions {
+		return false
+	}
+	s.sessions[username]++
+	return true
+}
+
+// endSession uncounts a login started with startSession.
+func (s *Server) endSession(username string) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	if s.sessions[username]--; s.sessions[username] <= 0 {
+		delete(s.sessions, username)
+	}
+}
+
+// removeClient forgets a disconnected client and its room membership.
+func (s *Server) removeClient(client *Client) {
+	s.roomsMutex.Lock()
+	s.clientsMutex.Lock()
+	delete(s.clients, client.conn)
+	if r, ok := s.rooms[client.room]; ok {
+		r.leave()
+	}
+	s.clientsMutex.Unlock()
+	s.roomsMutex.Unlock()
+}
+
+// moveToRoom switches client to the named (existing) room and tells both
+// the old and the new room about the move.
+func (s *Server) moveToRoom(client *Client, name string) {
+	s.roomsMutex.Lock()
+	s.clientsMutex.Lock()
+	old := client.room
+	room := s.rooms[name]
+	full := room != nil && old != name && s.config.MaxRoomMembers > 0 && room.members >= s.config.MaxRoomMembers
+	if room != nil && old != name && !full {
+		client.room = name
+		room.members++
+		if r, ok := s.rooms[old]; ok {
+			r.leave()
+		}
+	}
+	s.clientsMutex.Unlock()
+	s.roomsMutex.Unlock()
+
+	// An empty room can be cleaned up between /join finding it and now
+	if room == nil {
+		client.printf("No such room: %s\n", name)
+		return
+	}
+	if old == name {
+		client.printf("You're already in %s.\n", name)
+		return
+	}
+	if full {
+		client.printf("%s is full. Please try again later.\n", name)
+		return
+	}
+	s.broadcastRoom(old, fmt.Sprintf("%s has left %s", client.username, old), client)
+	s.broadcastRoom(name, fmt.Sprintf("%s has joined %s", client.username, name), client)
+	client.printf("You joined %s.\n", name)
+	s.sendTopic(client, name)
+}
+
+// whoami tells client about its own session.
+func (s *Server) whoami(client *Client) {
+	s.clientsMutex.Lock()
+	room, away, admin := client.room, client.away, client.admin
+	s.clientsMutex.Unlock()
+
+	awayStatus := "no"
+	if away != "" {
+		awayStatus = "yes (" + away + ")"
+	}
+	adminStatus := "no"
+	if admin {
+		adminStatus = "yes"
+	}
+	client.printf("Username: %s\n", client.username)
+	client.printf("Room: %s\n", room)
+	client.printf("Away: %s\n", awayStatus)
+	client.printf("Admin: %s\n", adminStatus)
+	if client.ephemeral {
+		client.println("Session: ephemeral")
+	} else {
+		client.println("Session: durable")
+	}
+	client.printf("Session started: %s\n", client.connectedAt.UTC().Format("2006-01-02 15:04:05 MST"))
+}
+
+// setAway marks client away with the given message, or back if it's empty.
+func (s *Server) setAway(client *Client, message string) {
+	s.clientsMutex.Lock()
+	client.away = message
+	s.clientsMutex.Unlock()
+
+	if message == "" {
+		client.println("You are no longer away.")
+	} else {
+		client.printf("You are now away: %s\n", message)
+	}
+}
+
+// listOnline returns the "/who" reply: every logged-in username, on one line
+// so clients can parse it.
+func (s *Server) listOnline() string {
+	s.clientsMutex.Lock()
+	// A user is idle only if none of their sessions has been active lately
+	idle := make(map[string]bool)
+	for _, client := range s.clients {
+		quiet := s.config.IdleAfter > 0 && time.Since(client.lastActive) >= s.config.IdleAfter
+		if wasIdle, seen := idle[client.username]; !seen || wasIdle {
+			idle[client.username] = quiet
+		}
+	}
+	s.clientsMutex.Unlock()
+
+	names := make([]string, 0, len(idle))
+	for name := range idle {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if idle[name] {
+			names[i] += " (idle)"
+		}
+	}
+	return "Online: " + strings.Join(names, ", ")
+}
+
+// sendPrivate delivers a private message to every session of the named
+// user, echoing it back to the sender so they see what was sent.
+func (s *Server) sendPrivate(from *Client, to, body string) {
+	s.logMessage(from, to, body)
+	s.clientsMutex.Lock()
+	blocked := s.blocks[to][from.username]
+	var sessions []*Client
+	for _, client := range s.clients {
+		if client.username == to && !blocked {
+			sessions = append(sessions, client)
+		}
+	}
+	if len(sessions) > 0 {
+		s.markUnread(to, from.username)
+	}
+	s.clientsMutex.Unlock()
+
+	if blocked {
+		from.printf("Your message to %s could not be delivered.\n", to)
+		return
+	}
+	if len(sessions) == 0 {
+		s.queuePrivate(from, to, body)
+		return
+	}
+	for _, client := range sessions {
+		s.deliver(client, fmt.Sprintf("[PM from %s] %s", from.username, body))
+	}
+	from.printf("[PM to %s (delivered)] %s\n", to, body)
+}
+
+// markUnread records that recipient has an unacknowledged PM from sender.
+// The caller must hold clientsMutex.
+func (s *Server) markUnread(recipient, sender string) {
+	if s.unread[recipient] == nil {
+		s.unread[recipient] = make(map[string]bool)
+	}
+	s.unread[recipient][sender] = true
+}
+
+// markRead handles /read: client acknowledges the PMs it has received from
+// sender, who gets a read receipt. Receipts are only sent for PMs actually
+// delivered, so /read can't be used to pester arbitrary users.
+func (s *Server) markRead(client *Client, sender string) {
+	s.clientsMutex.Lock()
+	unread := s.unread[client.username][sender]
+	delete(s.unread[client.username], sender)
+	s.clientsMutex.Unlock()
+	if !unread {
+		return
+	}
+	for _, other := range s.recipients(func(other *Client) bool { return other.username == sender }) {
+		s.deliver(other, fmt.Sprintf("[PM read by %s]", client.username))
+	}
+}
+
+// setBlocked adds or removes username from client's block list. Blocked
+// users' messages, PMs and notices never reach any of client's sessions.
+func (s *Server) setBlocked(client *Client, username string, blocked bool) {
+	if username == client.username {
+		client.println("You can't block yourself.")
+		return
+	}
+
+	s.clientsMutex.Lock()
+	if blocked {
+		if s.blocks[client.username] == nil {
+			s.blocks[client.username] = make(map[string]bool)
+		}
+		s.blocks[client.username][username] = true
+	} else {
+		delete(s.blocks[client.username], username)
+	}
+	s.clientsMutex.Unlock()
+
+	if blocked {
+		client.printf("Blocked %s.\n", username)
+	} else {
+		client.printf("Unblocked %s.\n", username)
+	}
+}
+
+// hasBlocked reports whether blocker has blocked username.
+func (s *Server) hasBlocked(blocker, username string) bool {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	return s.blocks[blocker][username]
+}
+
+// listRooms returns the "/rooms" reply: every public room with its member
+// count, on one line so clients can parse it. Whisper rooms are unlisted.
+func (s *Server) listRooms() string {
+	s.roomsMutex.Lock()
+	names := make([]string, 0, len(s.rooms))
+	for name, room := range s.rooms {
+		if !room.ephemeral {
+			names = append(names, name)
+		}
+	}
+	s.roomsMutex.Unlock()
+	sort.Strings(names)
+
+	counts := make(map[string]int)
+	s.clientsMutex.Lock()
+	for _, client := range s.clients {
+		counts[client.room]++
+	}
+	s.clientsMutex.Unlock()
+
+	entries := make([]string, len(names))
+	for i, name := range names {
+		entries[i] = fmt.Sprintf("%s (%d)", name, counts[name])
+	}
+	return "Rooms: " + strings.Join(entries, ", ")
+}
+
+// isAdmin reports whether client currently holds admin rights. The flag can
+// change while the client is online (see /promote), so read it under lock.
+func (s *Server) isAdmin(client *Client) bool {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	return client.admin
+}
+
+// maintenanceState returns whether maintenance mode is on and, if so,
+// whether non-admin messages are disabled too.
+func (s *Server) maintenanceState() (on, readOnly bool) {
+	s.maintenanceMutex.Lock()
+	defer s.maintenanceMutex.Unlock()
+	return s.maintenanceMode, s.maintenanceReadOnly
+}
+
+// maintenanceCommand handles "/maintenance on [readonly]|off" and returns the
+// reply for whoever issued it. With no arguments it reports the current state.
+func (s *Server) maintenanceCommand(args []string) string {
+	if len(args) == 0 {
+		on, readOnly := s.maintenanceState()
+		switch {
+		case readOnly:
+			return "Maintenance mode is on (read-only)."
+		case on:
+			return "Maintenance mode is on."
+		default:
+			return "Maintenance mode is off."
+		}
+	}
+
+	switch args[0] {
+	case "on":
+		readOnly := len(args) > 1 && args[1] == "readonly"
+		s.maintenanceMutex.Lock()
+		s.maintenanceMode, s.maintenanceReadOnly = true, readOnly
+		s.maintenanceMutex.Unlock()
+		log.Printf("Maintenance mode enabled (read-only: %v)", readOnly)
+		s.broadcast("Server is entering maintenance. New logins are paused.", nil)
+		return "Maintenance mode enabled."
+	case "off":
+		s.maintenanceMutex.Lock()
+		s.maintenanceMode, s.maintenanceReadOnly = false, false
+		s.maintenanceMutex.Unlock()
+		log.Println("Maintenance mode disabled")
+		s.broadcast("Server maintenance is over.", nil)
+		return "Maintenance mode disabled."
+	default:
+		return "Usage: /maintenance on [readonly]|off"
+	}
+}
+
+// promoteUser grants admin rights to a registered user, including any of
+// their sessions that are currently online.
+func (s *Server) promoteUser(username string) error {
+	res, err := s.db.Exec("UPDATE users SET admin = 1 WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user %q", username)
+	}
+
+	s.accountsMutex.Lock()
+	s.hasAdmin = true
+	s.accountsMutex.Unlock()
+
+	s.clientsMutex.Lock()
+	for _, client := range s.clients {
+		if client.username == username {
+			client.admin = true
+		}
+	}
+	s.clientsMutex.Unlock()
+	return nil
+}
+
+// approveCommand handles "/approve [username]": with a username it lets that
+// pending account log in, and on its own it lists the pending accounts.
+func (s *Server) approveCommand(args []string) string {
+	switch len(args) {
+	case 0:
+		rows, err := s.db.Query("SELECT username FROM users WHERE approved = 0 ORDER BY id")
+		if err != nil {
+			log.Printf("Failed to list pending accounts: %v", err)
+			return "Failed to list pending accounts."
+		}
+		defer rows.Close()
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				log.Printf("Failed to list pending accounts: %v", err)
+				return "Failed to list pending accounts."
+			}
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return "No accounts are awaiting approval."
+		}
+		return "Awaiting approval: " + strings.Join(names, ", ")
+	case 1:
+		res, err := s.db.Exec("UPDATE users SET approved = 1 WHERE username = ? AND approved = 0", args[0])
+		if err != nil {
+			log.Printf("Failed to approve %s: %v", args[0], err)
+			return "Failed to approve " + args[0] + "."
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return "No account " + args[0] + " is awaiting approval."
+		}
+		log.Printf("Approved %s", args[0])
+		return "Approved " + args[0] + "; they can now log in."
+	default:
+		return "Usage: /approve [username]"
+	}
+}
+
+// runConsole reads operator commands from the server's terminal. The console
+// has full admin rights; it is also the only way to create the first admin.
+func (s *Server) runConsole(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "/maintenance":
+			log.Println(s.maintenanceCommand(fields[1:]))
+		case "/export":
+			log.Println(s.exportCommand(fields[1:]))
+		case "/invite":
+			log.Println(s.inviteCommand(fields[1:]))
+		case "/approve":
+			log.Println(s.approveCommand(fields[1:]))
+		case "/group":
+			log.Println(s.groupCommand(fields[1:]))
+		case "/reports":
+			log.Println(s.reportsCommand(fields[1:]))
+		case "/announce":
+			if len(fields) < 2 {
+				log.Println("Usage: /announce <markdown>")
+				continue
+			}
+			s.announce(strings.Join(fields[1:], " "))
+		case "/restart":
+			s.restartCommand(fields[1:])
+		case "/promote":
+			if len(fields) != 2 {
+				log.Println("Usage: /promote <username>")
+				continue
+			}
+			if err := s.promoteUser(fields[1]); err != nil {
+				log.Printf("Failed to promote %s: %v", fields[1], err)
+				continue
+			}
+			log.Printf("%s is now an admin", fields[1])
+		default:
+			log.Printf("Unknown console command: %s", fields[0])
+		}
+	}
+}
+
+// broadcast sends the message to all connected clients except the sender
+func (s *Server) broadcast(message string, sender net.Conn) {
+	for _, client := range s.recipients(func(client *Client) bool { return client.conn != sender }) {
+		s.deliver(client, message)
+	}
+}
+
+// recipients returns the logged-in clients for which keep reports true,
+// which is called with clientsMutex held. Broadcasts write to the snapshot
+// after releasing the lock, so a slow client can't hold up logins and
+// logouts, and those can't change the set mid-send.
+//
+// The price is ordering: each sender's lines arrive in the order it sent
+// them, but two senders' broadcasts racing each other can reach recipients
+// interleaved differently, so there's no order across senders that every
+// client sees the same.
+func (s *Server) recipients(keep func(*Client) bool) []*Client {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	var list []*Client
+	for _, client := range s.clients {
+		if keep(client) {
+			list = append(list, client)
+		}
+	}
+	return list
+}
+
+// messageView is the data a -message-format template is executed with.
+type messageView struct {
+	Time string // local time the message was sent, as 15:04
+	Room string
+	From string
+	Body string
+}
+
+// parseMessageFormat parses a -message-format template and checks that it
+// renders, so typos in field names are caught at startup.
+func parseMessageFormat(text string) (*template.Template, error) {
+	tmpl, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	sample := messageView{Time: "12:00", Room: defaultRoom, From: "user", Body: "hello"}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// formatMessage renders one chat line with the configured message format.
+func (s *Server) formatMessage(sent time.Time, room, from, body string) string {
+	if s.config.MessageFormat == nil {
+		return fmt.Sprintf("%s: %s", from, body)
+	}
+	var line strings.Builder
+	view := messageView{Time: sent.Local().Format("15:04"), Room: room, From: from, Body: body}
+	if err := s.config.MessageFormat.Execute(&line, view); err != nil {
+		log.Printf("Failed to format message from %s: %v", from, err)
+		return fmt.Sprintf("%s: %s", from, body)
+	}
+	// A template must not be able to split one message over several lines.
+	return strings.ReplaceAll(line.String(), "\n", " ")
+}
+
+// broadcastRoom sends the message to every client in room except the sender
+// and anyone who has blocked the sender. A nil sender reaches everyone.
+func (s *Server) broadcastRoom(room, message string, sender *Client) {
+	keep := func(client *Client) bool {
+		if client == sender || client.room != room {
+			return false
+		}
+		return sender == nil || !s.blocks[client.username][sender.username]
+	}
+	for _, client := range s.recipients(keep) {
+		s.deliver(client, message)
+	}
+}
+
+// deliver writes a broadcast line to client, timing the write: one that
+// blocks holds up every other recipient, so clients whose writes keep
+// blocking are flagged as slow, and a write that can't finish within
+// WriteTimeout disconnects the client. The caller must not hold clientsMutex.
+// The client may have logged out since it was picked; the write then fails
+// on the closed connection and is dropped.
+func (s *Server) deliver(client *Client, message string) {
+	client.writeMutex.Lock()
+	if client.holding {
+		client.held = append(client.held, message)
+		client.writeMutex.Unlock()
+		return
+	}
+	start := time.Now()
+	if s.config.WriteTimeout > 0 {
+		client.conn.SetWriteDeadline(start.Add(s.config.WriteTimeout))
+	}
+	_, err := fmt.Fprintln(client.conn, message)
+	blocked := time.Since(start)
+	if s.config.WriteTimeout > 0 {
+		client.conn.SetWriteDeadline(time.Time{})
+	}
+	client.writeMutex.Unlock()
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		// Part of the line may have gone out, so the stream can't be resumed
+		log.Printf("[%s] Write to %s timed out after %s: disconnecting", client.id, client.username, s.config.WriteTimeout)
+		s.drop(client)
+		return
+	}
+	if s.config.SlowWrite <= 0 || blocked < s.config.SlowWrite {
+		return
+	}
+
+	s.clientsMutex.Lock()
+	client.slowWrites++
+	slowWrites := client.slowWrites
+	s.clientsMutex.Unlock()
+	log.Printf("[%s] Write to %s blocked for %s (%d so far)", client.id, client.username, blocked.Round(time.Millisecond), slowWrites)
+	if slowWrites != s.config.SlowWrites {
+		return
+	}
+	if s.config.SlowDisconnect {
+		log.Printf("[%s] Slow client %s: disconnecting", client.id, client.username)
+		s.drop(client)
+	} else {
+		log.Printf("[%s] Slow client %s", client.id, client.username)
+	}
+}
+
+// printf writes a reply, notice or prompt of the client's own to conn under
+// writeMutex, so it can't be interleaved with a broadcast to the same
+// client. Unlike deliver it ignores holding: before the client goes live,
+// these are its welcome and history, which come before what's held. Every
+// write to a logged-in client goes through here or deliver.
+func (c *Client) printf(format string, args ...any) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	fmt.Fprintf(c.conn, format, args...)
+}
+
+// println is printf for a line of operands, like fmt.Println.
+func (c *Client) println(args ...any) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	fmt.Fprintln(c.conn, args...)
+}
+
+// goLive ends a new client's replay: it marks the start of live messages,
+// then writes what was broadcast to the client since it was added.
+func (s *Server) goLive(client *Client) {
+	room := s.currentRoom(client)
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	if s.config.WriteTimeout > 0 {
+		client.conn.SetWriteDeadline(time.Now().Add(s.config.WriteTimeout))
+		defer client.conn.SetWriteDeadline(time.Time{})
+	}
+	fmt.Fprintf(client.conn, "--- now live in %s ---\n", room)
+	for _, line := range client.held {
+		fmt.Fprintln(client.conn, line)
+	}
+	client.holding, client.held = false, nil
+}
+
+// drop disconnects client from outside its read loop. The loop sees the
+// closed connection and cleans up, but lines already buffered could still be
+// read first, so client is marked for the loop to stop at (see connected).
+func (s *Server) drop(client *Client) {
+	s.clientsMutex.Lock()
+	client.dropped = true
+	s.clientsMutex.Unlock()
+	client.conn.Close()
+}
+
+// connected reports whether client is still logged in: in clients and not
+// dropped. Nothing it sends is acted on otherwise.
+func (s *Server) connected(client *Client) bool {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	_, ok := s.clients[client.conn]
+	return ok && !client.dropped
+}
+
+// Serve accepts connections on ln until it is closed, handling each one in
+// its own goroutine.
+func (s *Server) Serve(ln net.Listener) error {
+	s.listenersMutex.Lock()
+	s.listeners = append(s.listeners, ln)
+	s.listenersMutex.Unlock()
+
+	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue
 		}
-		go handleClient(conn)
+		s.configureConn(conn)
+		go s.handleClient(conn)
+	}
+}
+
+// restartPrefix starts the control line sent before a restart, followed by
+// the seconds until the server expects to be back. Clients that understand
+// it reconnect on their own after that long.
+const restartPrefix = "[restart] "
+
+// Shutdown stops every Serve loop, then sends every logged-in client
+// notice, followed by the restart signal when restartIn is positive, and
+// closes their connections. Like broadcasts, the notices are written outside
+// clientsMutex, each client in its own goroutine, so one that's slow to read
+// holds up neither the others nor its own disconnection for longer than
+// WriteTimeout.
+func (s *Server) Shutdown(notice string, restartIn time.Duration) {
+	s.listenersMutex.Lock()
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.listenersMutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, client := range s.recipients(func(*Client) bool { return true }) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliver(client, notice)
+			if restartIn > 0 {
+				s.deliver(client, fmt.Sprintf("%s%d", restartPrefix, int(restartIn.Round(time.Second).Seconds())))
+			}
+			s.drop(client)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *Server) restartCommand(args []string) {
+	delay := 10 * time.Second
+	if len(args) > 0 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d < time.Second {
+			log.Println("Usage: /restart [reconnect delay, at least 1s]")
+			return
+		}
+		delay = d
+	}
+	log.Printf("Restarting; clients will reconnect in %s", delay)
+	s.Shutdown(fmt.Sprintf("Server restarting. Reconnect in ~%s.", delay), delay)
+}
+
+// configureConn applies TCP keepalive to an accepted connection so that
+// half-open peers (e.g. after a router reboot) are detected and reaped even
+// when no data flows. The idle timeout covers the application level.
+func (s *Server) configureConn(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tcpConn.SetKeepAliveConfig(s.config.KeepAlive); err != nil {
+		log.Printf("Failed to configure keepalive for %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench-hash" {
+		benchHash(os.Args[2:])
+		return
+	}
+
+	var config Config
+	flag.DurationVar(&config.IdleTimeout, "idle-timeout", 0, "disconnect clients idle for this long (0 disables)")
+	flag.DurationVar(&config.IdleWarning, "idle-warning", 30*time.Second, "warn idle clients this long before disconnecting them")
+	flag.DurationVar(&config.KeepAlive.Idle, "keepalive", 30*time.Second, "idle time before TCP keepalive probes start (0 disables keepalive)")
+	flag.DurationVar(&config.KeepAlive.Interval, "keepalive-interval", 10*time.Second, "time between TCP keepalive probes")
+	flag.IntVar(&config.KeepAlive.Count, "keepalive-count", 3, "unanswered TCP keepalive probes before the connection is dropped")
+	flag.DurationVar(&config.MessageTimeout, "message-timeout", 10*time.Second, "max time for a client to finish sending a message once started")
+	flag.StringVar(&config.Greeting, "greeting", "", "extra greeting sent to users after login ({user} is replaced by their name)")
+	flag.BoolVar(&config.LogContent, "log-content", false, "include message bodies in the log (by default only sender, recipient and size are)")
+	flag.BoolVar(&config.SilentJoins, "silent-joins", false, "don't announce users joining or leaving the chat to their room")
+	flag.BoolVar(&config.FirstAdmin, "first-admin", false, "make the first account registered while no admin exists an admin")
+	flag.BoolVar(&config.RequireApproval, "require-approval", false, "registered accounts can't log in until an admin runs /approve (invited ones are approved)")
+	flag.BoolVar(&config.InviteSingleUse, "invite-single-use", false, "record redeemed invite tokens and refuse their reuse, rather than keeping invites stateless")
+	flag.IntVar(&config.RegCodeTries, "reg-code-attempts", 3, "registration code attempts allowed before disconnecting")
+	flag.IntVar(&config.ChoiceTries, "choice-attempts", 3, "attempts at answering 'login' or 'register' before disconnecting (0 is unlimited, within -handshake-lines)")
+	flag.DurationVar(&config.IdleAfter, "idle-after", 5*time.Minute, "silence after which /who shows a user as idle (0 disables)")
+	flag.IntVar(&config.MaxRooms, "max-rooms", 100, "rooms that may exist at once, including #general (0 is unlimited)")
+	flag.IntVar(&config.MaxAccounts, "max-accounts", 0, "registered accounts allowed; further registrations are refused (0 is unlimited)")
+	flag.IntVar(&config.MaxSessions, "max-sessions", 0, "simultaneous logins allowed per user, e.g. 3 devices (0 is unlimited)")
+	flag.IntVar(&config.MaxRoomMembers, "max-room-members", 0, "clients allowed in one room (0 is unlimited); logins always land in their room")
+	flag.DurationVar(&config.EditWindow, "edit-window", 15*time.Minute, "how long after sending users may /edit or /delete their messages (0 disables; moderators can always delete)")
+	flag.DurationVar(&config.RoomIdle, "room-idle", 0, "remove rooms users made after they've been empty this long (0 keeps them)")
+	flag.DurationVar(&config.SlowWrite, "slow-write", time.Second, "broadcast write duration that counts as blocked by a slow client (0 disables detection)")
+	flag.IntVar(&config.SlowWrites, "slow-writes", 3, "blocked writes after which a client is logged as slow")
+	flag.BoolVar(&config.SlowDisconnect, "slow-disconnect", false, "disconnect clients once they're flagged as slow")
+	flag.DurationVar(&config.WriteTimeout, "write-timeout", 10*time.Second, "disconnect a client when a broadcast write to it blocks this long (0 is unlimited)")
+	flag.IntVar(&config.ProtocolErrors, "protocol-errors", 5, "malformed lines tolerated per connection before disconnecting (0 is unlimited)")
+	flag.IntVar(&config.MaxMessage, "max-message", 0, "longest room message or PM in characters (0 is unlimited)")
+	oversizePolicy := flag.String("oversize-policy", "reject", "what to do with messages over -max-message: reject or truncate")
+	flag.IntVar(&config.HashIterations, "hash-iterations", defaultHashIterations, "PBKDF2 iterations for new password hashes; time them with the bench-hash subcommand")
+	flag.IntVar(&config.RegisterLimit, "register-limit", 5, "registration attempts allowed per IP per -register-window (0 is unlimited)")
+	flag.DurationVar(&config.RegisterWindow, "register-window", time.Hour, "window for -register-limit")
+	flag.DurationVar(&config.AuthDelay, "auth-delay", time.Second, "wait before answering a failed login, doubled for each recent failure from the same IP or for the same user (0 disables)")
+	flag.DurationVar(&config.AuthDelayMax, "auth-delay-max", 30*time.Second, "longest -auth-delay grows to (at or below -auth-delay keeps it flat)")
+	flag.DurationVar(&config.GreetDelay, "greet-delay", 0, "wait this long before sending a new connection the banner, closing it if it sends anything first, to slow down scanners (0 disables)")
+	flag.IntVar(&config.AbandonLimit, "abandon-limit", 0, "connections one IP may close before choosing login or register per -abandon-window; further ones are refused (0 is unlimited)")
+	flag.DurationVar(&config.AbandonWindow, "abandon-window", time.Minute, "window for -abandon-limit")
+	flag.IntVar(&config.HandshakeBytes, "handshake-bytes", 4096, "bytes a connection may send before logging in (0 is unlimited)")
+	flag.IntVar(&config.HandshakeLines, "handshake-lines", 10, "lines a connection may send before logging in (0 is unlimited)")
+	flag.DurationVar(&config.HandshakeTime, "handshake-timeout", time.Minute, "time a connection has to log in or register before it's closed (0 is unlimited)")
+	flag.IntVar(&config.OfflineCap, "offline-message-cap", 20, "private messages queued per offline user (0 disables queuing)")
+	flag.BoolVar(&config.Persist, "persist-messages", true, "keep room messages (in memory) for history replay and /export")
+	flag.IntVar(&config.HistoryLines, "history-lines", 20, "recent room messages replayed to users after login (0 disables)")
+	flag.StringVar(&config.ExportDir, "export-dir", ".", "directory that /export writes history files into")
+	metricsAddr := flag.String("metrics-addr", "", "address for the Prometheus metrics endpoint, e.g. localhost:9100 (empty disables it)")
+	flag.IntVar(&config.MetricsUsers, "metrics-users", 0, "users tracked with their own metrics series (0 disables per-user metrics)")
+	uploadAddr := flag.String("upload-addr", "", "address for the HTTP file upload endpoint, e.g. :9001 (empty disables uploads)")
+	flag.StringVar(&config.UploadURL, "upload-url", "", "public base URL of the upload endpoint (default http://<upload-addr>, with localhost for an empty host)")
+	flag.StringVar(&config.UploadDir, "upload-dir", "uploads", "directory uploaded files are stored in")
+	flag.Int64Var(&config.UploadMax, "upload-max", 10<<20, "largest file upload accepted, in bytes")
+	flag.Int64Var(&config.UploadUserQuota, "upload-quota", 50<<20, "bytes of uploads one user may have stored at once (0 is unlimited)")
+	flag.Int64Var(&config.UploadTotalQuota, "upload-total", 1<<30, "bytes of uploads stored at once in all (0 is unlimited)")
+	flag.DurationVar(&config.UploadTTL, "upload-ttl", 7*24*time.Hour, "delete uploads this long after they're stored (0 keeps them)")
+	uploadTimeout := flag.Duration("upload-timeout", 5*time.Minute, "time allowed to send an upload's request, or a download's response, in full")
+	flag.StringVar(&config.CommandPrefix, "command-prefix", "/", "what commands start with, e.g. ! so messages can start with /; send it twice to start a message with it")
+	sessions := flag.String("sessions", "durable", "kinds of session users may log in with: durable, choice ('login ephemeral' opts out of history and logging) or ephemeral")
+	roomPersistence := flag.String("room-persistence", "", "how given rooms' messages are kept, e.g. #ops=none,#hr=encrypted (plain is the default)")
+	roleRooms := flag.String("role-rooms", "", "rooms users land in after login by role, e.g. admin=#mods,user=#general")
+	messageFormat := flag.String("message-format", "", "Go template for chat lines, e.g. '{{.Time}} <{{.From}}> {{.Body}}'")
+	bannerFile := flag.String("banner", "", "file with ASCII art to show clients on connect")
+	flag.BoolVar(&config.BannerStatus, "banner-status", false, "add the number of users online and whether registration is open to the banner")
+	motdFile := flag.String("motd", "", "Markdown file sent to users after they log in")
+	var listens []listenSpec
+	flag.Func("listen", "address to accept chat clients on, e.g. localhost:9000; repeat for several, and add ,cert=FILE,key=FILE for TLS (default "+defaultListenAddr+")", func(value string) error {
+		spec, err := parseListenSpec(value)
+		if err == nil {
+			listens = append(listens, spec)
+		}
+		return err
+	})
+	flag.Parse()
+	config.KeepAlive.Enable = config.KeepAlive.Idle > 0
+
+	switch *oversizePolicy {
+	case "reject":
+	case "truncate":
+		config.TruncateLong = true
+	default:
+		log.Fatalf("Invalid -oversize-policy %q: want reject or truncate", *oversizePolicy)
+	}
+
+	rooms, err := parseRoleRooms(*roleRooms)
+	if err != nil {
+		log.Fatalf("Invalid -role-rooms: %v", err)
+	}
+	config.RoleRooms = rooms
+	if config.RoomPersistence, err = parseRoomPersistence(*roomPersistence); err != nil {
+		log.Fatalf("Invalid -room-persistence: %v", err)
+	}
+	if config.Sessions, err = parseSessionPolicy(*sessions); err != nil {
+		log.Fatalf("Invalid -sessions: %v", err)
+	}
+	if config.CommandPrefix == "" || !wellFormed(config.CommandPrefix) || strings.ContainsFunc(config.CommandPrefix, unicode.IsSpace) {
+		log.Fatalf("Invalid -command-prefix %q: want one or more characters, without spaces", config.CommandPrefix)
+	}
+
+	if *messageFormat != "" {
+		if config.MessageFormat, err = parseMessageFormat(*messageFormat); err != nil {
+			log.Fatalf("Invalid -message-format: %v", err)
+		}
+	}
+
+	if *bannerFile != "" {
+		banner, err := os.ReadFile(*bannerFile)
+		if err != nil {
+			log.Fatalf("Failed to read banner: %v", err)
+		}
+		config.Banner = string(banner)
+	}
+	if *motdFile != "" {
+		motd, err := os.ReadFile(*motdFile)
+		if err != nil {
+			log.Fatalf("Failed to read MOTD: %v", err)
+		}
+		config.MOTD = string(motd)
+	}
+
+	// Uploads only work while this process serves the endpoint
+	if *uploadAddr == "" {
+		config.UploadURL = ""
+	} else {
+		if config.UploadURL == "" {
+			host, port, err := net.SplitHostPort(*uploadAddr)
+			if err != nil {
+				log.Fatalf("Invalid -upload-addr: %v", err)
+			}
+			if host == "" {
+				host = "localhost"
+			}
+			config.UploadURL = "http://" + net.JoinHostPort(host, port)
+		}
+		config.UploadURL = strings.TrimSuffix(config.UploadURL, "/")
+		if err := os.MkdirAll(config.UploadDir, 0700); err != nil {
+			log.Fatalf("Failed to create upload directory: %v", err)
+		}
+	}
+
+	// Generate ephemeral encryption key
+	db, err := openDatabase(generateEncryptionKey())
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+
+	// Also generate a master registration key on startup
+	masterRegKey := generateRegistrationKey()
+	server := NewServer(config, db, masterRegKey)
+
+	log.Println("Secure (SQLCipher) chat server started.")
+	log.Println("Encryption Key generated on startup. Database is ephemeral.")
+	log.Printf("Registration Key for new signups: %s\n", masterRegKey)
+
+	if len(listens) == 0 {
+		listens = []listenSpec{{addr: defaultListenAddr}}
+	}
+	var listeners []net.Listener
+	for _, spec := range listens {
+		ln, err := spec.listen()
+		if err != nil {
+			log.Fatalf("Error listening on %s: %v", spec.addr, err)
+		}
+		listeners = append(listeners, ln)
+		log.Printf("Accepting chat clients on %s", spec)
+	}
+
+	go server.runConsole(os.Stdin)
+	if *uploadAddr != "" && config.UploadTTL > 0 {
+		go server.cleanupUploads()
+	}
+	if config.RoomIdle > 0 {
+		go server.cleanupRooms()
+	}
+
+	// On SIGINT/SIGTERM, say goodbye instead of just dropping everyone
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s; shutting down", sig)
+		server.Shutdown("Server shutting down.", 0)
+	}()
+
+	if *uploadAddr != "" {
+		// A whole file is read or written within the timeout, so a client
+		// trickling one can't hold a connection open indefinitely
+		uploads := &http.Server{
+			Addr:              *uploadAddr,
+			Handler:           server.uploadHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       *uploadTimeout,
+			WriteTimeout:      *uploadTimeout,
+			IdleTimeout:       time.Minute,
+		}
+		go func() {
+			log.Fatalf("Upload endpoint failed: %v", uploads.ListenAndServe())
+		}()
+		log.Printf("Accepting file uploads at %s", config.UploadURL)
+	}
+	if *metricsAddr != "" {
+		metrics := &http.Server{
+			Addr:              *metricsAddr,
+			Handler:           server.metricsHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       time.Minute,
+		}
+		go func() {
+			log.Fatalf("Metrics endpoint failed: %v", metrics.ListenAndServe())
+		}()
+		log.Printf("Serving metrics at http://%s/metrics", *metricsAddr)
+	}
+
+	// Every listener feeds the same server; Shutdown closes them all
+	var wg sync.WaitGroup
+	for _, ln := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.Serve(ln)
+		}()
 	}
+	wg.Wait()
 }
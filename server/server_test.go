@@ -0,0 +1,1527 @@
+// server_test.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The harness runs a Server in-process on a fresh in-memory database,
+// serving a pipeListener, and scripts clients over it, so a test goes
+// through Serve and exactly the lines a real client would see. Every test
+// gets its own server.
+
+const (
+	testRegKey   = "0123456789abcdef0123"
+	testPassword = "correct horse"
+	testTimeout  = 5 * time.Second
+)
+
+// testServer is a Server under test, serving connections made with dial
+// over ln.
+type testServer struct {
+	*Server
+	ln *pipeListener
+}
+
+// newTestServer returns a server for t with the given config. Password
+// hashes are made cheap unless the config says otherwise, since every
+// registration and login hashes one.
+func newTestServer(t *testing.T, config Config) *testServer {
+	t.Helper()
+	if config.HashIterations == 0 {
+		config.HashIterations = 1000
+	}
+	db, err := openDatabase(generateEncryptionKey())
+	if err != nil {
+		t.Fatalf("openDatabase: %v", err)
+	}
+	s := &testServer{Server: NewServer(config, db, testRegKey), ln: newPipeListener()}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(s.ln) }()
+	t.Cleanup(func() {
+		s.Shutdown("Test over.", 0)
+		// In case Serve hadn't got as far as listing it for Shutdown
+		s.ln.Close()
+		if err := <-served; !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Serve returned %v, want net.ErrClosed", err)
+		}
+		db.Close()
+	})
+	return s
+}
+
+// testConn is the scripted end of one connection to a test server. Lines
+// from the server are read as they come, so the server never blocks on the
+// pipe, and handed to the test in order.
+type testConn struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+}
+
+// dial connects a new scripted client to s.
+func (s *testServer) dial(t *testing.T) *testConn {
+	t.Helper()
+	conn, err := s.ln.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return newTestConn(t, conn)
+}
+
+func newTestConn(t *testing.T, conn net.Conn) *testConn {
+	c := &testConn{t: t, conn: conn, lines: make(chan string, 1000)}
+	go func() {
+		defer close(c.lines)
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+	}()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// send writes line to the server, failing the test if it can't.
+func (c *testConn) send(line string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatalf("send %q: %v", line, err)
+	}
+}
+
+// until reads lines up to the first containing want and returns them, that
+// one last. It fails the test if none arrives in time.
+func (c *testConn) until(want string) []string {
+	c.t.Helper()
+	var seen []string
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %q; got %q", want, seen)
+			}
+			seen = append(seen, line)
+			if strings.Contains(line, want) {
+				return seen
+			}
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for %q; got %q", want, seen)
+		}
+	}
+}
+
+// expect reads lines up to the first containing want and returns it.
+func (c *testConn) expect(want string) string {
+	c.t.Helper()
+	seen := c.until(want)
+	return seen[len(seen)-1]
+}
+
+// expectClosed reads the remaining lines until the server closes the
+// connection, and returns them.
+func (c *testConn) expectClosed() []string {
+	c.t.Helper()
+	var seen []string
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				return seen
+			}
+			seen = append(seen, line)
+		case <-timeout:
+			c.t.Fatalf("timed out waiting for the connection to close; got %q", seen)
+		}
+	}
+}
+
+// register registers a new account with the registration code and
+// testPassword, and returns its generated username.
+func register(t *testing.T, s *testServer) string {
+	t.Helper()
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	c.expect("registration code")
+	c.send(testRegKey)
+	username := strings.TrimPrefix(c.expect("Your randomly generated username is: "), "Your randomly generated username is: ")
+	c.expect("Enter your desired password")
+	c.send(testPassword)
+	c.expect("Registration successful!")
+	return username
+}
+
+// login logs username in with testPassword and returns the connection once
+// it's live in the chat.
+func login(t *testing.T, s *testServer, username string) *testConn {
+	t.Helper()
+	c := tryLogin(t, s, username)
+	c.expect("--- now live in ")
+	return c
+}
+
+// tryLogin answers the login prompts as username with testPassword and
+// returns the connection, leaving the server's answer to the test. The
+// five-second throttle between logins as the same user is reset first, so
+// tests can log a user in again straight away.
+func tryLogin(t *testing.T, s *testServer, username string) *testConn {
+	t.Helper()
+	return tryLoginWith(t, s, username, testPassword)
+}
+
+// tryLoginWith is tryLogin with the given password or token.
+func tryLoginWith(t *testing.T, s *testServer, username, secret string) *testConn {
+	t.Helper()
+	delete(s.loginAttempts, username)
+
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("login")
+	c.expect("Username:")
+	c.send(username)
+	c.expect("Password")
+	c.send(secret)
+	return c
+}
+
+// waitFor polls cond until it's true, failing the test after testTimeout.
+// It's for server state that changes after the last line a test can wait
+// for.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRegisterLoginChat(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob := register(t, s), register(t, s)
+
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	a.expect(bob + " has joined the chat")
+
+	a.send("hello, bob")
+	b.expect(alice + ": hello, bob")
+
+	b.send("/who")
+	online := b.expect("Online: ")
+	if !strings.Contains(online, alice) || !strings.Contains(online, bob) {
+		t.Errorf("/who = %q, want both users", online)
+	}
+}
+
+func TestTrickledMessageIsDropped(t *testing.T) {
+	s := newTestServer(t, Config{MessageTimeout: 200 * time.Millisecond})
+	c := login(t, s, register(t, s))
+
+	// One byte every 100ms never finishes a line within the timeout
+	for _, b := range []byte("slow") {
+		if _, err := c.conn.Write([]byte{b}); err != nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.expectClosed()
+	waitFor(t, "the client to be removed", func() bool {
+		s.clientsMutex.Lock()
+		defer s.clientsMutex.Unlock()
+		return len(s.clients) == 0
+	})
+}
+
+func TestMaintenanceRefusesLogins(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+
+	s.maintenanceCommand([]string{"on"})
+	a.expect("Server is entering maintenance")
+	tryLogin(t, s, bob).expect("Server in maintenance. Please try again later.")
+
+	// The session that was already on carries on
+	a.send("/who")
+	a.expect("Online: " + alice)
+
+	s.maintenanceCommand([]string{"off"})
+	a.expect("Server maintenance is over.")
+	login(t, s, bob)
+}
+
+func TestReadOnlyMaintenance(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	s.maintenanceCommand([]string{"on", "readonly"})
+
+	for _, line := range []string{"hello", "/msg " + alice + " psst"} {
+		b.send(line)
+		b.expect("Messages are disabled during maintenance.")
+	}
+	s.maintenanceCommand([]string{"off"})
+	b.send("/msg " + alice + " psst")
+	for _, line := range a.until("psst") {
+		if strings.Contains(line, "hello") {
+			t.Errorf("%s got %q during read-only maintenance", alice, line)
+		}
+	}
+}
+
+func TestWhisperRoom(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	a.send("kept")
+	b.expect(alice + ": kept")
+	a.send("/create #secret hunter2")
+	a.expect("You joined #secret.")
+
+	b.send("/join #secret wrong")
+	b.expect("Wrong password for #secret.")
+	b.send("/join #secret hunter2")
+	b.expect("You joined #secret.")
+	a.expect(bob + " has joined #secret")
+
+	b.send("psst")
+	a.expect(bob + ": psst")
+	// Stored by the time bob's next command is answered
+	b.send("/who")
+	b.expect("Online: ")
+
+	var general, secret int
+	s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE room = '#general'").Scan(&general)
+	s.db.QueryRow("SELECT COUNT(*) FROM messages WHERE room = '#secret'").Scan(&secret)
+	if general != 1 || secret != 0 {
+		t.Errorf("stored %d messages in #general and %d in #secret, want 1 and 0", general, secret)
+	}
+}
+
+// logBuffer collects what the server logs, for tests of what gets logged.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLog sends the log to a buffer until t ends. Connections take the
+// log's writer when they're opened, so it must be called before dialing.
+func captureLog(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	old := log.Writer()
+	log.SetOutput(b)
+	t.Cleanup(func() { log.SetOutput(old) })
+	return b
+}
+
+func TestRegisterWhenStorageFails(t *testing.T) {
+	s := newTestServer(t, Config{})
+	logs := captureLog(t)
+	if _, err := s.db.Exec("PRAGMA query_only = ON"); err != nil {
+		t.Fatalf("make the database read-only: %v", err)
+	}
+
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	c.expect("registration code")
+	c.send(testRegKey)
+	c.expect("Enter your desired password")
+	c.send(testPassword)
+	c.expect("Registration temporarily unavailable. Please try again later.")
+
+	if got := logs.String(); !strings.Contains(got, "storage unavailable: attempt to write a readonly database") {
+		t.Errorf("log = %q, want the cause", got)
+	}
+}
+
+func TestSilentJoinsKeepGreeting(t *testing.T) {
+	s := newTestServer(t, Config{SilentJoins: true, Greeting: "Good to see you, {user}."})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+
+	b := tryLogin(t, s, bob)
+	b.expect("Welcome back, " + bob + "!")
+	b.expect("Good to see you, " + bob + ".")
+
+	// Bob's message comes after his join would have
+	b.send("hello")
+	for _, line := range a.until(bob + ": hello") {
+		if strings.Contains(line, "has joined") {
+			t.Errorf("alice got %q with silent joins", line)
+		}
+	}
+}
+
+func TestCustomAuthenticator(t *testing.T) {
+	var asked []string
+	auth := AuthenticatorFunc(func(username, secret string) (Account, error) {
+		asked = append(asked, username)
+		if username == "carol" && secret == "token-ok" {
+			return Account{Username: username}, nil
+		}
+		return Account{}, errInvalidCredentials
+	})
+	s := newTestServer(t, Config{Authenticator: auth})
+
+	tryLoginWith(t, s, "carol", "token-ok").expect("Welcome back, carol!")
+	tryLoginWith(t, s, "carol", "token-bad").expect("Invalid username or password.")
+	tryLoginWith(t, s, "dave", "token-ok").expect("Invalid username or password.")
+	if want := []string{"carol", "carol", "dave"}; strings.Join(asked, " ") != strings.Join(want, " ") {
+		t.Errorf("authenticator asked about %q, want %q", asked, want)
+	}
+}
+
+func TestBlockStopsMessagesAndPMs(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	a.expect(bob + " has joined the chat")
+
+	a.send("/block " + bob)
+	a.expect("Blocked " + bob + ".")
+
+	b.send("to the room")
+	b.send("/msg " + alice + " to you")
+	b.expect("Your message to " + alice + " could not be delivered.")
+
+	// Bob's lines would be on their way to alice before his answer
+	a.send("/who")
+	for _, line := range a.until("Online: ") {
+		if strings.Contains(line, "to the room") || strings.Contains(line, "to you") {
+			t.Errorf("alice got %q from a blocked user", line)
+		}
+	}
+
+	a.send("/unblock " + bob)
+	a.expect("Unblocked " + bob + ".")
+	b.send("/msg " + alice + " again")
+	a.expect("[PM from " + bob + "] again")
+}
+
+func TestBannerArrivesIntact(t *testing.T) {
+	art := "  ____ _           _   \r\n / ___| |__   __ _| |_ \n| |   |  _ \\ / _` | __|\n\n Username: not a prompt\n"
+	s := newTestServer(t, Config{Banner: art})
+	c := s.dial(t)
+	c.expect(bannerStart)
+	got := c.until(bannerEnd)
+	want := []string{"  ____ _           _   ", " / ___| |__   __ _| |_ ", "| |   |  _ \\ / _` | __|", "", " Username: not a prompt", bannerEnd}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("banner = %q, want %q", got, want)
+	}
+	c.expect("Welcome to the secure chat server!")
+}
+
+func TestLoginLineOrder(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true, HistoryLines: 10, Greeting: "Hello, {user}."})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	a.send("before")
+	a.send("/who")
+	a.expect("Online: ")
+
+	b := tryLogin(t, s, bob)
+	got := b.until("--- now live in #general ---")
+	var order []string
+	for _, line := range got {
+		for _, want := range []string{"Welcome back, " + bob + "!", "Hello, " + bob + ".", alice + ": before", "--- now live in"} {
+			if strings.Contains(line, want) {
+				order = append(order, want)
+			}
+		}
+	}
+	want := []string{"Welcome back, " + bob + "!", "Hello, " + bob + ".", alice + ": before", "--- now live in"}
+	if !slices.Equal(order, want) {
+		t.Errorf("login lines %q, want %q in that order", got, want)
+	}
+
+	// Live from the marker on
+	a.send("after")
+	if line := b.expect(": after"); !strings.HasSuffix(line, alice+": after") {
+		t.Errorf("first live line = %q, want alice's message", line)
+	}
+}
+
+func TestLinesHeldUntilLive(t *testing.T) {
+	s := newTestServer(t, Config{})
+	conn, end := net.Pipe()
+	c := newTestConn(t, end)
+	t.Cleanup(func() { conn.Close() })
+	client := &Client{id: "test", conn: conn, username: "bob", room: defaultRoom, holding: true}
+
+	// Sent while bob's history was being replayed
+	s.deliver(client, "alice: during the replay")
+	s.deliver(client, "carol has joined the chat")
+	go s.goLive(client)
+
+	got := c.until("carol has joined the chat")
+	want := []string{"--- now live in " + defaultRoom + " ---", "alice: during the replay", "carol has joined the chat"}
+	if !slices.Equal(got, want) {
+		t.Errorf("lines %q, want %q", got, want)
+	}
+}
+
+func TestIdleWarning(t *testing.T) {
+	s := newTestServer(t, Config{IdleTimeout: 400 * time.Millisecond, IdleWarning: 200 * time.Millisecond})
+	alice, bob := register(t, s), register(t, s)
+
+	a := login(t, s, alice)
+	a.expect("You'll be disconnected in 200ms due to inactivity.")
+	a.expectClosed()
+
+	// Anything sent after the warning starts the wait over
+	b := login(t, s, bob)
+	b.expect("You'll be disconnected in 200ms due to inactivity.")
+	b.send("/who")
+	b.expect("Online: ")
+	b.expect("You'll be disconnected in 200ms due to inactivity.")
+	b.send("/who")
+	b.expect("Online: ")
+}
+
+func TestRegistrationCodeRetries(t *testing.T) {
+	s := newTestServer(t, Config{RegCodeTries: 3})
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	c.expect("registration code")
+	c.send("wrong")
+	c.expect("Invalid registration code (attempts left: 2).")
+	c.send("still wrong")
+	c.expect("Invalid registration code (attempts left: 1).")
+	c.send(testRegKey)
+	username := strings.TrimPrefix(c.expect("Your randomly generated username is: "), "Your randomly generated username is: ")
+	c.expect("Enter your desired password")
+	c.send(testPassword)
+	c.expect("Registration successful!")
+	login(t, s, username)
+
+	// Out of attempts
+	c = s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	for range 3 {
+		c.expect("registration code")
+		c.send("wrong")
+	}
+	if got := c.expectClosed(); len(got) == 0 || got[len(got)-1] != "Invalid registration code. Closing connection." {
+		t.Errorf("last lines %q, want the connection closed", got)
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice := register(t, s)
+	a := login(t, s, alice)
+
+	a.send("/whoami")
+	got := a.until("Session started: ")
+	want := []string{"Username: " + alice, "Room: #general", "Away: no", "Admin: no", "Session: durable"}
+	if !slices.Equal(got[:len(want)], want) {
+		t.Errorf("/whoami = %q, want %q then the start time", got, want)
+	}
+	started, err := time.Parse("2006-01-02 15:04:05 MST", strings.TrimPrefix(got[len(got)-1], "Session started: "))
+	if err != nil || time.Since(started) > time.Minute {
+		t.Errorf("session start %q: want about now", got[len(got)-1])
+	}
+
+	// After a room change, going away and being made an admin
+	a.send("/join #dev")
+	a.expect("You joined #dev.")
+	a.send("/away lunch")
+	a.expect("away")
+	if err := s.promoteUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	a.send("/whoami")
+	got = a.until("Session started: ")
+	want = []string{"Username: " + alice, "Room: #dev", "Away: yes (lunch)", "Admin: yes", "Session: durable"}
+	if !slices.Equal(got[:len(want)], want) {
+		t.Errorf("/whoami = %q, want %q then the start time", got, want)
+	}
+}
+
+func TestRoleRooms(t *testing.T) {
+	roles, err := parseRoleRooms("admin=#mods, user=#lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{RoleRooms: roles})
+	admin, user := register(t, s), register(t, s)
+	if err := s.promoteUser(admin); err != nil {
+		t.Fatal(err)
+	}
+
+	tryLogin(t, s, admin).expect("--- now live in #mods ---")
+	tryLogin(t, s, user).expect("--- now live in #lobby ---")
+
+	if _, err := parseRoleRooms("owner=#x"); err == nil {
+		t.Error("parseRoleRooms accepted an unknown role")
+	}
+}
+
+func TestMessageFormat(t *testing.T) {
+	format, err := parseMessageFormat("[{{.Room}}] <{{.From}}> {{.Body}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Config{MessageFormat: format})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	a.send("hi there")
+	if line, want := b.expect("hi there"), "[#general] <"+alice+"> hi there"; line != want {
+		t.Errorf("broadcast = %q, want %q", line, want)
+	}
+
+	if _, err := parseMessageFormat("{{.Sender}}: {{.Body}}"); err == nil {
+		t.Error("parseMessageFormat accepted an unknown field")
+	}
+}
+
+func TestConnectionIDInLogs(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice := register(t, s)
+	logs := captureLog(t)
+	a := login(t, s, alice)
+	a.conn.Close()
+
+	connected := regexp.MustCompile(`\[([0-9a-f]+)\] Connection from pipe`)
+	var id string
+	waitFor(t, "the disconnect to be logged", func() bool {
+		m := connected.FindStringSubmatch(logs.String())
+		if m != nil {
+			id = m[1]
+		}
+		return m != nil && strings.Contains(logs.String(), "["+id+"] Disconnected")
+	})
+	if !strings.Contains(logs.String(), "["+id+"] Logged in as "+alice) {
+		t.Errorf("log = %q, want the login under connection %s", logs.String(), id)
+	}
+}
+
+func TestRegisterLimit(t *testing.T) {
+	s := newTestServer(t, Config{RegisterLimit: 2, RegisterWindow: time.Minute})
+	alice := register(t, s)
+	register(t, s)
+
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	c.expect("Too many registrations from your address. Please try again later.")
+
+	// Logins from the same address aren't held up
+	login(t, s, alice)
+}
+
+func TestAttemptsSwept(t *testing.T) {
+	s := newTestServer(t, Config{RegisterLimit: 2, RegisterWindow: time.Minute, AbandonLimit: 2, AbandonWindow: time.Minute})
+	stale := []time.Time{time.Now().Add(-time.Hour)}
+	s.attemptsMutex.Lock()
+	for i := range sweptIPs {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		s.registerAttempts[ip] = stale
+		s.abandoned[ip] = stale
+	}
+	s.attemptsMutex.Unlock()
+
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	s.checkRegisterAttempt(addr)
+	s.connectionAbandoned(addr)
+
+	s.attemptsMutex.Lock()
+	defer s.attemptsMutex.Unlock()
+	if len(s.registerAttempts) != 1 || len(s.abandoned) != 1 {
+		t.Errorf("after a sweep: %d IPs of registrations and %d of abandoned connections, want 1 each", len(s.registerAttempts), len(s.abandoned))
+	}
+}
+
+func TestIdleMarker(t *testing.T) {
+	s := newTestServer(t, Config{IdleAfter: 200 * time.Millisecond})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	time.Sleep(300 * time.Millisecond)
+	b.send("/who")
+	if online := b.expect("Online: "); !strings.Contains(online, alice+" (idle)") || strings.Contains(online, bob+" (idle)") {
+		t.Errorf("/who = %q, want only %s idle", online, alice)
+	}
+
+	a.send("back")
+	b.expect(alice + ": back")
+	b.send("/who")
+	if online := b.expect("Online: "); strings.Contains(online, "(idle)") {
+		t.Errorf("/who = %q after %s spoke, want nobody idle", online, alice)
+	}
+}
+
+func TestProtocolErrorLimit(t *testing.T) {
+	s := newTestServer(t, Config{ProtocolErrors: 3})
+	c := login(t, s, register(t, s))
+
+	c.send("bell\a")
+	c.expect("Malformed message ignored")
+	c.send("bad \xff utf-8")
+	c.expect("Malformed message ignored")
+	c.send("fine")
+	c.send("\x1b[2J")
+	if got := c.expectClosed(); len(got) == 0 || got[len(got)-1] != "Protocol error limit exceeded. Closing connection." {
+		t.Errorf("last lines %q, want the limit exceeded", got)
+	}
+}
+
+func TestPMReceipts(t *testing.T) {
+	s := newTestServer(t, Config{OfflineCap: 5})
+	alice, bob, carol := register(t, s), register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	a.send("/msg " + bob + " hello")
+	a.expect("[PM to " + bob + " (delivered)] hello")
+	a.send("/msg " + carol + " later")
+	a.expect("[PM to " + carol + " (queued)] later")
+
+	b.expect("[PM from " + alice + "] hello")
+	b.send("/read " + alice)
+	a.expect("[PM read by " + bob + "]")
+}
+
+func TestRoomLimits(t *testing.T) {
+	s := newTestServer(t, Config{MaxRooms: 3, MaxRoomMembers: 1})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	a.send("/join #dev")
+	a.expect("You joined #dev.")
+	b.send("/join #dev")
+	b.expect("#dev is full. Please try again later.")
+
+	a.send("/create #ops")
+	a.expect("You joined #ops.")
+	b.send("/join #dev")
+	b.expect("You joined #dev.")
+
+	a.send("/create #more")
+	a.expect("Can't create #more: the server's room limit has been reached.")
+	a.send("/join #more")
+	a.expect("Can't create #more: the server's room limit has been reached.")
+}
+
+func TestRestartSignal(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	s.restartCommand([]string{"2s"})
+	for _, c := range []*testConn{a, b} {
+		got := c.until("[restart] 2")
+		if len(got) < 2 || got[len(got)-2] != "Server restarting. Reconnect in ~2s." {
+			t.Errorf("before the restart signal: %q, want the notice", got)
+		}
+		c.expectClosed()
+	}
+	if _, err := s.ln.Dial(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("dialing after the restart: %v, want the listener closed", err)
+	}
+}
+
+func TestRoomTopic(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob, carol := register(t, s), register(t, s), register(t, s)
+	if err := s.promoteUser(carol); err != nil {
+		t.Fatalf("promoteUser: %v", err)
+	}
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	c := login(t, s, carol)
+
+	a.send("/join #dev")
+	a.expect("You joined #dev.")
+	a.send("/topic Deploys on Fridays")
+	a.expect("Topic of #dev set.")
+
+	b.send("/join #dev")
+	b.expect("You joined #dev.")
+	b.expect("Topic of #dev: Deploys on Fridays")
+	b.send("/topic No deploys")
+	b.expect("Only admins and moderators of #dev can set its topic.")
+	b.send("/topic")
+	b.expect("Topic of #dev: Deploys on Fridays")
+
+	c.send("/topic #dev Deploys on Tuesdays")
+	c.expect("Topic of #dev set.")
+	b.expect(carol + " set the topic of #dev: Deploys on Tuesdays")
+}
+
+// slowConn is a connection whose reads lag once slow is set, so that the
+// server's writes to it block.
+type slowConn struct {
+	net.Conn
+	slow atomic.Bool
+}
+
+func (c *slowConn) Read(p []byte) (int, error) {
+	if c.slow.Load() {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return c.Conn.Read(p)
+}
+
+func TestSlowClient(t *testing.T) {
+	logs := captureLog(t)
+	s := newTestServer(t, Config{SlowWrite: 20 * time.Millisecond, SlowWrites: 2, SlowDisconnect: true})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+
+	conn, err := s.ln.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	slow := &slowConn{Conn: conn}
+	b := newTestConn(t, slow)
+	b.expect("Enter 'login' or 'register'")
+	b.send("login")
+	b.expect("Username:")
+	b.send(bob)
+	b.expect("Password")
+	b.send(testPassword)
+	b.expect("--- now live in ")
+	a.expect(bob + " has joined the chat")
+
+	slow.slow.Store(true)
+	for i := 0; i < 4; i++ {
+		a.send(fmt.Sprintf("message %d", i))
+	}
+	b.expectClosed()
+	if got := logs.String(); !strings.Contains(got, "Slow client "+bob+": disconnecting") {
+		t.Errorf("log doesn't flag %s as slow:\n%s", bob, got)
+	}
+}
+
+func TestLogContent(t *testing.T) {
+	for _, logContent := range []bool{false, true} {
+		logs := captureLog(t)
+		s := newTestServer(t, Config{LogContent: logContent})
+		alice, bob := register(t, s), register(t, s)
+		a := login(t, s, alice)
+		b := login(t, s, bob)
+
+		a.send("the launch code is 0000")
+		b.expect("the launch code is 0000")
+		a.send("/msg " + bob + " meet at noon")
+		b.expect("meet at noon")
+		a.send("/join #dev")
+		a.expect("You joined #dev.")
+		a.send("/topic Secret plans")
+		a.expect("Topic of #dev set.")
+
+		got := logs.String()
+		for _, want := range []string{
+			"Message from " + alice + " to #general (23 bytes)",
+			"Message from " + alice + " to " + bob + " (12 bytes)",
+			alice + " set the topic of #dev",
+		} {
+			if !strings.Contains(got, want) {
+				t.Errorf("-log-content=%v: log has no %q:\n%s", logContent, want, got)
+			}
+		}
+		for _, body := range []string{"the launch code is 0000", "meet at noon", "Secret plans"} {
+			if strings.Contains(got, body) != logContent {
+				t.Errorf("-log-content=%v: logged %q: %v", logContent, body, !logContent)
+			}
+		}
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	s := newTestServer(t, Config{MaxSessions: 2})
+	alice := register(t, s)
+	first := login(t, s, alice)
+	login(t, s, alice)
+	tryLogin(t, s, alice).expect("Too many active sessions for this account.")
+
+	first.conn.Close()
+	waitFor(t, "the first session to end", func() bool {
+		s.clientsMutex.Lock()
+		defer s.clientsMutex.Unlock()
+		return s.sessions[alice] < 2
+	})
+	login(t, s, alice)
+}
+
+func TestAuthDelayGrows(t *testing.T) {
+	s := newTestServer(t, Config{AuthDelay: 50 * time.Millisecond, AuthDelayMax: 400 * time.Millisecond})
+	alice := register(t, s)
+
+	for _, want := range []time.Duration{50, 100, 200} {
+		start := time.Now()
+		tryLoginWith(t, s, alice, "wrong").expect("Invalid username or password.")
+		if took := time.Since(start); took < want*time.Millisecond {
+			t.Errorf("failed login answered after %s, want at least %dms", took, want)
+		}
+	}
+
+	// Doubling stops at the cap, and a successful login starts it over
+	for _, want := range []time.Duration{400, 400} {
+		if got := s.failedLogin(pipeAddr{}, alice); got != want*time.Millisecond {
+			t.Errorf("next delay %s, want %dms", got, want)
+		}
+	}
+	login(t, s, alice)
+	if got := s.failedLogin(pipeAddr{}, alice); got != 50*time.Millisecond {
+		t.Errorf("delay after logging in %s, want 50ms", got)
+	}
+}
+
+func TestBroadcastDuringChurn(t *testing.T) {
+	s := newTestServer(t, Config{SilentJoins: true})
+	alice, bob, carol := register(t, s), register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	const sends = 50
+	var wg sync.WaitGroup
+	for _, sender := range []string{"one", "two"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range sends {
+				s.broadcast(fmt.Sprintf("%s %d", sender, i), nil)
+			}
+		}()
+	}
+	// Logins and logouts change clients while the broadcasts read it
+	for range 5 {
+		c := login(t, s, carol)
+		c.conn.Close()
+	}
+	wg.Wait()
+	s.broadcast("done", nil)
+
+	for _, c := range []*testConn{a, b} {
+		next := map[string]int{}
+		for _, line := range c.until("done") {
+			sender, n, ok := strings.Cut(line, " ")
+			if !ok || (sender != "one" && sender != "two") {
+				continue
+			}
+			if n != fmt.Sprint(next[sender]) {
+				t.Errorf("got %q after %s %d, want each sender's lines in order", line, sender, next[sender]-1)
+			}
+			next[sender]++
+		}
+		if next["one"] != sends || next["two"] != sends {
+			t.Errorf("got %d and %d lines from the two senders, want %d each", next["one"], next["two"], sends)
+		}
+	}
+}
+
+func TestRoomModerators(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob, carol, dave := register(t, s), register(t, s), register(t, s), register(t, s)
+	if err := s.promoteUser(dave); err != nil {
+		t.Fatalf("promoteUser: %v", err)
+	}
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	c := login(t, s, carol)
+	d := login(t, s, dave)
+
+	a.send("/join #ops")
+	a.expect("You joined #ops.")
+	for _, conn := range []*testConn{a, b, c, d} {
+		conn.send("/join #dev")
+		conn.expect("You joined #dev.")
+	}
+	a.send("/mod " + bob)
+	a.expect(bob + " is now a moderator of #dev.")
+
+	b.send("/mute " + carol)
+	b.expect("Muted " + carol + " in #dev.")
+	c.send("can anyone hear me?")
+	c.expect("You are muted in #dev.")
+
+	// Admins and the room's creator are out of a moderator's reach
+	for _, cmd := range []string{"/kick " + dave, "/kick " + alice} {
+		b.send(cmd)
+		b.expect("You can't kick ")
+	}
+	for _, cmd := range []string{"/mute " + dave, "/mute " + alice} {
+		b.send(cmd)
+		b.expect("You can't mute ")
+	}
+
+	b.send("/kick " + carol)
+	b.expect("Kicked " + carol + " from #dev.")
+	c.expect("You were kicked from #dev by " + bob + ".")
+	c.expect("You joined #general.")
+
+	// Only in their own room, and with no admin rights
+	b.send("/join #ops")
+	b.expect("You joined #ops.")
+	b.send("/mute " + alice)
+	b.expect("Only admins and moderators of #ops can do that.")
+	b.send("/maintenance on")
+	b.expect("Permission denied.")
+}
+
+func TestMutedCantPMOrEdit(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true, EditWindow: time.Minute})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	s.groupCommand([]string{"add", "staff", bob})
+
+	a.send("/join #dev")
+	a.expect("You joined #dev.")
+	b.send("/join #dev")
+	b.expect("You joined #dev.")
+	b.send("before the mute")
+	a.expect(bob + ": before the mute")
+	a.send("/mute " + bob)
+	a.expect("Muted " + bob + " in #dev.")
+
+	for _, cmd := range []string{"/msg " + alice + " psst", "/msggroup staff psst", "/edit last after the mute"} {
+		b.send(cmd)
+		b.expect("You are muted in #dev.")
+	}
+	// Nothing got through before alice's own reply
+	a.send("/whoami")
+	for _, line := range a.until("Username: " + alice) {
+		if strings.Contains(line, "psst") || strings.Contains(line, "after the mute") {
+			t.Errorf("alice got %q from a muted user", line)
+		}
+	}
+
+	// Read-only maintenance stops them for everyone else too
+	a.send("/unmute " + bob)
+	a.expect("Unmuted " + bob + " in #dev.")
+	s.maintenanceCommand([]string{"on", "readonly"})
+	b.send("/msg " + alice + " psst")
+	b.expect("Messages are disabled during maintenance.")
+}
+
+func TestRequireApproval(t *testing.T) {
+	s := newTestServer(t, Config{RequireApproval: true})
+	alice := register(t, s)
+	tryLogin(t, s, alice).expect("Your account is awaiting approval by an admin. Please try again later.")
+	if got, want := s.approveCommand(nil), "Awaiting approval: "+alice; got != want {
+		t.Errorf("/approve = %q, want %q", got, want)
+	}
+
+	s.approveCommand([]string{alice})
+	login(t, s, alice)
+	if got, want := s.approveCommand(nil), "No accounts are awaiting approval."; got != want {
+		t.Errorf("/approve after approving = %q, want %q", got, want)
+	}
+	if got, want := s.approveCommand([]string{alice}), "No account "+alice+" is awaiting approval."; got != want {
+		t.Errorf("approving again = %q, want %q", got, want)
+	}
+}
+
+func TestOversizePolicy(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		s := newTestServer(t, Config{MaxMessage: 5, TruncateLong: truncate})
+		alice, bob := register(t, s), register(t, s)
+		a := login(t, s, alice)
+		b := login(t, s, bob)
+
+		a.send("héllo")
+		b.expect(alice + ": héllo")
+		a.send("hello, bob")
+		a.send("/msg " + bob + " hello, bob")
+		if truncate {
+			a.expect("Message too long; sent only its first 4 characters.")
+			b.expect(alice + ": hell…")
+			b.expect("[PM from " + alice + "] hell…")
+			continue
+		}
+		a.expect("Message too long (10 characters, the limit is 5). Not sent.")
+		a.expect("Message too long (10 characters, the limit is 5). Not sent.")
+		a.send("ok")
+		for _, line := range b.until(alice + ": ok") {
+			if strings.Contains(line, "hell") {
+				t.Errorf("bob got %q, want it refused", line)
+			}
+		}
+	}
+}
+
+func TestConcurrentAccounts(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true, HistoryLines: 20, SilentJoins: true})
+	const users = 10
+	logs := captureLog(t)
+
+	// Registrations, logins, history replays and stored messages all share
+	// the one database connection at once
+	names := make([]string, users)
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			names[i] = register(t, s)
+			c := login(t, s, names[i])
+			c.send("hello from " + names[i])
+			c.send("/whoami")
+			c.expect("Username: " + names[i])
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	var stored int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&stored); err != nil || stored != users {
+		t.Errorf("users table has %d rows (%v), want %d", stored, err, users)
+	}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&stored); err != nil || stored != users {
+		t.Errorf("messages table has %d rows (%v), want %d", stored, err, users)
+	}
+	for _, bad := range []string{"no such table", "database is locked", "Error"} {
+		if strings.Contains(logs.String(), bad) {
+			t.Errorf("log = %q, want no %q", logs.String(), bad)
+		}
+	}
+}
+
+func TestDatabaseLifetime(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true})
+	var users []string
+	for i := range 20 {
+		users = append(users, register(t, s))
+		c := login(t, s, users[i])
+		c.send(fmt.Sprint("message ", i))
+		c.send("/whoami")
+		c.expect("Username: " + users[i])
+		c.conn.Close()
+		// Long enough for the pool to have let go of an idle connection
+		time.Sleep(10 * time.Millisecond)
+	}
+	login(t, s, users[0])
+
+	var stored, messages int
+	s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&stored)
+	s.db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&messages)
+	if stored != len(users) || messages != len(users) {
+		t.Errorf("%d users and %d messages stored, want %d of each", stored, messages, len(users))
+	}
+
+	// Once the one connection has gone, queries fail rather than find a new,
+	// empty database
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&stored); !errors.Is(err, errDatabaseLost) {
+		t.Errorf("query after losing the connection: %v, want errDatabaseLost", err)
+	}
+}
+
+func TestMaxAccounts(t *testing.T) {
+	s := newTestServer(t, Config{MaxAccounts: 2})
+	alice := register(t, s)
+
+	// A registration under way when the last account goes is refused at
+	// the end
+	late := s.dial(t)
+	late.expect("Enter 'login' or 'register'")
+	late.send("register")
+	late.expect("registration code")
+	late.send(testRegKey)
+	late.expect("Enter your desired password")
+	register(t, s)
+	late.send(testPassword)
+	late.expect("Registration closed: account limit reached.")
+
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	if got := c.expectClosed(); !slices.Contains(got, "Registration closed: account limit reached.") {
+		t.Errorf("registering past the limit got %q, want it refused", got)
+	}
+	var accounts int
+	s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&accounts)
+	if accounts != 2 {
+		t.Errorf("%d accounts stored, want 2", accounts)
+	}
+
+	// Existing accounts still log in
+	login(t, s, alice)
+}
+
+func TestGroupMessages(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice, bob, carol, dave := register(t, s), register(t, s), register(t, s), register(t, s)
+	if err := s.promoteUser(dave); err != nil {
+		t.Fatal(err)
+	}
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	c := login(t, s, carol)
+	d := login(t, s, dave)
+
+	d.send("/group add staff " + alice)
+	d.expect("Added " + alice + " to staff.")
+	d.send("/group add staff " + bob)
+	d.expect("Added " + bob + " to staff.")
+	c.send("/group add staff " + carol)
+	c.expect("Permission denied.")
+	// The client would take "[md] ..." lines for its own
+	d.send("/group add md " + alice)
+	d.expect("The group name md is reserved.")
+
+	// Members get it whatever room they're in
+	b.send("/join #dev")
+	b.expect("You joined #dev.")
+	a.send("/msggroup staff standup in five")
+	a.expect("[to staff (1 online)] standup in five")
+	b.expect("[staff] " + alice + ": standup in five")
+
+	c.send("/msggroup staff let me in")
+	c.expect("Only admins and members of staff can message it.")
+	d.send("/msggroup staff from the top")
+	d.expect("[to staff (2 online)] from the top")
+	a.expect("[staff] " + dave + ": from the top")
+	b.expect("[staff] " + dave + ": from the top")
+
+	c.send("/whoami")
+	for _, line := range c.until("Username: " + carol) {
+		if strings.Contains(line, "[staff]") {
+			t.Errorf("%s, not in staff, got %q", carol, line)
+		}
+	}
+	b.send("/msggroup staff done")
+	for _, line := range a.until("[staff] " + bob + ": done") {
+		if strings.Contains(line, "let me in") {
+			t.Errorf("%s got %q from a non-member", alice, line)
+		}
+	}
+}
+
+func TestFirstAdmin(t *testing.T) {
+	s := newTestServer(t, Config{FirstAdmin: true, RequireApproval: true})
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	c.expect("registration code")
+	c.send(testRegKey)
+	alice := strings.TrimPrefix(c.expect("Your randomly generated username is: "), "Your randomly generated username is: ")
+	c.expect("Enter your desired password")
+	c.send(testPassword)
+	c.expect("Registration successful! As the server's first account, you're an admin. You can now login.")
+
+	c = s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("register")
+	c.expect("registration code")
+	c.send(testRegKey)
+	bob := strings.TrimPrefix(c.expect("Your randomly generated username is: "), "Your randomly generated username is: ")
+	c.expect("Enter your desired password")
+	c.send(testPassword)
+	c.expect("An admin must approve your account before you can log in.")
+
+	// The first account skips approval and can act as an admin; the second
+	// is neither
+	a := login(t, s, alice)
+	a.send("/approve " + bob)
+	a.expect("Approved " + bob)
+	b := login(t, s, bob)
+	b.send("/group list")
+	b.expect("Permission denied.")
+}
+
+func TestIdleRoomsRemoved(t *testing.T) {
+	s := newTestServer(t, Config{RoomIdle: 100 * time.Millisecond})
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	for _, room := range []string{"#dev", "#general"} {
+		a.send("/join " + room)
+		a.expect("You joined " + room + ".")
+	}
+	b.send("/join #ops")
+	b.expect("You joined #ops.")
+	time.Sleep(150 * time.Millisecond)
+	// Only just emptied, so not idle yet
+	for _, room := range []string{"#fresh", "#general"} {
+		a.send("/join " + room)
+		a.expect("You joined " + room + ".")
+	}
+
+	s.removeIdleRooms()
+	a.send("/rooms")
+	if got, want := a.expect("Rooms: "), "Rooms: #fresh (0), #general (1), #ops (1)"; got != want {
+		t.Errorf("/rooms = %q, want %q", got, want)
+	}
+}
+
+// messageID returns the ID withMessageID gave line, or 0 if it has none.
+func messageID(line string) int64 {
+	rest, ok := strings.CutPrefix(line, messageIDPrefix)
+	if !ok {
+		return 0
+	}
+	num, _, _ := strings.Cut(rest, "] ")
+	id, _ := strconv.ParseInt(num, 10, 64)
+	return id
+}
+
+func TestReportReachesModerators(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true})
+	alice, bob, carol, dave := register(t, s), register(t, s), register(t, s), register(t, s)
+	if err := s.promoteUser(dave); err != nil {
+		t.Fatal(err)
+	}
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	c := login(t, s, carol)
+	d := login(t, s, dave)
+
+	a.send("/join #dev")
+	a.expect("You joined #dev.")
+	for _, x := range []*testConn{b, c} {
+		x.send("/join #dev")
+		x.expect("You joined #dev.")
+	}
+	c.send("buy my stuff")
+	line := b.expect(carol + ": buy my stuff")
+	id := messageID(line)
+	if id == 0 {
+		t.Fatalf("message line %q has no ID", line)
+	}
+
+	b.send(fmt.Sprintf("/report %d spam", id))
+	b.expect(fmt.Sprintf("Reported message %d to the moderators of #dev.", id))
+	want := fmt.Sprintf("[report] %s reported message %d in #dev, from %s: %q Reason: spam", bob, id, carol, "buy my stuff")
+	a.expect(want) // the room's creator
+	d.expect(want) // an admin, wherever they are
+	c.send("/whoami")
+	for _, line := range c.until("Username: " + carol) {
+		if strings.Contains(line, "[report]") {
+			t.Errorf("%s, no moderator, got %q", carol, line)
+		}
+	}
+
+	// It's kept for /reports, and IDs from other rooms can't be reported
+	if got := s.reportsCommand(nil); !strings.Contains(got, fmt.Sprintf("%s reported message %d in #dev, from %s", bob, id, carol)) {
+		t.Errorf("/reports = %q, want bob's report", got)
+	}
+	d.send(fmt.Sprintf("/report %d spam", id))
+	d.expect(fmt.Sprintf("No message %d in #general.", id))
+}
+
+func TestBannerStatus(t *testing.T) {
+	s := newTestServer(t, Config{Banner: "Hello", BannerStatus: true, MaxAccounts: 2})
+	banner := func() []string {
+		c := s.dial(t)
+		c.expect(bannerStart)
+		return c.until(bannerEnd)
+	}
+	check := func(want ...string) {
+		t.Helper()
+		want = append([]string{"Hello", ""}, append(want, bannerEnd)...)
+		if got := banner(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("banner = %q, want %q", got, want)
+		}
+	}
+
+	check("Users online: 0", "Registration: open")
+	alice := register(t, s)
+	register(t, s)
+	// Two sessions are one user
+	login(t, s, alice)
+	login(t, s, alice)
+	check("Users online: 1", "Registration: closed (account limit reached)")
+	s.maintenanceCommand([]string{"on"})
+	check("Users online: 1", "Registration: closed (account limit reached)", "Maintenance: only admins can log in")
+}
+
+func TestRoomPersistenceIsPerRoom(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true, RoomPersistence: map[string]persistPolicy{"#dev": persistNone, "#ops": persistEncrypted}})
+	alice := register(t, s)
+	a := login(t, s, alice)
+	for _, room := range []string{"#general", "#dev", "#ops", "#qa"} {
+		if room != "#general" {
+			a.send("/join " + room)
+			a.expect("You joined " + room + ".")
+		}
+		a.send("said in " + room)
+	}
+	a.send("/whoami")
+	a.expect("Username: " + alice)
+
+	rows, err := s.db.Query("SELECT room, body, encrypted FROM messages ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	stored := map[string]string{}
+	for rows.Next() {
+		var room, body string
+		var encrypted bool
+		if err := rows.Scan(&room, &body, &encrypted); err != nil {
+			t.Fatal(err)
+		}
+		stored[room] = body
+		switch {
+		case room == "#ops" && (!encrypted || strings.Contains(body, "said in")):
+			t.Errorf("#ops stored %q (encrypted %v), want it sealed", body, encrypted)
+		case room == "#ops":
+			if got := s.openBody(room, body, true); got != "said in #ops" {
+				t.Errorf("#ops body opens to %q", got)
+			}
+			if got := s.openBody("#qa", body, true); got != unreadableBody {
+				t.Errorf("#ops body opened as #qa's: %q", got)
+			}
+		case encrypted || body != "said in "+room:
+			t.Errorf("%s stored %q (encrypted %v), want it as sent", room, body, encrypted)
+		}
+	}
+	if _, ok := stored["#dev"]; ok || len(stored) != 3 {
+		t.Errorf("stored messages for %v, want #general, #ops and #qa but not #dev", stored)
+	}
+}
+
+func TestReservedUsernames(t *testing.T) {
+	s := newTestServer(t, Config{})
+	for _, name := range []string{"online", "Server", "HELP", "you", "/who"} {
+		if _, err := s.createUser(name, hashPassword(testPassword, 1000), true); !errors.Is(err, errReservedUsername) {
+			t.Errorf("createUser(%q) = %v, want errReservedUsername", name, err)
+		}
+	}
+	if got, want := s.inviteCommand([]string{"Online"}), "The username Online is reserved."; got != want {
+		t.Errorf("/invite Online = %q, want %q", got, want)
+	}
+
+	// An invite signed for a reserved name some other way still can't
+	// register it
+	c := sendCode(t, s, s.signInvite("console", time.Now().Add(time.Hour)))
+	c.expect("Your invited username is: console")
+	c.expect("Enter your desired password")
+	c.send(testPassword)
+	c.expect("That username is reserved. Please register again.")
+
+	var accounts int
+	s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&accounts)
+	if accounts != 0 {
+		t.Errorf("%d accounts stored, want none", accounts)
+	}
+	// Names merely containing one are fine
+	if _, err := s.createUser("online_bob", hashPassword(testPassword, 1000), true); err != nil {
+		t.Errorf("createUser(online_bob) = %v", err)
+	}
+}
+
+func TestEphemeralSessions(t *testing.T) {
+	s := newTestServer(t, Config{Persist: true, Sessions: sessionsChoice})
+	alice, bob := register(t, s), register(t, s)
+	b := login(t, s, bob)
+	logs := captureLog(t)
+
+	a := s.dial(t)
+	a.expect("Enter 'login' or 'register'")
+	a.send("login ephemeral")
+	a.expect("Username:")
+	a.send(alice)
+	a.expect("Password")
+	a.send(testPassword)
+	a.expect("This session is ephemeral: your messages aren't kept in history or logged.")
+	a.expect("--- now live in ")
+	a.send("/whoami")
+	a.expect("Session: ephemeral")
+
+	a.send("off the record")
+	b.expect(alice + ": off the record")
+	b.send("on the record")
+	a.expect(bob + ": on the record")
+
+	var bodies []string
+	rows, err := s.db.Query("SELECT body FROM messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var body string
+		rows.Scan(&body)
+		bodies = append(bodies, body)
+	}
+	rows.Close()
+	if !slices.Equal(bodies, []string{"on the record"}) {
+		t.Errorf("stored %q, want only the durable session's message", bodies)
+	}
+	if strings.Contains(logs.String(), "Message from "+alice) {
+		t.Errorf("log = %q, want nothing from the ephemeral session's messages", logs.String())
+	}
+
+	// Only where the policy allows
+	s.config.Sessions = sessionsDurable
+	c := s.dial(t)
+	c.expect("Enter 'login' or 'register'")
+	c.send("login ephemeral")
+	c.expect("This server doesn't allow ephemeral sessions. Enter 'login' or 'register'")
+}
+
+func TestPreferencesFollowLogin(t *testing.T) {
+	s := newTestServer(t, Config{})
+	alice := register(t, s)
+	a := login(t, s, alice)
+	a.send("/set notify pm")
+	a.expect("[pref] notify pm")
+	a.expect("Saved preference notify: pm")
+	a.send("/set ids on")
+	a.expect("Saved preference ids: on")
+
+	// A new session gets them straight after the welcome
+	lines := tryLogin(t, s, alice).until("--- now live in ")
+	welcome := slices.IndexFunc(lines, func(line string) bool { return strings.HasPrefix(line, "Welcome back, ") })
+	if welcome < 0 || !slices.Contains(lines[welcome:], "[pref] notify pm") || !slices.Contains(lines[welcome:], "[pref] ids on") {
+		t.Errorf("login lines %q, want the preferences after the welcome", lines)
+	}
+}
@@ -0,0 +1,62 @@
+// sessions.go
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Ephemeral sessions: a user can log in with "login ephemeral" rather than
+// "login", and nothing they send in that session is kept in room history or
+// logged; "login durable" asks for the usual kind. -sessions bounds what
+// users may pick. PMs queued for an offline recipient are still queued,
+// since that's delivery rather than history.
+
+// sessionPolicy is which kinds of session users may log in with.
+type sessionPolicy int
+
+const (
+	sessionsDurable   sessionPolicy = iota // durable only
+	sessionsChoice                         // either; durable unless asked
+	sessionsEphemeral                      // ephemeral only
+)
+
+// parseSessionPolicy parses the -sessions flag.
+func parseSessionPolicy(name string) (sessionPolicy, error) {
+	switch name {
+	case "durable":
+		return sessionsDurable, nil
+	case "choice":
+		return sessionsChoice, nil
+	case "ephemeral":
+		return sessionsEphemeral, nil
+	}
+	return 0, fmt.Errorf("unknown session policy %q (want durable, choice or ephemeral)", name)
+}
+
+// parseLoginChoice splits a login/register answer into the choice and, for
+// login, the kind of session asked for with it ("" when none was). ok is
+// false for anything else.
+func parseLoginChoice(answer string) (choice, kind string, ok bool) {
+	fields := strings.Fields(strings.ToLower(answer))
+	switch {
+	case len(fields) == 1 && (fields[0] == "login" || fields[0] == "register"):
+		return fields[0], "", true
+	case len(fields) == 2 && fields[0] == "login" && (fields[1] == "ephemeral" || fields[1] == "durable"):
+		return fields[0], fields[1], true
+	}
+	return "", "", false
+}
+
+// sessionEphemeral returns whether a login asking for kind of session (see
+// parseLoginChoice) is ephemeral under the server's policy, and false for
+// allowed when that kind isn't allowed at all.
+func (s *Server) sessionEphemeral(kind string) (ephemeral, allowed bool) {
+	switch s.config.Sessions {
+	case sessionsChoice:
+		return kind == "ephemeral", true
+	case sessionsEphemeral:
+		return true, kind != "durable"
+	}
+	return false, kind != "ephemeral"
+}
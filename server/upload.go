@@ -0,0 +1,270 @@
+// upload.go
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// uploadTokenTTL is how long a token from /upload stays valid.
+const uploadTokenTTL = 10 * time.Minute
+
+// uploadNamePattern restricts the file names uploads are stored and shared
+// under.
+var uploadNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,127}$`)
+
+// upload is a file in UploadDir that chat messages can refer to. It is
+// stored on disk under its ID; name is only what it's shared as.
+type upload struct {
+	name   string
+	size   int64
+	owner  string
+	stored time.Time
+}
+
+// uploadToken lets its owner upload one file until it expires.
+type uploadToken struct {
+	owner   string
+	expires time.Time
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate random token: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// uploadCommand handles /upload: it issues a one-time upload token and tells
+// the client where to send the file.
+func (s *Server) uploadCommand(client *Client) {
+	if s.config.UploadURL == "" {
+		client.println("File uploads are disabled on this server.")
+		return
+	}
+	token := randomHex(16)
+	s.uploadsMutex.Lock()
+	for t, issued := range s.uploadTokens {
+		if time.Now().After(issued.expires) {
+			delete(s.uploadTokens, t)
+		}
+	}
+	s.uploadTokens[token] = uploadToken{owner: client.username, expires: time.Now().Add(uploadTokenTTL)}
+	s.uploadsMutex.Unlock()
+	client.printf("Upload a file with: curl -T <file> %s/upload/%s/ (one use, expires in %s)\n",
+		s.config.UploadURL, token, uploadTokenTTL)
+}
+
+// attachCommand handles /attach <url>: the reference must name a file
+// uploaded to this server, which is then shared with the client's room.
+func (s *Server) attachCommand(client *Client, ref string) {
+	rest, ok := strings.CutPrefix(ref, s.config.UploadURL+"/files/")
+	if s.config.UploadURL == "" || !ok {
+		client.println("Not a file uploaded to this server.")
+		return
+	}
+	id, name, _ := strings.Cut(rest, "/")
+	s.expireUploads()
+	s.uploadsMutex.Lock()
+	u, exists := s.uploads[id]
+	s.uploadsMutex.Unlock()
+	if !exists || u.name != name {
+		client.println("Not a file uploaded to this server.")
+		return
+	}
+
+	room := s.currentRoom(client)
+	if !s.mayPost(client, room) {
+		return
+	}
+	s.broadcastRoom(room, fmt.Sprintf("[file from %s] %s (%d bytes)", client.username, ref, u.size), client)
+	client.printf("Shared %s with %s.\n", u.name, room)
+}
+
+// uploadHandler serves the upload endpoint: PUT /upload/{token}/{name}
+// stores a file and replies with its reference URL, and
+// GET /files/{id}/{name} downloads it.
+func (s *Server) uploadHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("PUT /upload/{token}/{name}", s.handleUpload)
+	mux.HandleFunc("GET /files/{id}/{name}", s.handleDownload)
+	return mux
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	// Tokens are single use, so take it whatever happens next
+	s.uploadsMutex.Lock()
+	token, ok := s.uploadTokens[r.PathValue("token")]
+	delete(s.uploadTokens, r.PathValue("token"))
+	s.uploadsMutex.Unlock()
+	if !ok || time.Now().After(token.expires) {
+		http.Error(w, "Invalid or expired upload token. Get a new one with /upload.", http.StatusForbidden)
+		return
+	}
+	name := r.PathValue("name")
+	if !uploadNamePattern.MatchString(name) {
+		http.Error(w, "File names may only contain letters, digits, '.', '_' and '-'.", http.StatusBadRequest)
+		return
+	}
+
+	s.expireUploads()
+	left := s.uploadAllowance(token.owner)
+	if left <= 0 {
+		http.Error(w, "Upload quota reached. Wait for older uploads to expire.", http.StatusInsufficientStorage)
+		return
+	}
+
+	// The body is cut off at whichever limit is nearer, so an upload can't
+	// fill the disk before the quota is checked
+	id := randomHex(8)
+	path := filepath.Join(s.config.UploadDir, id)
+	size, err := saveUpload(path, http.MaxBytesReader(w, r.Body, min(s.config.UploadMax, left)))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooBig) && left < s.config.UploadMax:
+			http.Error(w, fmt.Sprintf("Upload quota exceeded (%d bytes left).", left), http.StatusInsufficientStorage)
+		case errors.As(err, &tooBig):
+			http.Error(w, fmt.Sprintf("File too large (max %d bytes).", s.config.UploadMax), http.StatusRequestEntityTooLarge)
+		default:
+			log.Printf("Failed to store upload from %s: %v", token.owner, err)
+			http.Error(w, "Failed to store the file.", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Checked again as it's counted, in case uploads running side by side
+	// took the space meanwhile
+	s.uploadsMutex.Lock()
+	fits := s.uploadAllowanceLocked(token.owner) >= size
+	if fits {
+		s.uploads[id] = &upload{name: name, size: size, owner: token.owner, stored: time.Now()}
+	}
+	s.uploadsMutex.Unlock()
+	if !fits {
+		os.Remove(path)
+		http.Error(w, "Upload quota exceeded. Wait for older uploads to expire.", http.StatusInsufficientStorage)
+		return
+	}
+	log.Printf("%s uploaded %s (%d bytes) as %s", token.owner, name, size, id)
+
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "Uploaded. Share it in the chat with: /attach %s/files/%s/%s\n", s.config.UploadURL, id, name)
+}
+
+// uploadAllowance returns how many more bytes owner may upload under
+// UploadUserQuota and UploadTotalQuota; it's at most UploadMax.
+func (s *Server) uploadAllowance(owner string) int64 {
+	s.uploadsMutex.Lock()
+	defer s.uploadsMutex.Unlock()
+	return s.uploadAllowanceLocked(owner)
+}
+
+// uploadAllowanceLocked is uploadAllowance for a caller holding uploadsMutex.
+func (s *Server) uploadAllowanceLocked(owner string) int64 {
+	var mine, total int64
+	for _, u := range s.uploads {
+		total += u.size
+		if u.owner == owner {
+			mine += u.size
+		}
+	}
+	left := s.config.UploadMax
+	if quota := s.config.UploadUserQuota; quota > 0 {
+		left = min(left, quota-mine)
+	}
+	if quota := s.config.UploadTotalQuota; quota > 0 {
+		left = min(left, quota-total)
+	}
+	return left
+}
+
+// expireUploads deletes the uploads stored longer than UploadTTL ago, from
+// disk and from the list, so links to them stop working and their space
+// counts towards the quotas again.
+func (s *Server) expireUploads() {
+	if s.config.UploadTTL <= 0 {
+		return
+	}
+	var expired []string
+	s.uploadsMutex.Lock()
+	for id, u := range s.uploads {
+		if time.Since(u.stored) >= s.config.UploadTTL {
+			delete(s.uploads, id)
+			expired = append(expired, id)
+		}
+	}
+	s.uploadsMutex.Unlock()
+	for _, id := range expired {
+		if err := os.Remove(filepath.Join(s.config.UploadDir, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove expired upload %s: %v", id, err)
+			continue
+		}
+		log.Printf("Removed upload %s after %s", id, s.config.UploadTTL)
+	}
+}
+
+// cleanupUploads runs expireUploads a few times per UploadTTL, so expired
+// files are removed even when nobody uploads or downloads.
+func (s *Server) cleanupUploads() {
+	ticker := time.NewTicker(max(s.config.UploadTTL/4, time.Second))
+	defer ticker.Stop()
+	for range ticker.C {
+		s.expireUploads()
+	}
+}
+
+// saveUpload writes body to a new file at path, removing it again if the
+// body can't be read in full.
+func saveUpload(path string, body io.Reader) (int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(f, body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	s.expireUploads()
+	id := r.PathValue("id")
+	s.uploadsMutex.Lock()
+	u, exists := s.uploads[id]
+	s.uploadsMutex.Unlock()
+	if !exists || u.name != r.PathValue("name") {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.config.UploadDir, id))
+	if err != nil {
+		log.Printf("Failed to open upload %s: %v", id, err)
+		http.Error(w, "File unavailable.", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Always a download, never rendered by the browser
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", u.name))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
@@ -0,0 +1,135 @@
+// upload_test.go
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadAndAttach(t *testing.T) {
+	s := newTestServer(t, Config{UploadDir: t.TempDir(), UploadMax: 1 << 20})
+	web := httptest.NewServer(s.uploadHandler())
+	defer web.Close()
+	s.config.UploadURL = web.URL
+	alice, bob := register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+
+	a.send("/upload")
+	_, link, _ := strings.Cut(a.expect("Upload a file with: curl -T <file> "), "curl -T <file> ")
+	link, _, _ = strings.Cut(link, " ")
+	req, err := http.NewRequest(http.MethodPut, link+"hello.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := do(t, req, http.StatusCreated)
+	_, ref, ok := strings.Cut(strings.TrimSpace(reply), "/attach ")
+	if !ok || !strings.HasPrefix(ref, web.URL+"/files/") || !strings.HasSuffix(ref, "/hello.txt") {
+		t.Fatalf("upload reply %q, want a reference to the file", reply)
+	}
+
+	a.send("/attach " + ref)
+	a.expect("Shared hello.txt with #general.")
+	b.expect("[file from " + alice + "] " + ref + " (5 bytes)")
+
+	req, _ = http.NewRequest(http.MethodGet, ref, nil)
+	if got := do(t, req, http.StatusOK); got != "hello" {
+		t.Errorf("download = %q, want the file", got)
+	}
+
+	// Sharing is posting, so read-only maintenance stops it
+	s.maintenanceCommand([]string{"on", "readonly"})
+	a.send("/attach " + ref)
+	a.expect("Messages are disabled during maintenance.")
+	s.maintenanceCommand([]string{"off"})
+
+	// Tokens are single use, and references must be real
+	req, _ = http.NewRequest(http.MethodPut, link+"again.txt", strings.NewReader("again"))
+	do(t, req, http.StatusForbidden)
+	a.send("/attach " + web.URL + "/files/0000/hello.txt")
+	a.expect("Not a file uploaded to this server.")
+}
+
+// do sends req, checks the response has status want and returns its body.
+func do(t *testing.T, req *http.Request, want int) string {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: %s %q, want status %d", req.Method, req.URL, resp.Status, body, want)
+	}
+	return string(body)
+}
+
+// uploadLink asks for an upload token as c and returns the link to PUT a
+// file under, up to its name.
+func uploadLink(t *testing.T, c *testConn) string {
+	t.Helper()
+	c.send("/upload")
+	_, link, _ := strings.Cut(c.expect("Upload a file with: curl -T <file> "), "curl -T <file> ")
+	link, _, _ = strings.Cut(link, " ")
+	return link
+}
+
+func TestUploadQuotas(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t, Config{UploadDir: dir, UploadMax: 1 << 20, UploadUserQuota: 8, UploadTotalQuota: 12, UploadTTL: time.Hour})
+	web := httptest.NewServer(s.uploadHandler())
+	defer web.Close()
+	s.config.UploadURL = web.URL
+	alice, bob, carol := register(t, s), register(t, s), register(t, s)
+	a := login(t, s, alice)
+	b := login(t, s, bob)
+	c := login(t, s, carol)
+
+	put := func(conn *testConn, body string, want int) string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPut, uploadLink(t, conn)+"file.txt", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return do(t, req, want)
+	}
+	reply := put(a, "12345", http.StatusCreated)
+	_, ref, _ := strings.Cut(strings.TrimSpace(reply), "/attach ")
+	if got := put(a, "12345", http.StatusInsufficientStorage); !strings.Contains(got, "Upload quota exceeded (3 bytes left).") {
+		t.Errorf("over the user quota: %q", got)
+	}
+	put(b, "12345", http.StatusCreated)
+	if got := put(c, "12345", http.StatusInsufficientStorage); !strings.Contains(got, "Upload quota exceeded (2 bytes left).") {
+		t.Errorf("over the total quota: %q", got)
+	}
+	// Refused uploads leave nothing behind
+	if files, _ := os.ReadDir(dir); len(files) != 2 {
+		t.Errorf("%d files in the upload directory, want the 2 accepted", len(files))
+	}
+
+	// Once alice's upload has expired, it's gone and its space is free again
+	s.uploadsMutex.Lock()
+	for _, u := range s.uploads {
+		if u.owner == alice {
+			u.stored = u.stored.Add(-2 * time.Hour)
+		}
+	}
+	s.uploadsMutex.Unlock()
+	req, _ := http.NewRequest(http.MethodGet, ref, nil)
+	do(t, req, http.StatusNotFound)
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files in the upload directory after expiry, want 1", len(files))
+	}
+	a.send("/attach " + ref)
+	a.expect("Not a file uploaded to this server.")
+	put(a, "1234567", http.StatusCreated)
+}